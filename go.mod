@@ -9,6 +9,7 @@ require (
 	github.com/charmbracelet/bubbletea v0.15.0
 	github.com/charmbracelet/lipgloss v0.4.0
 	github.com/containerd/console v1.0.3
+	github.com/go-git/go-git/v5 v5.4.2
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/maxmcd/dag v0.0.0-20210909010249-5757e2034a95
 	github.com/mholt/archiver/v3 v3.5.0
@@ -27,8 +28,11 @@ require (
 	go.opentelemetry.io/otel/trace v1.2.0
 	go.starlark.net v0.0.0-20210901212718-87f333178d59
 	go.uber.org/zap v1.19.1
-	golang.org/x/mod v0.4.2
-	golang.org/x/sys v0.0.0-20211007075335-d3039528d8ac
+	golang.org/x/crypto v0.10.0 // indirect
+	golang.org/x/mod v0.10.0
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.10.0
+	golang.org/x/term v0.10.0 // indirect
 	gotest.tools/v3 v3.0.3 // indirect
 )
 
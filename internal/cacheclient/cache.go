@@ -13,6 +13,7 @@ import (
 	"github.com/maxmcd/bramble/internal/store"
 	"github.com/maxmcd/bramble/pkg/chunkedarchive"
 	"github.com/maxmcd/bramble/pkg/httpx"
+	"github.com/pkg/errors"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
@@ -20,6 +21,7 @@ type cacheClient interface {
 	PostChunk(context.Context, io.Reader) (string, error)
 	PostDerivation(context.Context, store.Derivation) (string, error)
 	PostOutput(context.Context, store.OutputRequestBody) error
+	Missing(context.Context, store.CacheObjects) (store.CacheObjects, error)
 }
 
 type Client struct {
@@ -27,7 +29,11 @@ type Client struct {
 	client *http.Client
 }
 
-var _ cacheClient = new(Client)
+var (
+	_ cacheClient       = new(Client)
+	_ store.CacheClient = new(Client)
+	_ store.Substituter = new(Client)
+)
 
 func New(host string) *Client {
 	return &Client{
@@ -38,6 +44,20 @@ func New(host string) *Client {
 	}
 }
 
+// NewWithToken returns a client that authenticates every request with a
+// bearer token
+func NewWithToken(host, token string) *Client {
+	return &Client{
+		host: host,
+		client: &http.Client{
+			Transport: httpx.BearerTokenTransport{
+				Token:     token,
+				Transport: otelhttp.NewTransport(http.DefaultTransport),
+			},
+		},
+	}
+}
+
 func (cc *Client) request(ctx context.Context, method, path, contentType string, body io.Reader, resp interface{}) (err error) {
 	url := fmt.Sprintf("%s/%s",
 		strings.TrimSuffix(cc.host, "/"),
@@ -77,13 +97,26 @@ func (cc *Client) PostChunk(ctx context.Context, chunk io.Reader) (hash string,
 		&hash)
 }
 
+func (cc *Client) Missing(ctx context.Context, objects store.CacheObjects) (missing store.CacheObjects, err error) {
+	b, err := json.Marshal(objects)
+	if err != nil {
+		return missing, err
+	}
+	return missing, cc.request(ctx,
+		http.MethodPost,
+		"/missing",
+		"application/json",
+		bytes.NewBuffer(b),
+		&missing)
+}
+
 func (cc *Client) GetDerivation(ctx context.Context, filename string) (drv store.Derivation, exists bool, err error) {
 	err = cc.request(ctx,
 		http.MethodGet,
 		"/derivation/"+filename,
 		"",
 		nil,
-		drv)
+		&drv)
 	if err == os.ErrNotExist {
 		return drv, false, nil
 	}
@@ -111,3 +144,76 @@ func (cc *Client) GetChunk(ctx context.Context, hash string, chunk io.Writer) (e
 		nil,
 		chunk)
 }
+
+// RemoteBuilder builds derivations on a bramble server. Build inputs and
+// outputs are sent through the server's cache, which is served at /cache.
+type RemoteBuilder struct {
+	*Client
+	url string
+}
+
+var _ store.RemoteBuilder = new(RemoteBuilder)
+
+// NewRemoteBuilder returns a remote builder for the bramble server at url. If
+// token is set it's used to authenticate every request.
+func NewRemoteBuilder(url, token string) *RemoteBuilder {
+	url = strings.TrimSuffix(url, "/")
+	client := New(url + "/cache")
+	if token != "" {
+		client = NewWithToken(url+"/cache", token)
+	}
+	return &RemoteBuilder{Client: client, url: url}
+}
+
+// Info returns the platform the server builds for and the number of builds it
+// runs at once.
+func (rb *RemoteBuilder) Info(ctx context.Context) (info store.BuildServerInfo, err error) {
+	err = httpx.Request(ctx, rb.client, http.MethodGet, rb.url+"/build/info", "", nil, &info)
+	if err == os.ErrNotExist {
+		return info, errors.Errorf("%s doesn't accept builds", rb.url)
+	}
+	return info, err
+}
+
+// Build builds a derivation on the server and writes the build logs to logs
+// while it runs. The inputs in the request must already be in the server's
+// cache.
+func (rb *RemoteBuilder) Build(ctx context.Context, req store.BuildRequest, logs io.Writer) (drv store.Derivation, err error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return drv, err
+	}
+	var body io.ReadCloser
+	if err := httpx.Request(ctx, rb.client,
+		http.MethodPost,
+		rb.url+"/build/derivation",
+		"application/json",
+		bytes.NewBuffer(b),
+		&body); err != nil {
+		if err == os.ErrNotExist {
+			return drv, errors.Errorf("%s doesn't accept builds", rb.url)
+		}
+		return drv, err
+	}
+	defer body.Close()
+	decoder := json.NewDecoder(body)
+	for {
+		var msg store.BuildMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return drv, errors.New("build server closed the connection before the build finished")
+			}
+			return drv, errors.Wrap(err, "error reading build logs")
+		}
+		switch {
+		case msg.Error != "":
+			return drv, errors.New(msg.Error)
+		case msg.Derivation != nil:
+			return *msg.Derivation, nil
+		default:
+			if _, err := io.WriteString(logs, msg.Log); err != nil {
+				return drv, err
+			}
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package cacheclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/maxmcd/bramble/internal/store"
+	"github.com/maxmcd/bramble/pkg/sandbox"
+	"github.com/maxmcd/bramble/pkg/test"
+	_ "github.com/opencontainers/runc/libcontainer/nsenter"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// Builds in the sandbox start from this entrypoint
+func init() {
+	sandbox.Entrypoint()
+}
+
+type testLockfileWriter map[string]string
+
+func (lfw testLockfileWriter) AddEntry(k string, v string) error {
+	lfw[k] = v
+	return nil
+}
+
+func (lfw testLockfileWriter) LookupEntry(k string) (v string, found bool) {
+	v, found = lfw[k]
+	return v, found
+}
+
+func fetchDerivation(url, name string, dependencies ...store.Derivation) store.Derivation {
+	var dos store.DerivationOutputs
+	for _, dep := range dependencies {
+		dos = append(dos, store.DerivationOutput{
+			Filename:   dep.Filename(),
+			OutputName: "out",
+			Output:     dep.Outputs[0].Path,
+		})
+	}
+	return store.Derivation{
+		Name:         name,
+		Builder:      "basic_fetch_url",
+		OutputNames:  []string{"out"},
+		Dependencies: dos,
+		Env:          map[string]string{"url": url + "/" + name},
+	}
+}
+
+// countingCacheClient counts the chunks and outputs that are posted to a cache
+type countingCacheClient struct {
+	store.CacheClient
+	lock            sync.Mutex
+	chunks, outputs int
+}
+
+func (cc *countingCacheClient) PostChunk(ctx context.Context, chunk io.Reader) (string, error) {
+	cc.lock.Lock()
+	cc.chunks++
+	cc.lock.Unlock()
+	return cc.CacheClient.PostChunk(ctx, chunk)
+}
+
+func (cc *countingCacheClient) PostOutput(ctx context.Context, output store.OutputRequestBody) error {
+	cc.lock.Lock()
+	cc.outputs++
+	cc.lock.Unlock()
+	return cc.CacheClient.PostOutput(ctx, output)
+}
+
+func TestSubstitute(t *testing.T) {
+	ctx := context.Background()
+	buildStore, err := store.NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+
+	var depPath string
+	fileServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dep" {
+			_, _ = rw.Write([]byte("dep"))
+			return
+		}
+		_, _ = rw.Write([]byte("I reference " + filepath.Join(buildStore.StorePath, depPath)))
+	}))
+
+	builder := buildStore.NewBuilder(testLockfileWriter{})
+	depInput := fetchDerivation(fileServer.URL, "dep")
+	dep, _, err := builder.BuildDerivation(ctx, depInput, store.BuildDerivationOptions{})
+	require.NoError(t, err)
+	depPath = dep.Outputs[0].Path
+	rootInput := fetchDerivation(fileServer.URL, "root", dep)
+	root, _, err := builder.BuildDerivation(ctx, rootInput, store.BuildDerivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{depPath}, root.Outputs[0].Dependencies)
+
+	secretKey, publicKey, err := store.GenerateSigningKey("test-1")
+	require.NoError(t, err)
+	dep, err = buildStore.SignDerivation(dep, secretKey)
+	require.NoError(t, err)
+	root, err = buildStore.SignDerivation(root, secretKey)
+	require.NoError(t, err)
+
+	cacheStore, err := store.NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	cacheServer := httptest.NewServer(cacheStore.CacheServer())
+	t.Cleanup(cacheServer.Close)
+	require.NoError(t, buildStore.UploadDerivationsToCache(ctx, []store.Derivation{dep, root}, New(cacheServer.URL), store.UploadOptions{Progress: io.Discard}))
+
+	missing, err := New(cacheServer.URL).Missing(ctx, store.CacheObjects{
+		Chunks:      []string{"nope"},
+		Outputs:     []string{dep.Outputs[0].Path, root.Outputs[0].Path},
+		Derivations: []string{dep.Filename(), root.Filename()},
+	})
+	require.NoError(t, err)
+	require.Equal(t, store.CacheObjects{Chunks: []string{"nope"}}, missing)
+	// Uploading again is a no-op
+	counter := &countingCacheClient{CacheClient: New(cacheServer.URL)}
+	require.NoError(t, buildStore.UploadDerivationsToCache(ctx, []store.Derivation{dep, root}, counter, store.UploadOptions{Progress: io.Discard}))
+	require.Zero(t, counter.chunks)
+	require.Zero(t, counter.outputs)
+
+	// Shut down the file server so that derivations can't be built
+	fileServer.Close()
+
+	substituteStore, err := store.NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	require.NotEqual(t, buildStore.StorePath, substituteStore.StorePath)
+
+	// Outputs aren't substituted without a trusted key, so the build fails
+	_, _, err = substituteStore.NewBuilder(testLockfileWriter{}, New(cacheServer.URL)).
+		BuildDerivation(ctx, depInput, store.BuildDerivationOptions{})
+	require.Error(t, err)
+
+	lockfile := testLockfileWriter{}
+	substituteBuilder := substituteStore.NewBuilder(lockfile, New(cacheServer.URL))
+	require.NoError(t, substituteBuilder.TrustPublicKeys(publicKey))
+	for i, input := range []store.Derivation{depInput, rootInput} {
+		substituted, didBuild, err := substituteBuilder.BuildDerivation(ctx, input, store.BuildDerivationOptions{})
+		require.NoError(t, err)
+		require.False(t, didBuild)
+		require.Equal(t, []store.Derivation{dep, root}[i].Outputs, substituted.Outputs)
+	}
+	// Substituted fetch derivations are recorded in the lockfile
+	require.Equal(t, dep.Outputs[0].Path, lockfile["basic_fetch_url "+depInput.Env["url"]])
+
+	// And they must match the lockfile
+	otherStore, err := store.NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	otherBuilder := otherStore.NewBuilder(testLockfileWriter{
+		"basic_fetch_url " + depInput.Env["url"]: root.Outputs[0].Path,
+	}, New(cacheServer.URL))
+	require.NoError(t, otherBuilder.TrustPublicKeys(publicKey))
+	_, _, err = otherBuilder.BuildDerivation(ctx, depInput, store.BuildDerivationOptions{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't match with the existing hash")
+
+	// References to the build store are relocated to the local store
+	b, err := ioutil.ReadFile(filepath.Join(substituteStore.StorePath, root.Outputs[0].Path, "root"))
+	require.NoError(t, err)
+	require.Equal(t, "I reference "+filepath.Join(substituteStore.StorePath, depPath), string(b))
+}
+
+func TestRemoteBuild(t *testing.T) {
+	ctx := context.Background()
+	clientStore, err := store.NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	fileServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(r.URL.Path))
+	}))
+	t.Cleanup(fileServer.Close)
+
+	serverStore, err := store.NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.Handle("/cache/", http.StripPrefix("/cache", serverStore.CacheServer()))
+	mux.Handle("/build/", http.StripPrefix("/build", serverStore.BuildServer(1)))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	remote := NewRemoteBuilder(server.URL, "")
+
+	// Fetch derivations are always built locally
+	builder := clientStore.NewBuilder(testLockfileWriter{})
+	dep, didBuild, err := builder.BuildDerivation(ctx, fetchDerivation(fileServer.URL, "dep"),
+		store.BuildDerivationOptions{Remote: remote})
+	require.NoError(t, err)
+	require.True(t, didBuild)
+	require.NoFileExists(t, filepath.Join(serverStore.StorePath, dep.Filename()))
+
+	wd, err := filepath.Abs(".")
+	require.NoError(t, err)
+	source, err := clientStore.StoreLocalSources(ctx, store.SourceFiles{
+		ProjectLocation: wd,
+		Location:        wd,
+		Files:           []string{"cache_test.go"},
+	})
+	require.NoError(t, err)
+	drv := store.Derivation{
+		Name:        "remote",
+		Builder:     store.BramblePrefixOfRecord + "/" + dep.Outputs[0].Path + "/missing",
+		OutputNames: []string{"out"},
+		Dependencies: store.DerivationOutputs{{
+			Filename:   dep.Filename(),
+			OutputName: "out",
+			Output:     dep.Outputs[0].Path,
+		}},
+		Source: source,
+	}
+	_, _, err = builder.BuildDerivation(ctx, drv, store.BuildDerivationOptions{Remote: remote})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "builder location doesn't exist")
+	// Logs are attached to the error even if they were printed
+	_, _, err = builder.BuildDerivation(ctx, drv, store.BuildDerivationOptions{Remote: remote, Verbose: true})
+	er, ok := errors.Cause(err).(store.ExecError)
+	require.True(t, ok, err)
+	require.NotNil(t, er.Logs)
+	_ = er.Logs.Close()
+	_ = os.Remove(er.Logs.Name())
+	// The build ran on the server with the inputs sent through its cache
+	require.DirExists(t, filepath.Join(serverStore.StorePath, dep.Outputs[0].Path))
+	require.DirExists(t, filepath.Join(serverStore.StorePath, source.Path))
+
+	drv.Platform = "plan9_arm"
+	_, err = remote.Build(ctx, store.BuildRequest{Derivation: drv}, ioutil.Discard)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "this server builds")
+}
+
+// builderArchive builds testdata/builder and returns a gzipped tar archive
+// containing it
+func builderArchive(t *testing.T) []byte {
+	t.Helper()
+	location := filepath.Join(test.TmpDir(t), "builder")
+	cmd := exec.Command("go", "build", "-o", location, "./testdata/builder")
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	b, err := ioutil.ReadFile(location)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "builder",
+		Mode:     0755,
+		Size:     int64(len(b)),
+	}))
+	_, err = tw.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestRemoteBuild_dependencies(t *testing.T) {
+	if _, ok := os.LookupEnv("BRAMBLE_INTEGRATION_TEST"); !ok {
+		t.Skip("skipping sandboxed builds unless BRAMBLE_INTEGRATION_TEST is set")
+	}
+	ctx := context.Background()
+	archive := builderArchive(t)
+	fileServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write(archive)
+	}))
+	t.Cleanup(fileServer.Close)
+
+	serverStore, err := store.NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.Handle("/cache/", http.StripPrefix("/cache", serverStore.CacheServer()))
+	mux.Handle("/build/", http.StripPrefix("/build", serverStore.BuildServer(1)))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	clientStore, err := store.NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	builder := clientStore.NewBuilder(testLockfileWriter{})
+	dep, _, err := builder.BuildDerivation(ctx, fetchDerivation(fileServer.URL, "builder.tar.gz"),
+		store.BuildDerivationOptions{})
+	require.NoError(t, err)
+
+	built, didBuild, err := builder.BuildDerivation(ctx, store.Derivation{
+		Name:        "remote",
+		Builder:     store.BramblePrefixOfRecord + "/" + dep.Outputs[0].Path + "/builder",
+		OutputNames: []string{"out"},
+		Dependencies: store.DerivationOutputs{{
+			Filename:   dep.Filename(),
+			OutputName: "out",
+			Output:     dep.Outputs[0].Path,
+		}},
+	}, store.BuildDerivationOptions{Remote: NewRemoteBuilder(server.URL, "")})
+	require.NoError(t, err)
+	require.True(t, didBuild)
+	// The dependency was sent to the server so that it could find references
+	// to its output
+	require.FileExists(t, filepath.Join(serverStore.StorePath, dep.Filename()))
+	require.Equal(t, []string{dep.Outputs[0].Path}, built.Outputs[0].Dependencies)
+
+	// References to the server's store are relocated to the local store
+	b, err := ioutil.ReadFile(filepath.Join(clientStore.StorePath, built.Outputs[0].Path, "built"))
+	require.NoError(t, err)
+	require.Equal(t, "built by "+filepath.Join(clientStore.StorePath, dep.Outputs[0].Path, "builder"), string(b))
+}
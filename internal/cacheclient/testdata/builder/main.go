@@ -0,0 +1,15 @@
+// builder is a statically linked builder for remote build tests. It writes a
+// file to $out that references the builder's own location.
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	if err := os.WriteFile(filepath.Join(os.Getenv("out"), "built"),
+		[]byte("built by "+os.Args[0]), 0644); err != nil {
+		panic(err)
+	}
+}
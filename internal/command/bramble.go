@@ -1,16 +1,20 @@
 package command
 
 import (
+	"os"
 	"path/filepath"
+	"strconv"
 
+	"github.com/maxmcd/bramble/internal/config"
 	"github.com/maxmcd/bramble/internal/dependency"
 	"github.com/maxmcd/bramble/internal/project"
 	"github.com/maxmcd/bramble/internal/store"
 )
 
 type bramble struct {
-	store   *store.Store
-	project *project.Project
+	store      *store.Store
+	project    *project.Project
+	userConfig config.UserConfig
 }
 
 func newBramble(wd string, bramblePath string) (b bramble, err error) {
@@ -20,12 +24,26 @@ func newBramble(wd string, bramblePath string) (b bramble, err error) {
 	if b.project, err = project.NewProject(wd); err != nil {
 		return
 	}
+	if b.userConfig, err = config.ReadUserConfig(filepath.Join(b.store.BramblePath, "config.toml")); err != nil {
+		return
+	}
+	b.store.AutoOptimise = b.userConfig.Store.AutoOptimise
 
 	b.project.AddModuleFetcher(
 		dependency.NewManager(
 			filepath.Join(b.store.BramblePath, "var/dependencies"),
-			"https://store.bramble.run",
+			config.Registries(b.project.Config(), b.userConfig),
+			offline(),
 		),
 	)
 	return b, nil
 }
+
+// offlineEnvVar is set to "true" to stop bramble from contacting package
+// servers, it's also set by the --offline flag.
+const offlineEnvVar = "BRAMBLE_OFFLINE"
+
+func offline() bool {
+	v, _ := strconv.ParseBool(os.Getenv(offlineEnvVar))
+	return v
+}
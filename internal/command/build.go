@@ -3,11 +3,15 @@ package command
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/maxmcd/bramble/internal/cacheclient"
 	"github.com/maxmcd/bramble/internal/config"
 	"github.com/maxmcd/bramble/internal/project"
 	"github.com/maxmcd/bramble/internal/store"
@@ -65,7 +69,20 @@ type runBuildOptions struct {
 	verbose      bool
 	includeTests bool
 	quiet        bool
-	callback     func(dep project.Dependency, drv project.Derivation, buildDrv store.Derivation)
+	// substituters are cache urls that are used in addition to the caches in
+	// the project config
+	substituters []string
+	// remotes are the urls of bramble servers that builds are distributed to,
+	// used in addition to the builders in the user config
+	remotes []string
+	// jobs is the number of derivations that are built locally at once
+	jobs     int
+	callback func(dep project.Dependency, drv project.Derivation, buildDrv store.Derivation)
+	// logs receives build output in addition to stdout, if set
+	logs io.Writer
+	// stdout receives build progress and the output of verbose builds,
+	// os.Stdout is used if it's nil
+	stdout io.Writer
 }
 
 func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput, ops runBuildOptions) (outputDerivations []store.Derivation, err error) {
@@ -80,53 +97,43 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 	if len(output.Output) != 1 && ops.shell {
 		return nil, errors.New("Can't open a shell if the function doesn't return a single derivation")
 	}
-	builder := b.store.NewBuilder(b.project.LockfileWriter())
-	derivationIDUpdates := map[project.Dependency]store.DerivationOutput{}
-	var derivationDataLock sync.Mutex
+	stdout := ops.stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	// Sources are stored before the derivations that use them are built, gc
+	// must not remove them in between
+	unlock, err := b.store.Lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = unlock() }()
+	builder, err := b.builder(ops.substituters)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := b.builderPool(ctx, builder, ops)
+	if err != nil {
+		return nil, err
+	}
+	built := newBuiltOutputs()
+	var outputDerivationsLock sync.Mutex
 
-	err = output.WalkAndPatch(8, func(dep project.Dependency, drv project.Derivation) (addGraph *project.ExecModuleOutput, buildOutputs []project.BuildOutput, err error) {
+	err = output.WalkAndPatch(pool.MaxConcurrency(), func(dep project.Dependency, drv project.Derivation) (addGraph *project.ExecModuleOutput, buildOutputs []project.BuildOutput, err error) {
 		select {
 		case <-ctx.Done():
 			return
 		default:
 		}
-		dependencies := []store.DerivationOutput{}
-
 		// job := jobPrinter.StartJob(drv.Name)
 		// defer jobPrinter.EndJob(job)
-		derivationDataLock.Lock()
-		// Populate the input derivation from previous builds
-		for _, dep := range drv.Dependencies {
-			do, found := derivationIDUpdates[dep]
-			if !found {
-				derivationDataLock.Unlock()
-				return nil, nil, errors.Errorf("Missing build output for dep %q but we should have it", dep)
-			}
-			dependencies = append(dependencies, do)
-		}
-		derivationDataLock.Unlock()
 
-		source, err := b.store.StoreLocalSources(ctx, store.SourceFiles{
-			ProjectLocation: b.project.Location(),
-			Location:        drv.Sources.Location,
-			Files:           drv.Sources.Files,
-		}) // TODO: delete this if the build fails?
+		// Populate the input derivation from previous builds
+		dependencies, err := built.dependencies(drv)
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "error moving local files to the store")
+			return nil, nil, err
 		}
-
-		_, buildDrv, err := b.store.NewDerivation(store.NewDerivationOptions{
-			Args:         drv.Args,
-			Builder:      drv.Builder,
-			Env:          drv.Env,
-			Dependencies: dependencies,
-			Name:         drv.Name,
-			Network:      drv.Network,
-			Outputs:      drv.Outputs,
-			Platform:     drv.Platform,
-			Source:       source,
-			Target:       drv.Target,
-		})
+		_, buildDrv, err := b.newStoreDerivation(ctx, drv, dependencies)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -143,10 +150,12 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 			}
 		}
 
-		if buildDrv, didBuild, err = builder.BuildDerivation(ctx, buildDrv, store.BuildDerivationOptions{
+		if buildDrv, didBuild, err = pool.BuildDerivation(ctx, buildDrv, store.BuildDerivationOptions{
 			Shell:      runShell,
 			Verbose:    ops.verbose,
 			ForceBuild: runShell,
+			Logs:       ops.logs,
+			Stdout:     stdout,
 		}); err != nil {
 			return nil, nil, err
 		}
@@ -154,6 +163,8 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 		if ops.check {
 			secondBuildDrv, _, err := builder.BuildDerivation(ctx, buildDrv, store.BuildDerivationOptions{
 				ForceBuild: true,
+				Logs:       ops.logs,
+				Stdout:     stdout,
 			})
 			if err != nil {
 				return nil, nil, err
@@ -181,33 +192,19 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 		}
 		// Don't print if we're quiet, unless we built something
 		if !ops.quiet || didBuild {
-			fmt.Printf("✔ %s - %s\n", buildDrv.Name, ts)
+			fmt.Fprintf(stdout, "✔ %s - %s\n", buildDrv.Name, ts)
 		}
-		derivationDataLock.Lock()
-		// allDerivations = append(allDerivations, buildDrv)
-		// Store the derivation outputs in the map for reference when building
-		// input derivations later. Also populate the buildOutputs
-		for i, o := range buildDrv.OutputNames {
-			out := buildDrv.Outputs[i]
-			derivationIDUpdates[project.Dependency{
-				Hash:   dep.Hash,
-				Output: o,
-			}] = store.DerivationOutput{
-				Filename:   buildDrv.Filename(),
-				OutputName: o,
-				Output:     out.Path,
-			}
-			buildOutputs = append(buildOutputs, project.BuildOutput{
-				Dep:        project.Dependency{Hash: dep.Hash, Output: o},
-				OutputPath: store.BramblePrefixOfRecord + "/" + out.Path,
-			})
+		if ops.logs != nil {
+			fmt.Fprintf(ops.logs, "✔ %s - %s\n", buildDrv.Name, ts)
 		}
+		buildOutputs = built.add(dep, buildDrv)
+		outputDerivationsLock.Lock()
 		for hash := range output.Output {
 			if hash == dep.Hash {
 				outputDerivations = append(outputDerivations, buildDrv)
 			}
 		}
-		derivationDataLock.Unlock()
+		outputDerivationsLock.Unlock()
 		return
 	})
 	if err != nil {
@@ -222,6 +219,253 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 	return outputDerivations, err
 }
 
+// builtOutputs tracks the store derivation outputs that each project
+// dependency resolved to so that dependents can reference them.
+type builtOutputs struct {
+	outputs map[project.Dependency]store.DerivationOutput
+	lock    sync.Mutex
+}
+
+func newBuiltOutputs() *builtOutputs {
+	return &builtOutputs{outputs: map[project.Dependency]store.DerivationOutput{}}
+}
+
+// dependencies returns the store derivation outputs for all dependencies of a
+// project derivation.
+func (bo *builtOutputs) dependencies(drv project.Derivation) (dependencies []store.DerivationOutput, err error) {
+	bo.lock.Lock()
+	defer bo.lock.Unlock()
+	for _, dep := range drv.Dependencies {
+		do, found := bo.outputs[dep]
+		if !found {
+			return nil, errors.Errorf("Missing build output for dep %q but we should have it", dep)
+		}
+		dependencies = append(dependencies, do)
+	}
+	return dependencies, nil
+}
+
+// add stores the derivation outputs in the map for reference when building
+// input derivations later. The returned buildOutputs can be used to patch
+// dependent derivations.
+func (bo *builtOutputs) add(dep project.Dependency, buildDrv store.Derivation) (buildOutputs []project.BuildOutput) {
+	bo.lock.Lock()
+	defer bo.lock.Unlock()
+	for i, o := range buildDrv.OutputNames {
+		out := buildDrv.Outputs[i]
+		bo.outputs[project.Dependency{
+			Hash:   dep.Hash,
+			Output: o,
+		}] = store.DerivationOutput{
+			Filename:   buildDrv.Filename(),
+			OutputName: o,
+			Output:     out.Path,
+		}
+		buildOutputs = append(buildOutputs, project.BuildOutput{
+			Dep:        project.Dependency{Hash: dep.Hash, Output: o},
+			OutputPath: store.BramblePrefixOfRecord + "/" + out.Path,
+		})
+	}
+	return buildOutputs
+}
+
+// newStoreDerivation moves the sources of a project derivation into the store
+// and returns the matching store derivation. Exists is true if the derivation
+// has already been built.
+func (b bramble) newStoreDerivation(ctx context.Context, drv project.Derivation, dependencies []store.DerivationOutput) (exists bool, buildDrv store.Derivation, err error) {
+	source, err := b.store.StoreLocalSources(ctx, store.SourceFiles{
+		ProjectLocation: b.project.Location(),
+		Location:        drv.Sources.Location,
+		Files:           drv.Sources.Files,
+	}) // TODO: delete this if the build fails?
+	if err != nil {
+		return false, buildDrv, errors.Wrap(err, "error moving local files to the store")
+	}
+
+	return b.store.NewDerivation(newDerivationOptions(drv, dependencies, source))
+}
+
+// newDerivationOptions returns the options to create a store derivation from
+// a project derivation with sources already in the store.
+func newDerivationOptions(drv project.Derivation, dependencies []store.DerivationOutput, source store.Source) store.NewDerivationOptions {
+	return store.NewDerivationOptions{
+		Args:         drv.Args,
+		Builder:      drv.Builder,
+		Env:          drv.Env,
+		Dependencies: dependencies,
+		Name:         drv.Name,
+		Network:      drv.Network,
+		Outputs:      drv.Outputs,
+		Platform:     drv.Platform,
+		Source:       source,
+		Target:       drv.Target,
+	}
+}
+
+// builder returns a store builder that substitutes outputs from the caches in
+// the project and user config followed by any additional urls. Outputs must be
+// signed by a trusted key from either config.
+func (b bramble) builder(urls []string) (*store.Builder, error) {
+	return newStoreBuilder(b.store, b.project.LockfileWriter(),
+		[]config.Cache{b.project.Config().Cache, b.userConfig.Cache}, urls)
+}
+
+// newStoreBuilder returns a store builder that substitutes outputs from the
+// passed caches followed by any additional urls. Outputs must be signed by a
+// trusted key from one of the caches.
+func newStoreBuilder(s *store.Store, lockfileWriter types.LockfileWriter, caches []config.Cache, urls []string) (*store.Builder, error) {
+	var substituters []store.Substituter
+	seen := map[string]struct{}{}
+	lists := [][]string{}
+	for _, cache := range caches {
+		lists = append(lists, cache.Substituters)
+	}
+	for _, list := range append(lists, urls) {
+		for _, url := range list {
+			if _, ok := seen[url]; ok {
+				continue
+			}
+			seen[url] = struct{}{}
+			substituters = append(substituters, cacheclient.New(url))
+		}
+	}
+	builder := s.NewBuilder(lockfileWriter, substituters...)
+	for _, cache := range caches {
+		if err := builder.TrustPublicKeys(cache.TrustedPublicKeys...); err != nil {
+			return nil, errors.Wrap(err, "error reading trusted public keys")
+		}
+	}
+	return builder, nil
+}
+
+// discardLockfile is used for builds outside of a project, nothing is looked up
+// or recorded.
+type discardLockfile struct{}
+
+var _ types.LockfileWriter = discardLockfile{}
+
+func (discardLockfile) AddEntry(string, string) error             { return nil }
+func (discardLockfile) LookupEntry(string) (v string, found bool) { return "", false }
+
+// defaultBuildJobs is the number of derivations that are built locally at
+// once if runBuildOptions.jobs isn't set
+const defaultBuildJobs = 8
+
+// builderPool returns a pool that distributes builds across the local builder
+// and the remote builders in the user config and options. The platform and
+// concurrency of remote builders that don't set them are requested from the
+// server.
+func (b bramble) builderPool(ctx context.Context, builder *store.Builder, ops runBuildOptions) (*store.BuilderPool, error) {
+	jobs := ops.jobs
+	if jobs == 0 {
+		jobs = defaultBuildJobs
+	}
+	pool := builder.NewPool(jobs)
+	remotes := append([]config.Builder{}, b.userConfig.Builders...)
+	for _, url := range ops.remotes {
+		remotes = append(remotes, config.Builder{URL: url})
+	}
+	token := os.Getenv("BRAMBLE_TOKEN")
+	for _, remote := range remotes {
+		rb := cacheclient.NewRemoteBuilder(remote.URL, token)
+		if remote.Platform == "" || remote.MaxConcurrency == 0 {
+			info, err := rb.Info(ctx)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error contacting builder %s", remote.URL)
+			}
+			if remote.Platform == "" {
+				remote.Platform = info.Platform
+			}
+			if remote.MaxConcurrency == 0 {
+				remote.MaxConcurrency = info.Workers
+			}
+		}
+		pool.AddRemote(rb, remote.Platform, remote.MaxConcurrency)
+	}
+	return pool, nil
+}
+
+// createOutLinks creates a symlink in the working directory for every output
+// of the passed derivations and registers each link as a gc root. Links are
+// named by outLinkNames.
+func (b bramble) createOutLinks(derivations []store.Derivation, outLink string) (err error) {
+	if !filepath.IsAbs(outLink) {
+		outLink = filepath.Join(b.project.WD(), outLink)
+	}
+	for _, l := range outLinkNames(derivations, outLink) {
+		if err := b.store.AddRoot(l.link, l.drv, l.output); err != nil {
+			return errors.Wrapf(err, "error creating out link for %s", l.drv.Name)
+		}
+		fmt.Printf("%s -> %s\n", l.link, l.path)
+	}
+	return nil
+}
+
+type resultLink struct {
+	link   string
+	drv    store.Derivation
+	output string
+	path   string
+}
+
+// outLinkNames returns the link for every output of the passed derivations. A
+// single derivation gets outLink for its default output and
+// "<outLink>-<output>" for all others. Multiple derivations are suffixed with
+// their name, and derivations whose links would be the same as another
+// derivation's are also suffixed with the start of their hash.
+func outLinkNames(derivations []store.Derivation, outLink string) (links []resultLink) {
+	var unique []store.Derivation
+	seen := map[string]struct{}{}
+	for _, drv := range derivations {
+		if _, ok := seen[drv.Filename()]; !ok {
+			seen[drv.Filename()] = struct{}{}
+			unique = append(unique, drv)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool {
+		if unique[i].Name != unique[j].Name {
+			return unique[i].Name < unique[j].Name
+		}
+		return unique[i].Hash() < unique[j].Hash()
+	})
+	names := func(withHash map[string]bool) (links []resultLink) {
+		for _, drv := range unique {
+			base := outLink
+			if len(unique) > 1 {
+				base += "-" + drv.Name
+			}
+			if withHash[drv.Filename()] {
+				base += "-" + drv.Hash()[:8]
+			}
+			for i, name := range drv.OutputNames {
+				link := base
+				if i != 0 || name != "out" {
+					link += "-" + name
+				}
+				links = append(links, resultLink{link: link, drv: drv, output: name, path: drv.Outputs[i].Path})
+			}
+		}
+		return links
+	}
+	links = names(nil)
+	producers := map[string][]string{}
+	for _, l := range links {
+		producers[l.link] = append(producers[l.link], l.drv.Filename())
+	}
+	withHash := map[string]bool{}
+	for _, filenames := range producers {
+		if len(filenames) > 1 {
+			for _, filename := range filenames {
+				withHash[filename] = true
+			}
+		}
+	}
+	if len(withHash) == 0 {
+		return links
+	}
+	return names(withHash)
+}
+
 func (b bramble) fullBuild(ctx context.Context, args []string, opts types.BuildOptions) (br buildResponse, err error) {
 	br.FinalHashMapping = make(map[string]store.Derivation)
 	br.Output, err = b.execModule(ctx, args, execModuleOptions{})
@@ -231,6 +475,7 @@ func (b bramble) fullBuild(ctx context.Context, args []string, opts types.BuildO
 	var lock sync.Mutex
 	_, err = b.runBuild(ctx, br.Output, runBuildOptions{
 		check: opts.Check,
+		logs:  opts.Logs,
 		callback: func(dep project.Dependency, drv project.Derivation, buildDrv store.Derivation) {
 			lock.Lock()
 			br.FinalHashMapping[dep.Hash] = buildDrv
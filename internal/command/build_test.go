@@ -0,0 +1,46 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/maxmcd/bramble/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutLinkNames(t *testing.T) {
+	drv := func(name string, env string, outputs ...string) store.Derivation {
+		d := store.Derivation{Name: name, OutputNames: outputs, Env: map[string]string{"v": env}}
+		for _, output := range outputs {
+			d.Outputs = append(d.Outputs, store.Output{Path: name + env + output})
+		}
+		return d
+	}
+	links := func(drvs ...store.Derivation) (names []string) {
+		for _, l := range outLinkNames(drvs, "result") {
+			names = append(names, l.link)
+		}
+		return names
+	}
+
+	a, b := drv("a", "1", "out", "dev"), drv("b", "1", "out")
+	require.Equal(t, []string{"result", "result-dev"}, links(a))
+	require.Equal(t, []string{"result-a", "result-a-dev", "result-b"}, links(b, a, a))
+
+	// Derivations with the same name get a hash suffix so that both are
+	// linked and registered as roots
+	other := drv("a", "2", "out")
+	first, second := a, other
+	if other.Hash() < a.Hash() {
+		first, second = other, a
+	}
+	names := links(a, other, b)
+	require.Len(t, names, 4)
+	require.Equal(t, "result-a-"+first.Hash()[:8], names[0])
+	require.Equal(t, "result-a-"+second.Hash()[:8], names[len(first.OutputNames)])
+	require.Equal(t, "result-b", names[3])
+	unique := map[string]struct{}{}
+	for _, name := range names {
+		unique[name] = struct{}{}
+	}
+	require.Len(t, unique, len(names))
+}
@@ -0,0 +1,142 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/maxmcd/bramble/internal/cacheclient"
+	"github.com/maxmcd/bramble/internal/store"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/pkg/errors"
+	"github.com/rhnvrm/simples3"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newCacheClient returns a client that uploads to the cache at url. Urls in the
+// form s3://<bucket> upload to a bucket with an S3 compatible api that is
+// configured with environment variables. All other urls are expected to point
+// at a bramble cache server, requests are authenticated with BRAMBLE_TOKEN if
+// it's set.
+func newCacheClient(url string) (store.CacheClient, error) {
+	if !strings.HasPrefix(url, "s3://") {
+		if token := os.Getenv("BRAMBLE_TOKEN"); token != "" {
+			return cacheclient.NewWithToken(url, token), nil
+		}
+		return cacheclient.New(url), nil
+	}
+	bucket := strings.TrimSuffix(strings.TrimPrefix(url, "s3://"), "/")
+	if bucket == "" {
+		return nil, errors.Errorf("s3 url %q is missing a bucket name", url)
+	}
+	accessKey := os.Getenv("BRAMBLE_S3_ACCESS_KEY_ID")
+	secretKey := os.Getenv("BRAMBLE_S3_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("BRAMBLE_S3_ACCESS_KEY_ID and BRAMBLE_S3_SECRET_ACCESS_KEY must be set to upload to s3")
+	}
+	region := os.Getenv("BRAMBLE_S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	s3 := simples3.New(region, accessKey, secretKey)
+	s3.SetEndpoint(os.Getenv("BRAMBLE_S3_ENDPOINT"))
+	return store.NewS3CacheClient(s3, bucket), nil
+}
+
+// cachePush builds the passed modules and uploads their runtime closures to a
+// cache. If signKey is set derivations are signed with the secret key in that
+// file before they're uploaded.
+func (b bramble) cachePush(ctx context.Context, url string, args []string, signKey string) (err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "command.cachePush")
+	defer span.End()
+
+	cc, err := newCacheClient(url)
+	if err != nil {
+		return err
+	}
+	drvs, err := b.buildClosure(ctx, args, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if signKey != "" {
+		if drvs, err = b.signDerivations(drvs, signKey); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Uploading %d derivations to %s\n", len(drvs), url)
+	return b.store.UploadDerivationsToCache(ctx, drvs, cc, store.UploadOptions{Progress: os.Stderr})
+}
+
+// cacheSign builds the passed modules and signs every derivation in their
+// runtime closures with the secret key in keyFile.
+func (b bramble) cacheSign(ctx context.Context, args []string, keyFile string) (err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "command.cacheSign")
+	defer span.End()
+
+	drvs, err := b.buildClosure(ctx, args, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if _, err = b.signDerivations(drvs, keyFile); err != nil {
+		return err
+	}
+	fmt.Printf("Signed %d derivations\n", len(drvs))
+	return nil
+}
+
+// buildClosure builds the passed modules and returns the derivations they
+// return along with all of their runtime dependencies. Build progress is
+// written to stdout.
+func (b bramble) buildClosure(ctx context.Context, args []string, stdout io.Writer) (drvs []store.Derivation, err error) {
+	output, err := b.execModule(ctx, args, execModuleOptions{})
+	if err != nil {
+		return nil, err
+	}
+	outputDerivations, err := b.runBuild(ctx, output, runBuildOptions{quiet: true, stdout: stdout})
+	if err != nil {
+		return nil, err
+	}
+	return b.store.RuntimeClosure(outputDerivations)
+}
+
+func (b bramble) signDerivations(drvs []store.Derivation, keyFile string) (signed []store.Derivation, err error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading secret key")
+	}
+	for _, drv := range drvs {
+		drv, err := b.store.SignDerivation(drv, strings.TrimSpace(string(key)))
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, drv)
+	}
+	return signed, nil
+}
+
+// cacheKeygen generates a key pair for signing derivations and writes the keys
+// to secretKeyFile and publicKeyFile.
+func cacheKeygen(name, secretKeyFile, publicKeyFile string) (err error) {
+	for _, file := range []string{secretKeyFile, publicKeyFile} {
+		if fileutil.PathExists(file) {
+			return errors.Errorf("won't overwrite existing file %q", file)
+		}
+	}
+	secretKey, publicKey, err := store.GenerateSigningKey(name)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(secretKeyFile, []byte(secretKey+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(publicKeyFile, []byte(publicKey+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote secret key to %s, keep it private.\nAdd the public key to trusted_public_keys to use outputs signed with it:\n\n%s\n", secretKeyFile, publicKey)
+	return nil
+}
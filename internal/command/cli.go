@@ -14,6 +14,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/maxmcd/bramble/internal/config"
 	"github.com/maxmcd/bramble/internal/dependency"
 	"github.com/maxmcd/bramble/internal/logger"
 	"github.com/maxmcd/bramble/internal/project"
@@ -24,7 +25,6 @@ import (
 	"github.com/maxmcd/bramble/pkg/starutil"
 	"github.com/mitchellh/go-wordwrap"
 	"github.com/pkg/errors"
-	"github.com/rhnvrm/simples3"
 	cli "github.com/urfave/cli/v2"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -68,6 +68,21 @@ func cliApp(wd string) *cli.App {
 		Version:               "0.1.0",
 		HideHelpCommand:       true,
 		CustomAppHelpTemplate: appHelpTemplate,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "offline",
+				EnvVars: []string{offlineEnvVar},
+				Usage:   "don't contact package servers, only use dependencies and package metadata that are cached locally",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			if c.Bool("offline") {
+				// Set the environment variable so that every command, and any
+				// bramble process they start, is offline
+				return os.Setenv(offlineEnvVar, "true")
+			}
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "build",
@@ -116,6 +131,29 @@ subdirectories.
 						Value:   false,
 						Usage:   "print build logs",
 					},
+					&cli.StringFlag{
+						Name:  "out-link",
+						Value: "result",
+						Usage: "the name of the symlinks that point to build outputs, links are registered as gc roots",
+					},
+					&cli.BoolFlag{
+						Name:  "no-out-link",
+						Value: false,
+						Usage: "don't create symlinks to build outputs",
+					},
+					&cli.StringSliceFlag{
+						Name:  "substituter",
+						Usage: "url of a cache to download build outputs from, used in addition to caches in bramble.toml, to pass multiple caches use this flag multiple times",
+					},
+					&cli.StringSliceFlag{
+						Name:  "remote",
+						Usage: "url of a bramble server to distribute builds to, used in addition to the builders in the user config, to pass multiple servers use this flag multiple times",
+					},
+					&cli.IntFlag{
+						Name:  "jobs",
+						Value: defaultBuildJobs,
+						Usage: "the number of derivations to build locally at once",
+					},
 				},
 				Action: func(c *cli.Context) error {
 					ctx, span := tracer.Start(c.Context, "bramble build "+fmt.Sprintf("%q", c.Args().Slice()))
@@ -138,11 +176,17 @@ subdirectories.
 					if c.Bool("just-parse") {
 						return nil
 					}
-					_, err = b.runBuild(ctx, output, runBuildOptions{
-						check:   c.Bool("check"),
-						verbose: c.Bool("verbose"),
+					outputDerivations, err := b.runBuild(ctx, output, runBuildOptions{
+						check:        c.Bool("check"),
+						verbose:      c.Bool("verbose"),
+						substituters: c.StringSlice("substituter"),
+						remotes:      c.StringSlice("remote"),
+						jobs:         c.Int("jobs"),
 					})
-					return err
+					if err != nil || c.Bool("no-out-link") {
+						return err
+					}
+					return b.createOutLinks(outputDerivations, c.String("out-link"))
 				},
 			},
 			{
@@ -222,17 +266,6 @@ subdirectories.
 					return b.test(c.Context)
 				},
 			},
-			{
-				Name:      "magic",
-				UsageText: "bramble magic",
-				Action: func(c *cli.Context) error {
-					b, err := newBramble(wd, "")
-					if err != nil {
-						return err
-					}
-					return b.project.CalculateDependencies()
-				},
-			},
 			{
 				Name:      "config",
 				UsageText: "bramble config",
@@ -280,11 +313,25 @@ good way to debug a derivation that you're building.`,
 				},
 			},
 			{
-				Name:      "init",
-				Usage:     "Initialize a new directory as a bramble project",
-				UsageText: `bramble init [name]`,
+				Name:  "init",
+				Usage: "Initialize a new directory as a bramble project",
+				UsageText: `bramble init [name]
+
+init creates a bramble.toml, bramble.lock and a starter default.bramble file in
+the current directory. The project depends on the standard library. If a name
+isn't passed it is inferred from the git remote of the current directory, or the
+directory name.
+`,
 				Action: func(c *cli.Context) error {
-					panic("unimplemented")
+					if c.Args().Len() > 1 {
+						return errors.New("bramble init takes at most one argument")
+					}
+					p, err := project.InitProject(wd, c.Args().First())
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Created project %q at version %s in %s\n", p.Module(), p.Version(), p.Location())
+					return nil
 				},
 			},
 			{
@@ -351,9 +398,379 @@ their public functions with documentation. If an immediate subdirectory has a
 				},
 			},
 			{
-				Name:      "publish",
-				UsageText: `bramble publish package [reference]`,
+				Name:  "gc",
+				Usage: "Delete everything in the store that isn't needed by a known project",
+				UsageText: `bramble gc [options]
+
+gc searches for all known projects, runs all of their public functions and
+calculates what derivations and outputs they need to build and run. All other
+paths are deleted from the store. Projects are registered when they are built,
+projects that no longer exist are removed from the registry.
+
+Chunks and outputs uploaded to the cache of "bramble server" are deleted unless
+their output is kept, pass --keep-cache to keep all of them.
+`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Value: false,
+						Usage: "print what would be deleted without deleting anything",
+					},
+					&cli.BoolFlag{
+						Name:  "keep-cache",
+						Value: false,
+						Usage: "keep everything uploaded to the binary cache of this store",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					s, err := store.NewStore("")
+					if err != nil {
+						return err
+					}
+					return runGC(c.Context, s, gcOptions{
+						dryRun:    c.Bool("dry-run"),
+						keepCache: c.Bool("keep-cache"),
+					})
+				},
+			},
+			{
+				Name:      "store",
+				Usage:     "Inspect and manage the bramble store",
+				UsageText: "bramble store <command>",
+				Action:    cli.ShowAppHelp,
+				Subcommands: []*cli.Command{
+					{
+						Name:  "roots",
+						Usage: "List gc roots",
+						UsageText: `bramble store roots
+
+Lists all registered gc roots. Roots are symlinks that point to build outputs,
+they are created by "bramble build". Outputs that are referenced by a root, and
+their runtime dependencies, are not deleted by "bramble gc". Stale roots no
+longer point to a build output and are removed during the next gc.
+`,
+						Action: func(c *cli.Context) error {
+							s, err := store.NewStore("")
+							if err != nil {
+								return err
+							}
+							roots, err := s.Roots()
+							if err != nil {
+								return err
+							}
+							for _, root := range roots {
+								if root.Stale() {
+									fmt.Printf("%s (stale)\n", root.Link)
+									continue
+								}
+								fmt.Printf("%s -> %s\n", root.Link, root.Path)
+							}
+							return nil
+						},
+						Subcommands: []*cli.Command{
+							{
+								Name:      "remove",
+								Usage:     "Remove gc roots",
+								UsageText: "bramble store roots remove <link> [links...]",
+								Action: func(c *cli.Context) error {
+									if c.Args().Len() == 0 {
+										return errors.New("bramble store roots remove takes at least one argument")
+									}
+									s, err := store.NewStore("")
+									if err != nil {
+										return err
+									}
+									for _, link := range c.Args().Slice() {
+										if err := s.RemoveRoot(link); err != nil {
+											return err
+										}
+									}
+									return nil
+								},
+							},
+						},
+					},
+					{
+						Name:  "verify",
+						Usage: "Check the store for missing or corrupted paths",
+						UsageText: `bramble store verify [--repair] [--substituter url]
+
+verify checks that every derivation in the store can be read and that the
+outputs and sources it references exist and match their hash. With --repair
+unreadable derivations are removed, and missing or corrupted outputs are
+downloaded from a cache in the user config or from a --substituter, or built
+again. Outputs that are built again must match their previous hash.
+`,
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "repair",
+								Usage: "substitute or rebuild missing and corrupted outputs",
+							},
+							&cli.StringSliceFlag{
+								Name:  "substituter",
+								Usage: "an additional cache url to substitute outputs from",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							s, err := store.NewStore("")
+							if err != nil {
+								return err
+							}
+							opts := store.VerifyOptions{}
+							if c.Bool("repair") {
+								userConfig, err := config.ReadUserConfig(filepath.Join(s.BramblePath, "config.toml"))
+								if err != nil {
+									return err
+								}
+								if opts.Repair, err = newStoreBuilder(s, discardLockfile{},
+									[]config.Cache{userConfig.Cache}, c.StringSlice("substituter")); err != nil {
+									return err
+								}
+							}
+							result, err := s.Verify(c.Context, opts)
+							if err != nil {
+								return err
+							}
+							remaining := 0
+							for _, problem := range result.Problems {
+								fmt.Println(problem)
+								if !problem.Repaired {
+									remaining++
+								}
+							}
+							fmt.Printf("Checked %d paths, found %d problems\n", result.Checked, len(result.Problems))
+							if remaining > 0 {
+								return errors.Errorf("%d problems weren't repaired", remaining)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "optimise",
+						Usage: "Replace identical files in the store with hard links",
+						UsageText: `bramble store optimise
+
+optimise replaces files in build outputs that have the same contents and
+permissions with hard links to a single copy in the .links directory of the
+store. Files in optimised outputs are made read-only. New outputs can be
+optimised after every build by setting auto_optimise in the [store] section of
+$BRAMBLE_PATH/config.toml.
+`,
+						Action: func(c *cli.Context) error {
+							s, err := store.NewStore("")
+							if err != nil {
+								return err
+							}
+							result, err := s.Optimise(c.Context)
+							if err != nil {
+								return err
+							}
+							fmt.Printf("Checked %d files, linked %d files, saved %s\n",
+								result.Files, result.Linked, formatBytes(result.BytesSaved))
+							return nil
+						},
+					},
+					{
+						Name:  "export",
+						Usage: "Write the runtime closure of derivations or modules to stdout",
+						UsageText: `bramble store export <derivation|module> [...] > closure.tar
+
+export writes the outputs of the passed derivations, along with all of their
+runtime dependencies, to a tar archive on stdout. Arguments can be the
+filenames of derivations in the store or modules, modules are built first:
+
+bramble store export ./tests/basic:self_reference > closure.tar
+
+Outputs are normalized the same way they are when they're uploaded to a cache,
+so the archive can be imported into any store with "bramble store import".
+`,
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() == 0 {
+								return errors.New("bramble store export takes at least one derivation or module")
+							}
+							return storeExport(c.Context, wd, c.Args().Slice())
+						},
+					},
+					{
+						Name:  "import",
+						Usage: "Add the derivations and outputs in an exported archive to the store",
+						UsageText: `bramble store import < closure.tar
+
+import reads an archive written by "bramble store export" from stdin and adds
+its derivations and outputs to the store. Outputs are relocated to the local
+store and checked against their hash, the same way outputs downloaded from a
+cache are.
+`,
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() != 0 {
+								return errors.New("bramble store import doesn't take any arguments")
+							}
+							return storeImport(c.Context)
+						},
+					},
+					{
+						Name:  "relocate",
+						Usage: "Move the bramble directory and the store to a new path",
+						UsageText: `bramble store relocate <new-path>
+
+relocate moves the bramble directory to a new path, which must not exist yet.
+The store path is padded so that it has the same length wherever it is, so
+references to the old store path in build outputs are rewritten instead of
+building them again. The store is verified once it has moved. If the new path
+is on a different disk the bramble directory is copied, and the original is
+removed once the copy has been verified. If relocation fails the store is
+moved back, if that isn't possible the error says where the store was left.
+
+Set BRAMBLE_PATH to the new path to keep using the store.
+`,
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() != 1 {
+								return errors.New("bramble store relocate takes one argument, the new path")
+							}
+							s, err := store.NewStore("")
+							if err != nil {
+								return err
+							}
+							bramblePath, err := filepath.Abs(c.Args().First())
+							if err != nil {
+								return err
+							}
+							relocated, result, err := s.Relocate(c.Context, bramblePath)
+							for _, problem := range result.Problems {
+								fmt.Println(problem)
+							}
+							if err != nil {
+								return err
+							}
+							if len(result.Problems) > 0 {
+								return errors.Errorf("moved the store to %s but found %d problems, run \"bramble store verify --repair\" to fix them",
+									relocated.BramblePath, len(result.Problems))
+							}
+							fmt.Printf("Moved the store to %s, set BRAMBLE_PATH=%s to use it\n", relocated.BramblePath, relocated.BramblePath)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:      "cache",
+				Usage:     "Upload build outputs to binary caches and sign them",
+				UsageText: "bramble cache <command>",
+				Action:    cli.ShowAppHelp,
+				Subcommands: []*cli.Command{
+					{
+						Name:  "keygen",
+						Usage: "Generate a key pair for signing derivations",
+						UsageText: `bramble cache keygen <name> <secret-key-file> <public-key-file>
+
+keygen generates an ed25519 key pair and writes it to the passed files. The
+name identifies the key in signatures, it's common to use the hostname of the
+cache followed by a number: cache.example.com-1
+
+Derivations are signed with the secret key by "bramble cache sign" and "bramble
+cache push --sign-key". The public key is added to trusted_public_keys in the
+[cache] section of bramble.toml or the user config so that signed outputs can
+be substituted.
+`,
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() != 3 {
+								return errors.New("bramble cache keygen takes a key name, a secret key file and a public key file")
+							}
+							return cacheKeygen(c.Args().Get(0), c.Args().Get(1), c.Args().Get(2))
+						},
+					},
+					{
+						Name:  "sign",
+						Usage: "Build modules and sign their runtime closures",
+						UsageText: `bramble cache sign --key <secret-key-file> [modules...]
+
+sign builds the passed modules and signs every derivation they return, along
+with all of their runtime dependencies, in the local store. Signatures are
+uploaded with the derivations by "bramble cache push".
+`,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "key",
+								Usage:    "file containing the secret key to sign with",
+								Required: true,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() == 0 {
+								return errors.New("bramble cache sign takes at least one module")
+							}
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.cacheSign(c.Context, c.Args().Slice(), c.String("key"))
+						},
+					},
+					{
+						Name:  "push",
+						Usage: "Build modules and upload their runtime closures to a cache",
+						UsageText: `bramble cache push <url> [modules...]
+
+push builds the passed modules and uploads the outputs of every derivation they
+return, along with all of their runtime dependencies, to a cache. The url can
+point at a bramble cache server or an S3 compatible bucket:
+
+bramble cache push https://cache.example.com ./...
+bramble cache push s3://bucket ./tests/basic:self_reference
+
+S3 uploads are configured with the following environment variables:
+
+BRAMBLE_S3_ACCESS_KEY_ID      access key id, required
+BRAMBLE_S3_SECRET_ACCESS_KEY  secret access key, required
+BRAMBLE_S3_ENDPOINT           endpoint of an S3 compatible api, defaults to AWS
+BRAMBLE_S3_REGION             bucket region, defaults to us-east-1
+
+Derivations that are signed in the local store are uploaded with their
+signatures, pass --sign-key to sign them before uploading.
+`,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "sign-key",
+								Usage: "file containing a secret key to sign derivations with before uploading",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() < 2 {
+								return errors.New("bramble cache push takes a url and at least one module")
+							}
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.cachePush(c.Context, c.Args().First(), c.Args().Tail(), c.String("sign-key"))
+						},
+					},
+				},
+			},
+			{
+				Name:  "publish",
+				Usage: "Build and publish a package",
+				UsageText: `bramble publish [--from source] package [reference]
+
+publish builds a package and publishes it to a registry. By default the package
+is fetched from the git repository at https://<package>.git and the name of
+every package in the repository must match its location. With --from the
+package is fetched from the git url or local directory that is passed, and is
+published with the name that's passed instead:
+
+    bramble publish --from https://git.example.com/lib.git example.com/lib v1.2.0
+
+Local directories are always built locally, as if --local was passed. When
+publishing a local directory the package name can be left out to use the name in
+its bramble.toml. If a reference is passed the directory must be a git
+repository.
+`,
 				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "from",
+						Value: "",
+						Usage: "A git url or local directory to fetch the package from.",
+					},
 					&cli.StringFlag{
 						Name:  "url",
 						Value: "",
@@ -364,27 +781,45 @@ their public functions with documentation. If an immediate subdirectory has a
 						Value: false,
 						Usage: "Build locally, don't send to a build server.",
 					},
-					&cli.BoolFlag{
+					&cli.StringFlag{
 						Name:  "upload",
-						Value: false,
-						Usage: "Upload resulting build artifacts to an object store.",
+						Value: "",
+						Usage: "Upload resulting build artifacts to a cache, takes the same urls as \"bramble cache push\".",
 					},
 				},
 				Action: func(c *cli.Context) error {
 					args := c.Args().Slice()
-					if len(args) == 0 {
+					source := c.String("from")
+					localSource := source != "" && !strings.Contains(source, "://")
+					if len(args) == 0 && !localSource {
 						return errors.New("bramble publish takes at least one argument: \"module\"")
 					}
 					if len(args) > 2 {
 						return errors.New("bramble publish takes at most two arguments")
 					}
-					module := args[0]
+					module := ""
+					if len(args) > 0 {
+						module = args[0]
+					}
 					reference := ""
 					if len(args) == 2 {
 						reference = args[1]
 					}
+					local := c.Bool("local")
+					if localSource {
+						// Package servers don't publish files from their
+						// filesystem, so local directories are built here
+						if c.String("url") != "" {
+							return errors.New("local directories are built locally, they can't be sent to --url")
+						}
+						local = true
+						var err error
+						if source, err = filepath.Abs(source); err != nil {
+							return err
+						}
+					}
 
-					if c.Bool("local") {
+					if local {
 						// TODO: add build cache handler to this server
 						s, err := store.NewStore("")
 						if err != nil {
@@ -392,16 +827,21 @@ their public functions with documentation. If an immediate subdirectory has a
 						}
 						builder := dependency.Builder(filepath.Join(s.BramblePath, "var/dependencies"),
 							newBuilder(s),
-							dependency.DownloadGithubRepo,
+							dependency.FetchSource,
 						)
 						builtDerivations, err := builder(&dependency.Job{
 							Package:   module,
+							Source:    source,
 							Reference: reference,
 						})
 						if err != nil {
 							return err
 						}
-						if c.Bool("upload") {
+						if url := c.String("upload"); url != "" {
+							cc, err := newCacheClient(url)
+							if err != nil {
+								return err
+							}
 							var drvs []store.Derivation
 							for _, drvFilename := range builtDerivations {
 								drv, _, err := s.LoadDerivation(drvFilename)
@@ -410,25 +850,32 @@ their public functions with documentation. If an immediate subdirectory has a
 								}
 								drvs = append(drvs, drv)
 							}
-							// TODO: replace with something generally usable
-							s3 := simples3.New("",
-								os.Getenv("DIGITALOCEAN_SPACES_ACCESS_ID"),
-								os.Getenv("DIGITALOCEAN_SPACES_SECRET_KEY"))
-							s3.SetEndpoint("nyc3.digitaloceanspaces.com")
-							cc := store.NewS3CacheClient(s3)
 							fmt.Printf("Uploading %d derivations\n", len(drvs))
-							if err := s.UploadDerivationsToCache(c.Context, drvs, cc); err != nil {
+							if err := s.UploadDerivationsToCache(c.Context, drvs, cc, store.UploadOptions{Progress: os.Stderr}); err != nil {
 								return err
 							}
 						}
 						return nil
 					}
 
-					url := "https://store.bramble.run"
+					s, err := store.NewStore("")
+					if err != nil {
+						return err
+					}
+					userConfig, err := config.ReadUserConfig(filepath.Join(s.BramblePath, "config.toml"))
+					if err != nil {
+						return err
+					}
+					// Publish to the registry that the package would be fetched from
+					var cfg config.Config
+					if p, err := project.NewProject(wd); err == nil {
+						cfg = p.Config()
+					}
+					url := config.PackageRegistries(config.Registries(cfg, userConfig), module)[0].URL
 					if u := c.String("url"); u != "" {
 						url = u
 					}
-					return dependency.PostJob(c.Context, url, module, reference)
+					return dependency.PostJob(c.Context, url, module, source, reference, os.Getenv("BRAMBLE_TOKEN"))
 				},
 			},
 			{
@@ -450,12 +897,167 @@ their public functions with documentation. If an immediate subdirectory has a
 					return b.project.AddDependency(types.Package{Version: parts[1], Name: parts[0]})
 				},
 			},
+			{
+				Name:  "update",
+				Usage: "Upgrade dependencies to their newest compatible version",
+				UsageText: `bramble update [package...]
+
+update upgrades the passed packages to the newest version with the same major
+version and recalculates the versions of every other dependency. If no packages
+are passed every dependency is upgraded. The new versions are written to
+bramble.toml.
+`,
+				Action: func(c *cli.Context) error {
+					b, err := newBramble(wd, "")
+					if err != nil {
+						return err
+					}
+					return b.project.UpdateDependencies(c.Args().Slice()...)
+				},
+			},
+			{
+				Name:  "downgrade",
+				Usage: "Downgrade a dependency to an older version",
+				UsageText: `bramble downgrade package@version
+
+downgrade changes the version of a dependency to an older version with the same
+major version. Dependencies that require a newer version of the package are
+downgraded as well, or removed if none of their versions are old enough. The
+new versions are written to bramble.toml.
+`,
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return cli.ShowCommandHelp(c, "downgrade")
+					}
+					parts := strings.Split(c.Args().First(), "@")
+					if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+						return errors.Errorf("%q must be in the form package@version", c.Args().First())
+					}
+					b, err := newBramble(wd, "")
+					if err != nil {
+						return err
+					}
+					return b.project.DowngradeDependency(types.Package{Name: parts[0], Version: parts[1]})
+				},
+			},
+			{
+				Name:      "mod",
+				Usage:     "Inspect the dependencies of a project",
+				UsageText: "bramble mod <command>",
+				Action:    cli.ShowAppHelp,
+				Subcommands: []*cli.Command{
+					{
+						Name:  "tidy",
+						Usage: "Add missing dependencies and remove unused ones",
+						UsageText: `bramble mod tidy
+
+tidy makes bramble.toml match the load statements in the project's bramble
+files. Packages are found for loads that don't match a dependency and added at
+their newest version. Dependencies that aren't needed by any load are removed
+and the versions of every other dependency are recalculated.
+`,
+						Action: func(c *cli.Context) error {
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.project.TidyDependencies(c.Context)
+						},
+					},
+					{
+						Name:  "vendor",
+						Usage: "Copy the source of every dependency into the project",
+						UsageText: `bramble mod vendor
+
+vendor copies the source of every dependency into the vendor directory of the
+project and records the hash of each source in bramble.lock. Projects with a
+vendor directory only load dependencies from it, and vendored sources must
+match bramble.lock. Dependencies with a path aren't vendored.
+`,
+						Action: func(c *cli.Context) error {
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.project.VendorDependencies(c.Context)
+						},
+					},
+					{
+						Name:  "graph",
+						Usage: "Print the requirement graph of the project",
+						UsageText: `bramble mod graph [--format text|dot|json]
+
+graph prints every requirement that is reachable from the project. The project
+requires the dependencies that its bramble files load, every other package
+requires the dependencies in its bramble.toml. Each line of the text format is
+a package followed by a package it requires. The versions are the ones that are
+asked for, bramble.toml contains the versions that are selected.
+`,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "format",
+								Value: project.GraphFormatText,
+								Usage: "the output format, one of text, dot or json",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.project.ModGraph(os.Stdout, c.String("format"))
+						},
+					},
+					{
+						Name:  "why",
+						Usage: "Print why a package is a dependency",
+						UsageText: `bramble mod why <package>
+
+why prints the shortest chain of requirements from the project to the package.
+`,
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() != 1 {
+								return cli.ShowCommandHelp(c, "why")
+							}
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.project.ModWhy(os.Stdout, c.Args().First())
+						},
+					},
+				},
+			},
 			{
 				Name: "server",
 				UsageText: `bramble server
 
 server starts a server instance. The server can act as a build cache and a
-module cache.
+module cache. The module cache is served at the root of the server and the
+build cache is served at /cache, so a server listening on localhost:2726 can be
+used as a substituter with the url http://localhost:2726/cache. Either half can
+be disabled with --packages=false or --cache=false.
+
+Requests that change the server need a bearer token with a matching scope.
+Tokens are read from --token-file and the BRAMBLE_SERVER_TOKENS environment
+variable. Each token is listed on its own line, followed by a comma separated
+list of scopes:
+
+    5d4a7bd0d53ac6cb publish,cache-write
+    e2e6d4cc8d7f1b2b read
+
+The "publish" scope allows building and publishing packages, "cache-write"
+allows uploading to the cache, "build" allows remote builds and "read" allows
+reads when the server is started with --private. Without tokens the server is
+read-only. Clients send the token in the BRAMBLE_TOKEN environment variable.
+
+With --builds the server also builds derivations for "bramble build --remote".
+Build inputs and outputs are sent through the cache, so remote builders need a
+token with the "build" and "cache-write" scopes.
+
+Package sources are only fetched over http and https from the hosts passed with
+--source-host, github.com by default. Pass --allow-git-transports to also fetch
+ssh:// and git:// sources.
 `,
 				Flags: []cli.Flag{
 					&cli.StringFlag{
@@ -468,25 +1070,84 @@ module cache.
 						Value: "localhost",
 						Usage: "the host that the server will listen on",
 					},
+					&cli.StringFlag{
+						Name:  "token-file",
+						Usage: "file containing tokens and their scopes",
+					},
+					&cli.BoolFlag{
+						Name:  "read-only",
+						Usage: "reject all requests that change the server",
+					},
+					&cli.BoolFlag{
+						Name:  "private",
+						Usage: "require a token with the read scope for reads",
+					},
+					&cli.BoolFlag{
+						Name:  "packages",
+						Value: true,
+						Usage: "serve the package api",
+					},
+					&cli.BoolFlag{
+						Name:  "cache",
+						Value: true,
+						Usage: "serve the build cache api at /cache",
+					},
+					&cli.IntFlag{
+						Name:  "builds",
+						Value: 0,
+						Usage: "build derivations for remote builders at /build, running this many builds at once",
+					},
+					&cli.StringSliceFlag{
+						Name:  "source-host",
+						Value: cli.NewStringSlice("github.com"),
+						Usage: "a host that package sources can be fetched from, can be passed more than once",
+					},
+					&cli.BoolFlag{
+						Name:  "allow-git-transports",
+						Usage: "fetch package sources with the ssh and git protocols",
+					},
 				},
 				Action: func(c *cli.Context) error {
 					listenOn := fmt.Sprintf("%s:%s", c.String("host"), c.String("port"))
-					fmt.Printf("Server listening on: %s\n", listenOn)
 
-					// TODO: add build cache handler to this server
+					tokens, err := loadServerTokens(c.String("token-file"))
+					if err != nil {
+						return err
+					}
+					if len(tokens) == 0 && !c.Bool("read-only") {
+						fmt.Println("No tokens are configured, the server is read-only.")
+					}
+					auth := serverAuth{
+						tokens:   tokens,
+						readOnly: c.Bool("read-only"),
+						private:  c.Bool("private"),
+					}
+
+					if !c.Bool("packages") && !c.Bool("cache") && c.Int("builds") == 0 {
+						return errors.New("nothing to serve, --packages and --cache are both disabled")
+					}
 					store, err := store.NewStore("")
 					if err != nil {
 						return err
 					}
 
+					handler, err := serverHandler(store, auth, serverOptions{
+						packages:     c.Bool("packages"),
+						cache:        c.Bool("cache"),
+						buildWorkers: c.Int("builds"),
+						sources: dependency.ServerOptions{
+							SourceHosts:        c.StringSlice("source-host"),
+							AllowGitTransports: c.Bool("allow-git-transports"),
+						},
+					})
+					if err != nil {
+						return err
+					}
 					srv := &http.Server{
-						Addr: listenOn,
-						Handler: dependency.ServerHandler(
-							filepath.Join(store.BramblePath, "var/dependencies"),
-							newBuilder(store),
-							dependency.DownloadGithubRepo,
-						),
+						Addr:    listenOn,
+						Handler: handler,
 					}
+					fmt.Printf("Server listening on: %s\n", listenOn)
 					errChan := make(chan error)
 					go func() {
 						if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
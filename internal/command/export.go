@@ -0,0 +1,87 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/maxmcd/bramble/internal/store"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// storeExport writes the runtime closure of the passed derivation filenames or
+// modules to stdout. Modules are built first, build progress is written to
+// stderr so that it doesn't end up in the archive.
+func storeExport(ctx context.Context, wd string, args []string) (err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "command.storeExport")
+	defer span.End()
+
+	var s *store.Store
+	var drvs []store.Derivation
+	if isDerivationFilenames(args) {
+		if s, err = store.NewStore(""); err != nil {
+			return err
+		}
+		for _, filename := range args {
+			drv, found, err := s.LoadDerivation(filename)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return errors.Errorf("derivation %s isn't in the store", filename)
+			}
+			drvs = append(drvs, drv)
+		}
+	} else {
+		b, err := newBramble(wd, "")
+		if err != nil {
+			return err
+		}
+		if drvs, err = b.buildClosure(ctx, args, os.Stderr); err != nil {
+			return err
+		}
+		s = b.store
+	}
+	exported, err := s.ExportClosure(ctx, drvs, os.Stdout)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d derivations\n", len(exported))
+	return nil
+}
+
+func isDerivationFilenames(args []string) bool {
+	for _, arg := range args {
+		if !strings.HasSuffix(arg, ".drv") || strings.Contains(arg, "/") {
+			return false
+		}
+	}
+	return true
+}
+
+// storeImport adds the derivations and outputs in an archive written by
+// "bramble store export" to the store.
+func storeImport(ctx context.Context) (err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "command.storeImport")
+	defer span.End()
+
+	s, err := store.NewStore("")
+	if err != nil {
+		return err
+	}
+	imported, err := s.ImportClosure(ctx, os.Stdin)
+	if err != nil {
+		return err
+	}
+	for _, drv := range imported {
+		for i, output := range drv.Outputs {
+			fmt.Printf("%s %s -> %s\n", drv.Filename(), drv.OutputNames[i], output.Path)
+		}
+	}
+	fmt.Printf("Imported %d derivations\n", len(imported))
+	return nil
+}
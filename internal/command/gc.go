@@ -0,0 +1,133 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/maxmcd/bramble/internal/project"
+	"github.com/maxmcd/bramble/internal/store"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type gcOptions struct {
+	dryRun    bool
+	keepCache bool
+}
+
+// runGC evaluates every project in the config registry and removes everything
+// in the store that those projects don't need to build or run.
+func runGC(ctx context.Context, s *store.Store, opts gcOptions) (err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "command.runGC")
+	defer span.End()
+
+	// Projects are evaluated once the store is locked so that nothing they
+	// need can be built or removed in the meantime
+	result, err := s.CollectGarbage(ctx, func() ([]store.Derivation, error) {
+		return registeredRoots(ctx, s, opts)
+	}, store.GCOptions{DryRun: opts.dryRun, KeepCache: opts.keepCache})
+	if err != nil {
+		return err
+	}
+	verb := "Removed"
+	if opts.dryRun {
+		verb = "Would remove"
+	}
+	for _, link := range result.StaleRoots {
+		fmt.Printf("%s root %q from the registry, it no longer points to a build output\n", verb, link)
+	}
+	for _, path := range result.Removed {
+		fmt.Printf("%s %s\n", verb, path)
+	}
+	fmt.Printf("%s %d store paths, %s freed\n", verb, len(result.Removed), formatBytes(result.BytesFreed))
+	return nil
+}
+
+// registeredRoots evaluates every project in the config registry and returns
+// the derivations they have built. Projects that no longer exist are removed
+// from the registry.
+func registeredRoots(ctx context.Context, s *store.Store, opts gcOptions) (roots []store.Derivation, err error) {
+	locations, err := s.ConfigLinks()
+	if err != nil {
+		return nil, err
+	}
+	for _, location := range locations {
+		if !fileutil.FileExists(filepath.Join(location, "bramble.toml")) {
+			if opts.dryRun {
+				fmt.Printf("Would remove project %q from the registry, it no longer exists\n", location)
+				continue
+			}
+			if err := s.RemoveConfigLink(location); err != nil {
+				return nil, err
+			}
+			fmt.Printf("Removed project %q from the registry, it no longer exists\n", location)
+			continue
+		}
+		b, err := newBramble(location, s.BramblePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error loading project %q", location)
+		}
+		drvs, err := b.builtDerivations(ctx)
+		if err != nil {
+			// Any error here means we don't know what this project needs, so
+			// we can't safely delete anything.
+			return nil, errors.Wrapf(err, "error computing derivations in %q", location)
+		}
+		roots = append(roots, drvs...)
+	}
+	return roots, nil
+}
+
+// builtDerivations evaluates all public functions in a project and returns the
+// store derivations that have already been built. Nothing is built and nothing
+// is written to the store, sources are only hashed to find derivation
+// filenames.
+func (b bramble) builtDerivations(ctx context.Context) (drvs []store.Derivation, err error) {
+	output, err := b.execModule(ctx, []string{"./..."}, execModuleOptions{})
+	if err != nil {
+		return nil, err
+	}
+	built := newBuiltOutputs()
+	var lock sync.Mutex
+	err = output.WalkAndPatch(8, func(dep project.Dependency, drv project.Derivation) (addGraph *project.ExecModuleOutput, buildOutputs []project.BuildOutput, err error) {
+		dependencies, err := built.dependencies(drv)
+		if err != nil {
+			// A dependency hasn't been built, so neither has this derivation
+			return nil, nil, nil
+		}
+		source, err := b.store.HashLocalSources(ctx, store.SourceFiles{
+			ProjectLocation: b.project.Location(),
+			Location:        drv.Sources.Location,
+			Files:           drv.Sources.Files,
+		})
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error hashing local files")
+		}
+		exists, buildDrv, err := b.store.NewDerivation(newDerivationOptions(drv, dependencies, source))
+		if err != nil || !exists {
+			return nil, nil, err
+		}
+		lock.Lock()
+		drvs = append(drvs, buildDrv)
+		lock.Unlock()
+		return nil, built.add(dep, buildDrv), nil
+	})
+	return drvs, err
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
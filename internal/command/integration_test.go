@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
@@ -13,6 +15,7 @@ import (
 	"github.com/maxmcd/bramble/internal/cacheclient"
 	"github.com/maxmcd/bramble/internal/config"
 	"github.com/maxmcd/bramble/internal/dependency"
+	"github.com/maxmcd/bramble/internal/project"
 	"github.com/maxmcd/bramble/internal/store"
 	"github.com/maxmcd/bramble/internal/tracing"
 	"github.com/maxmcd/bramble/pkg/fxt"
@@ -187,13 +190,18 @@ func TestDep(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	server := httptest.NewServer(dependency.ServerHandler(
+	handler, err := dependency.ServerHandler(
 		filepath.Join(store.BramblePath, "var/dependencies"),
 		newBuilder(store),
 		func(url, reference string) (location string, err error) {
 			return filepath.Join(projectDir, url), nil
 		},
-	))
+		dependency.ServerOptions{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
 
 	type testRun struct {
 		name        string
@@ -263,6 +271,38 @@ func TestDep(t *testing.T) {
 	}
 }
 
+func TestInitBuild(t *testing.T) {
+	test.SetEnv(t, "BRAMBLE_PATH", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	projectDir := t.TempDir()
+	require.NoError(t, cliApp(projectDir).Run([]string{"bramble", "init", "example"}))
+
+	// The sandbox has no network, so serve the starter url locally and use the
+	// standard library from this repository
+	bramblefile := filepath.Join(projectDir, "default.bramble")
+	b, err := os.ReadFile(bramblefile)
+	require.NoError(t, err)
+	test.WriteFile(t, bramblefile, strings.Replace(string(b), "https://example.com", server.URL, 1))
+	repoRoot, err := filepath.Abs("../..")
+	require.NoError(t, err)
+	configFile := filepath.Join(projectDir, "bramble.toml")
+	b, err = os.ReadFile(configFile)
+	require.NoError(t, err)
+	dependency := fmt.Sprintf("%q = %q", project.StdLibModule, project.StdLibVersion)
+	require.Contains(t, string(b), dependency)
+	test.WriteFile(t, configFile, strings.Replace(string(b), dependency,
+		fmt.Sprintf("%q = {version=%q, path=%q}", project.StdLibModule, project.StdLibVersion, repoRoot), 1))
+
+	require.NoError(t, cliApp(projectDir).Run([]string{"bramble", "build", "./..."}))
+	lockfile, err := os.ReadFile(filepath.Join(projectDir, "bramble.lock"))
+	require.NoError(t, err)
+	assert.Contains(t, string(lockfile), server.URL)
+}
+
 func TestStore_CacheServer(t *testing.T) {
 	ctx := context.Background()
 
@@ -301,7 +341,7 @@ func TestStore_CacheServer(t *testing.T) {
 		// s3 := simples3.New("", "", "")
 		// s3.SetEndpoint("nyc3.digitaloceanspaces.com")
 		// cc := store.NewS3CacheClient(s3)
-		if err := clientStore.UploadDerivationsToCache(ctx, drvs, cc); err != nil {
+		if err := clientStore.UploadDerivationsToCache(ctx, drvs, cc, store.UploadOptions{Progress: io.Discard}); err != nil {
 			t.Fatal(err)
 		}
 
@@ -0,0 +1,204 @@
+package command
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxmcd/bramble/internal/dependency"
+	"github.com/maxmcd/bramble/internal/store"
+	"github.com/maxmcd/bramble/pkg/httpx"
+	"github.com/pkg/errors"
+)
+
+// Scopes that a server token can grant
+const (
+	scopeRead       = "read"
+	scopePublish    = "publish"
+	scopeCacheWrite = "cache-write"
+	scopeBuild      = "build"
+)
+
+// serverAuth authenticates requests to bramble server with bearer tokens.
+// Requests that change the server require a token with a matching scope, read
+// requests are open to everyone unless the server is private.
+type serverAuth struct {
+	// tokens maps tokens to the scopes they grant
+	tokens   map[string][]string
+	readOnly bool
+	private  bool
+}
+
+// loadServerTokens reads tokens from tokenFile and the BRAMBLE_SERVER_TOKENS
+// environment variable. Each token is on its own line, followed by a comma
+// separated list of scopes:
+//
+//	# comments are allowed
+//	5d4a7bd0d53ac6cb publish,cache-write
+//	e2e6d4cc8d7f1b2b read
+//
+// Tokens in the environment variable can also be separated by semicolons.
+func loadServerTokens(tokenFile string) (tokens map[string][]string, err error) {
+	tokens = map[string][]string{}
+	if tokenFile != "" {
+		f, err := os.Open(tokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading token file")
+		}
+		defer f.Close()
+		if err := parseServerTokens(f, tokens); err != nil {
+			return nil, errors.Wrapf(err, "error parsing %q", tokenFile)
+		}
+	}
+	if env := os.Getenv("BRAMBLE_SERVER_TOKENS"); env != "" {
+		if err := parseServerTokens(strings.NewReader(strings.ReplaceAll(env, ";", "\n")), tokens); err != nil {
+			return nil, errors.Wrap(err, "error parsing BRAMBLE_SERVER_TOKENS")
+		}
+	}
+	return tokens, nil
+}
+
+func parseServerTokens(r io.Reader, tokens map[string][]string) (err error) {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return errors.Errorf("line %d: expected a token followed by a list of scopes", line)
+		}
+		scopes := strings.Split(fields[1], ",")
+		for _, scope := range scopes {
+			switch scope {
+			case scopeRead, scopePublish, scopeCacheWrite, scopeBuild:
+			default:
+				return errors.Errorf("line %d: unknown scope %q, scopes can be %q, %q, %q or %q",
+					line, scope, scopeRead, scopePublish, scopeCacheWrite, scopeBuild)
+			}
+		}
+		tokens[fields[0]] = append(tokens[fields[0]], scopes...)
+	}
+	return scanner.Err()
+}
+
+// handler wraps next so that every request must be authorized for the scope
+// returned by scope.
+func (sa serverAuth) handler(next http.Handler, scope func(*http.Request) string) http.Handler {
+	return httpx.Middleware(next, func(c httpx.Context) error {
+		return sa.authorize(c, scope(c.Request))
+	})
+}
+
+func (sa serverAuth) authorize(c httpx.Context, scope string) error {
+	if scope == scopeRead && !sa.private {
+		return nil
+	}
+	if scope != scopeRead && sa.readOnly {
+		return httpx.ErrForbidden(errors.New("server is read-only"))
+	}
+	scopes, ok := sa.lookupToken(c.Request)
+	if !ok {
+		c.ResponseWriter.Header().Set("WWW-Authenticate", "Bearer")
+		return httpx.ErrUnauthorized(errors.New("a valid bearer token is required"))
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return nil
+		}
+	}
+	return httpx.ErrForbidden(errors.Errorf("token does not have the %q scope", scope))
+}
+
+func (sa serverAuth) lookupToken(req *http.Request) (scopes []string, ok bool) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, false
+	}
+	token := []byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	// Compare against every token so that timing doesn't reveal a match
+	for t, s := range sa.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), token) == 1 {
+			scopes, ok = s, true
+		}
+	}
+	return scopes, ok
+}
+
+// dependencyScope returns the scope needed for a request to the dependency
+// server, creating jobs publishes packages
+func dependencyScope(req *http.Request) string {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return scopeRead
+	}
+	return scopePublish
+}
+
+// cacheScope returns the scope needed for a request to the cache server.
+// Asking the cache which objects it's missing doesn't change it.
+func cacheScope(req *http.Request) string {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead ||
+		req.URL.Path == "/missing" {
+		return scopeRead
+	}
+	return scopeCacheWrite
+}
+
+// buildScope returns the scope needed for a request to the build server, every
+// request runs a build
+func buildScope(req *http.Request) string { return scopeBuild }
+
+// Paths the cache and build servers are mounted at, the package server is
+// mounted at the root
+const (
+	cachePathPrefix = "/cache"
+	buildPathPrefix = "/build"
+)
+
+type serverOptions struct {
+	packages bool
+	cache    bool
+	// buildWorkers is the number of derivations that are built at once for
+	// remote builders, builds are disabled if it's zero
+	buildWorkers int
+	// sources limits where the package server fetches sources from
+	sources dependency.ServerOptions
+}
+
+// serverHandler returns the handler for bramble server. The package server is
+// mounted at the root so that existing package urls keep working, the cache
+// server is mounted at /cache and the build server at /build.
+func serverHandler(s *store.Store, auth serverAuth, opts serverOptions) (http.Handler, error) {
+	mux := http.NewServeMux()
+	if opts.cache {
+		mux.Handle(cachePathPrefix+"/", http.StripPrefix(cachePathPrefix,
+			auth.handler(s.CacheServer(), cacheScope)))
+	}
+	if opts.buildWorkers > 0 {
+		if !opts.cache {
+			return nil, errors.New("the build server needs the cache server to send build inputs and outputs")
+		}
+		mux.Handle(buildPathPrefix+"/", http.StripPrefix(buildPathPrefix,
+			auth.handler(s.BuildServer(opts.buildWorkers), buildScope)))
+	}
+	if opts.packages {
+		handler, err := dependency.ServerHandler(
+			filepath.Join(s.BramblePath, "var/dependencies"),
+			newBuilder(s),
+			dependency.FetchSource,
+			opts.sources,
+		)
+		if err != nil {
+			return nil, err
+		}
+		mux.Handle("/", auth.handler(handler, dependencyScope))
+	}
+	return mux, nil
+}
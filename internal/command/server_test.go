@@ -0,0 +1,104 @@
+package command
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxmcd/bramble/internal/store"
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServerTokens(t *testing.T) {
+	tokens := map[string][]string{}
+	require.NoError(t, parseServerTokens(strings.NewReader(`
+# publishing token
+a publish,cache-write
+
+b read
+`), tokens))
+	require.Equal(t, map[string][]string{
+		"a": {scopePublish, scopeCacheWrite},
+		"b": {scopeRead},
+	}, tokens)
+
+	require.Error(t, parseServerTokens(strings.NewReader("a"), tokens))
+	require.Error(t, parseServerTokens(strings.NewReader("a admin"), tokens))
+}
+
+func TestServerAuth(t *testing.T) {
+	tokens := map[string][]string{
+		"publisher": {scopePublish},
+		"reader":    {scopeRead},
+	}
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	for _, tt := range []struct {
+		name   string
+		auth   serverAuth
+		method string
+		token  string
+		code   int
+	}{
+		{"public read", serverAuth{tokens: tokens}, http.MethodGet, "", http.StatusOK},
+		{"missing token", serverAuth{tokens: tokens}, http.MethodPost, "", http.StatusUnauthorized},
+		{"wrong token", serverAuth{tokens: tokens}, http.MethodPost, "nope", http.StatusUnauthorized},
+		{"missing scope", serverAuth{tokens: tokens}, http.MethodPost, "reader", http.StatusForbidden},
+		{"publish", serverAuth{tokens: tokens}, http.MethodPost, "publisher", http.StatusOK},
+		{"read-only", serverAuth{tokens: tokens, readOnly: true}, http.MethodPost, "publisher", http.StatusForbidden},
+		{"read-only read", serverAuth{tokens: tokens, readOnly: true}, http.MethodGet, "", http.StatusOK},
+		{"private read", serverAuth{tokens: tokens, private: true}, http.MethodGet, "", http.StatusUnauthorized},
+		{"private read with token", serverAuth{tokens: tokens, private: true}, http.MethodGet, "reader", http.StatusOK},
+		{"private read without scope", serverAuth{tokens: tokens, private: true}, http.MethodGet, "publisher", http.StatusForbidden},
+		{"no tokens", serverAuth{}, http.MethodPost, "publisher", http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/job", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			tt.auth.handler(ok, dependencyScope).ServeHTTP(rec, req)
+			require.Equal(t, tt.code, rec.Code, rec.Body.String())
+		})
+	}
+}
+
+func TestServerHandler(t *testing.T) {
+	s, err := store.NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	auth := serverAuth{tokens: map[string][]string{"writer": {scopeCacheWrite}}}
+
+	request := func(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	h, err := serverHandler(s, auth, serverOptions{packages: true, cache: true})
+	require.NoError(t, err)
+	rec := request(h, http.MethodPost, "/cache/missing", "", `{"Chunks": ["nope"]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Contains(t, rec.Body.String(), "nope")
+	require.Equal(t, http.StatusUnauthorized, request(h, http.MethodPost, "/cache/chunk", "", "hi").Code)
+	require.Equal(t, http.StatusOK, request(h, http.MethodPost, "/cache/chunk", "writer", "hi").Code)
+	require.Equal(t, http.StatusForbidden, request(h, http.MethodPost, "/job", "writer", "{}").Code)
+
+	cacheOnly, err := serverHandler(s, auth, serverOptions{cache: true})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, request(cacheOnly, http.MethodPost, "/job", "writer", "{}").Code)
+	packagesOnly, err := serverHandler(s, auth, serverOptions{packages: true})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, request(packagesOnly, http.MethodGet, "/cache/chunk/nope", "", "").Code)
+
+	builds, err := serverHandler(s, auth, serverOptions{cache: true, buildWorkers: 1})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, request(builds, http.MethodPost, "/build/derivation", "writer", "{}").Code)
+	_, err = serverHandler(s, auth, serverOptions{buildWorkers: 1})
+	require.Error(t, err, "builds need the cache")
+}
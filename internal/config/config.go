@@ -23,13 +23,41 @@ import (
 type Config struct {
 	Package      Package `toml:"package"`
 	Dependencies map[string]Dependency
+	Cache        Cache `toml:"cache"`
+	// Registries are package servers that dependencies are fetched from, they
+	// are tried before the registries in the user config.
+	Registries []Registry `toml:"registries"`
 }
 
 func (cfg Config) Render(w io.Writer) {
 	fmt.Fprintln(w, "[package]")
 	fxt.Fprintfln(w, "name = %q", cfg.Package.Name)
 	fxt.Fprintfln(w, "version = %q", cfg.Package.Version)
+	if len(cfg.Package.ReadOnlyPaths) > 0 {
+		fxt.Fprintfln(w, "read_only_paths = %s", renderStrings(cfg.Package.ReadOnlyPaths))
+	}
+	if len(cfg.Package.HiddenPaths) > 0 {
+		fxt.Fprintfln(w, "hidden_paths = %s", renderStrings(cfg.Package.HiddenPaths))
+	}
 	fmt.Fprintln(w)
+	if len(cfg.Cache.Substituters) > 0 || len(cfg.Cache.TrustedPublicKeys) > 0 {
+		fmt.Fprintln(w, "[cache]")
+		if len(cfg.Cache.Substituters) > 0 {
+			fxt.Fprintfln(w, "substituters = %s", renderStrings(cfg.Cache.Substituters))
+		}
+		if len(cfg.Cache.TrustedPublicKeys) > 0 {
+			fxt.Fprintfln(w, "trusted_public_keys = %s", renderStrings(cfg.Cache.TrustedPublicKeys))
+		}
+		fmt.Fprintln(w)
+	}
+	for _, registry := range cfg.Registries {
+		fmt.Fprintln(w, "[[registries]]")
+		fxt.Fprintfln(w, "url = %q", registry.URL)
+		if registry.Prefix != "" {
+			fxt.Fprintfln(w, "prefix = %q", registry.Prefix)
+		}
+		fmt.Fprintln(w)
+	}
 	fmt.Fprintln(w, "[dependencies]")
 	var keys []string
 	for key := range cfg.Dependencies {
@@ -46,6 +74,14 @@ func (cfg Config) Render(w io.Writer) {
 	}
 }
 
+func renderStrings(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
 // LoadValueToDependency takes the string from a `load()` statement and returns
 // the matching dependency in this config, if there is one
 func (cfg Config) LoadValueToDependency(val string) string {
@@ -92,6 +128,111 @@ type Package struct {
 	HiddenPaths   []string `toml:"hidden_paths"`
 }
 
+// Cache configures the binary caches that are used during builds
+type Cache struct {
+	// Substituters are the urls of caches that build outputs are downloaded
+	// from before building. They are tried in order.
+	Substituters []string `toml:"substituters"`
+	// TrustedPublicKeys are the public keys of caches in the form
+	// "<name>:<base64 key>". Outputs are only downloaded from a cache if they
+	// are signed by one of these keys.
+	TrustedPublicKeys []string `toml:"trusted_public_keys"`
+}
+
+// DefaultPackageServer is the package server that dependencies are fetched
+// from if no other registry is configured.
+const DefaultPackageServer = "https://store.bramble.run"
+
+// Registry is a package server that dependencies are fetched from.
+type Registry struct {
+	URL string `toml:"url"`
+	// Prefix limits the registry to packages with names that start with it.
+	// A trailing "*" is allowed, so "corp.example.com/*" matches every package
+	// hosted at corp.example.com.
+	Prefix string `toml:"prefix"`
+}
+
+// Matches returns true if the registry has a prefix that matches the package
+// name.
+func (r Registry) Matches(name string) bool {
+	prefix := strings.TrimSuffix(r.Prefix, "*")
+	return prefix != "" && (strings.HasPrefix(name, prefix) || name == strings.TrimSuffix(prefix, "/"))
+}
+
+// Registries returns the registries of a project followed by the registries in
+// the user config. DefaultPackageServer is added if none of them are used for
+// every package.
+func Registries(cfg Config, userConfig UserConfig) (registries []Registry) {
+	registries = append(registries, cfg.Registries...)
+	registries = append(registries, userConfig.Registries...)
+	for _, r := range registries {
+		if r.Prefix == "" {
+			return registries
+		}
+	}
+	return append(registries, Registry{URL: DefaultPackageServer})
+}
+
+// PackageRegistries returns the registries that a package is fetched from, in
+// the order they're tried. If any registry has a prefix that matches the
+// package only those registries are used, so that private packages are never
+// requested from public registries. Otherwise every registry without a prefix
+// is used.
+func PackageRegistries(registries []Registry, name string) (out []Registry) {
+	for _, r := range registries {
+		if r.Matches(name) {
+			out = append(out, r)
+		}
+	}
+	if len(out) > 0 {
+		return out
+	}
+	for _, r := range registries {
+		if r.Prefix == "" {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// UserConfig is configuration that applies to every project a user builds.
+// It's read from config.toml in the bramble path.
+type UserConfig struct {
+	Cache Cache `toml:"cache"`
+	// Registries are package servers that dependencies are fetched from, they
+	// are tried after the registries in a project's bramble.toml.
+	Registries []Registry `toml:"registries"`
+	// Builders are bramble servers that builds are distributed to in
+	// addition to the local machine.
+	Builders []Builder `toml:"builders"`
+	Store    Store     `toml:"store"`
+}
+
+// Store configures the local store.
+type Store struct {
+	// AutoOptimise replaces identical files in new build outputs with hard
+	// links.
+	AutoOptimise bool `toml:"auto_optimise"`
+}
+
+// Builder is a bramble server that builds derivations. If Platform or
+// MaxConcurrency aren't set they're requested from the server.
+type Builder struct {
+	URL            string `toml:"url"`
+	Platform       string `toml:"platform"`
+	MaxConcurrency int    `toml:"max_concurrency"`
+}
+
+// ReadUserConfig reads the user config at location, an empty config is
+// returned if the file doesn't exist.
+func ReadUserConfig(location string) (cfg UserConfig, err error) {
+	if !fileutil.FileExists(location) {
+		return cfg, nil
+	}
+	_, err = toml.DecodeFile(location, &cfg)
+	return cfg, errors.Wrapf(err, "error decoding %q", location)
+}
+
 func getConfigLock(dir string) (io.Closer, error) {
 	count := 0
 	for {
@@ -184,12 +325,14 @@ func WriteLockfile(lockFile *LockFile, dir string) (err error) {
 	defer func() { _ = f.Close() }()
 
 	lf := LockFile{
-		URLHashes: map[string]string{},
+		URLHashes:    map[string]string{},
+		Dependencies: map[string]string{},
 	}
 	if _, err := toml.DecodeReader(f, &lf); err != nil {
 		return err
 	}
-	if reflect.DeepEqual(lockFile.URLHashes, lf.URLHashes) {
+	if reflect.DeepEqual(lockFile.URLHashes, lf.URLHashes) &&
+		reflect.DeepEqual(lockFile.Dependencies, lf.Dependencies) {
 		return nil
 	}
 
@@ -201,14 +344,23 @@ func WriteLockfile(lockFile *LockFile, dir string) (err error) {
 		}
 		lf.URLHashes[url] = hash
 	}
+	for pkg, hash := range lockFile.Dependencies {
+		if v, ok := lf.Dependencies[pkg]; ok && v != hash {
+			return errors.Errorf("found existing hash for package %s with value %q not %q, not sure how to proceed", pkg, v, hash)
+		}
+		lf.Dependencies[pkg] = hash
+	}
 
 	return toml.NewEncoder(f).Encode(&lf)
 }
 
 type LockFile struct {
 	URLHashes map[string]string
-	changed   bool
-	lock      sync.RWMutex
+	// Dependencies are the hashes of the sources of every dependency, keyed by
+	// name@version
+	Dependencies map[string]string `toml:",omitempty"`
+	changed      bool
+	lock         sync.RWMutex
 }
 
 var _ types.LockfileWriter = new(LockFile)
@@ -238,3 +390,32 @@ func (l *LockFile) LookupEntry(k string) (v string, found bool) {
 	v, found = l.URLHashes[k]
 	return v, found
 }
+
+// AddDependency records the hash of the source of a package. It's an error if a
+// different hash is already recorded.
+func (l *LockFile) AddDependency(pkg types.Package, hash string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	oldHash, found := l.Dependencies[pkg.String()]
+	if found && oldHash != hash {
+		return errors.Errorf(
+			"Existing lockfile entry found for package %s, old hash %q does not equal new hash value %q",
+			pkg, oldHash, hash)
+	}
+	if !found {
+		if l.Dependencies == nil {
+			l.Dependencies = map[string]string{}
+		}
+		l.Dependencies[pkg.String()] = hash
+		l.changed = true
+	}
+	return nil
+}
+
+// LookupDependency returns the hash of the source of a package.
+func (l *LockFile) LookupDependency(pkg types.Package) (hash string, found bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	hash, found = l.Dependencies[pkg.String()]
+	return hash, found
+}
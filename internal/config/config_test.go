@@ -1,8 +1,12 @@
 package config
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/maxmcd/bramble/internal/types"
 	"github.com/stretchr/testify/require"
 )
 
@@ -56,3 +60,60 @@ func TestConfig_LoadValueToDependency(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_Render(t *testing.T) {
+	cfg := Config{
+		Package: Package{
+			Name:          "github.com/maxmcd/bramble",
+			Version:       "0.0.1",
+			ReadOnlyPaths: []string{"./"},
+		},
+		Dependencies: map[string]Dependency{
+			"github.com/maxmcd/busybox": {Version: "0.0.2"},
+		},
+		Cache: Cache{
+			Substituters:      []string{"https://store.bramble.run"},
+			TrustedPublicKeys: []string{"store.bramble.run-1:4Zsmx1sJ5dpOB7ONH4Sr8+NZ5ZbNC9zpiV4bZhBqbME="},
+		},
+	}
+	var buf bytes.Buffer
+	cfg.Render(&buf)
+	parsed, err := ParseConfig(&buf)
+	require.NoError(t, err)
+	require.Equal(t, cfg, parsed)
+}
+
+func TestWriteLockfile_dependencies(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	Config{Package: Package{Name: "x.y/z", Version: "0.0.1"}}.Render(&buf)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bramble.toml"), buf.Bytes(), 0644))
+
+	pkg := types.Package{Name: "x.y/dep", Version: "1.0.0"}
+	lockFile := &LockFile{}
+	require.NoError(t, lockFile.AddDependency(pkg, "hash"))
+	require.Error(t, lockFile.AddDependency(pkg, "other"))
+	require.NoError(t, WriteLockfile(lockFile, dir))
+
+	_, lockFile, err := ReadConfigs(dir)
+	require.NoError(t, err)
+	hash, found := lockFile.LookupDependency(pkg)
+	require.True(t, found)
+	require.Equal(t, "hash", hash)
+}
+
+func TestPackageRegistries(t *testing.T) {
+	corp := Registry{URL: "https://bramble.internal", Prefix: "corp.example.com/*"}
+	mirror := Registry{URL: "http://localhost:2726"}
+	registries := Registries(
+		Config{Registries: []Registry{corp}},
+		UserConfig{Registries: []Registry{mirror}},
+	)
+	require.Equal(t, []Registry{corp, mirror}, registries)
+	require.Equal(t, []Registry{corp}, PackageRegistries(registries, "corp.example.com/lib"))
+	require.Equal(t, []Registry{mirror}, PackageRegistries(registries, "github.com/maxmcd/busybox"))
+
+	// The default registry is used for packages that don't match a prefix
+	registries = Registries(Config{Registries: []Registry{corp}}, UserConfig{})
+	require.Equal(t, []Registry{{URL: DefaultPackageServer}}, PackageRegistries(registries, "github.com/maxmcd/busybox"))
+}
@@ -0,0 +1,161 @@
+package dependency
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/maxmcd/bramble/internal/config"
+	"github.com/maxmcd/bramble/internal/types"
+	"github.com/pkg/errors"
+)
+
+// Metadata fetched from the package server is cached in the dependency
+// directory so that dependencies can be resolved without the network. The
+// config of a published version never changes, so configs are cached until
+// they're deleted. Version lists change whenever a package is published and
+// are refetched once they expire. When the Manager is offline cached metadata
+// is used regardless of its age.
+
+// versionsCacheExpiry is how long a cached list of package versions is used
+// before it's fetched again
+const versionsCacheExpiry = 10 * time.Minute
+
+func (dd dir) cachedVersionsLocation(name string) string {
+	return dd.join("cache", "versions", name+".json")
+}
+
+func (dd dir) cachedConfigLocation(pkg types.Package) string {
+	return dd.join("cache", "config", pkg.String()+".toml")
+}
+
+// writeCacheFile atomically writes a file to the metadata cache.
+func writeCacheFile(location string, b []byte) (err error) {
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(location), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), location)
+}
+
+// noPackageServer returns an error for metadata that isn't available locally
+// and can't be fetched.
+func (dm *Manager) noPackageServer(what string) error {
+	if dm.offline {
+		return errors.Errorf("%s isn't in the local dependency cache at %s and bramble is offline", what, dm.dir)
+	}
+	return errors.Errorf("%s isn't available locally and no registry is configured for it", what)
+}
+
+// remotePackageVersions returns the versions of a package from the first
+// registry that has it. os.ErrNotExist is returned if no registry has the
+// package, or if the versions aren't cached and they can't be fetched.
+func (dm *Manager) remotePackageVersions(ctx context.Context, name string) (vs []string, err error) {
+	location := dm.dir.cachedVersionsLocation(name)
+	if fi, err := os.Stat(location); err == nil &&
+		(dm.offline || time.Since(fi.ModTime()) < versionsCacheExpiry) {
+		b, err := ioutil.ReadFile(location)
+		if err != nil {
+			return nil, err
+		}
+		return vs, json.Unmarshal(b, &vs)
+	}
+	if dm.offline {
+		return nil, os.ErrNotExist
+	}
+	if err = dm.fromRegistries(name, func(dc *dependencyClient) (err error) {
+		vs, err = dc.getPackageVersions(ctx, name)
+		if err == nil && len(vs) == 0 {
+			// The server returns an empty list for packages it doesn't have
+			return os.ErrNotExist
+		}
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(vs)
+	if err != nil {
+		return nil, err
+	}
+	return vs, writeCacheFile(location, b)
+}
+
+// remotePackageConfig returns the config of a package version from the first
+// registry that has it.
+func (dm *Manager) remotePackageConfig(ctx context.Context, pkg types.Package) (cfg config.Config, err error) {
+	location := dm.dir.cachedConfigLocation(pkg)
+	if _, err := os.Stat(location); err == nil {
+		return config.ReadConfig(location)
+	}
+	if dm.offline || len(dm.registries) == 0 {
+		return cfg, dm.noPackageServer("the config of package " + pkg.String())
+	}
+	if err = dm.fromRegistries(pkg.Name, func(dc *dependencyClient) (err error) {
+		cfg, err = dc.getPackageConfig(ctx, pkg)
+		return err
+	}); err != nil {
+		if err == os.ErrNotExist {
+			err = errors.Errorf("no registry has package %s", pkg)
+		}
+		return cfg, err
+	}
+	var buf bytes.Buffer
+	cfg.Render(&buf)
+	return cfg, writeCacheFile(location, buf.Bytes())
+}
+
+// remotePackageSource downloads the source of a package version from the
+// first registry that has it. Sources aren't cached here, they're unarchived
+// into the dependency directory by PackagePathOrDownload.
+func (dm *Manager) remotePackageSource(ctx context.Context, pkg types.Package) (body io.ReadCloser, err error) {
+	if dm.offline || len(dm.registries) == 0 {
+		return nil, dm.noPackageServer("the source of package " + pkg.String())
+	}
+	err = dm.fromRegistries(pkg.Name, func(dc *dependencyClient) (err error) {
+		body, err = dc.getPackageSource(ctx, pkg)
+		return err
+	})
+	return body, err
+}
+
+// fromRegistries calls fn with a client for each registry of the package, in
+// priority order, until one of them has the package. fn returns os.ErrNotExist
+// if the registry doesn't have it. If a registry fails the next one is tried,
+// and the error is returned if no other registry has the package.
+func (dm *Manager) fromRegistries(name string, fn func(dc *dependencyClient) error) (err error) {
+	client := dm.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var firstErr error
+	for _, registry := range config.PackageRegistries(dm.registries, name) {
+		err := fn(&dependencyClient{host: registry.URL, client: client})
+		if err == nil {
+			return nil
+		}
+		if err != os.ErrNotExist && firstErr == nil {
+			firstErr = errors.Wrapf(err, "error fetching package %s from registry %s", name, registry.URL)
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return os.ErrNotExist
+}
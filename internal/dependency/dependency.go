@@ -7,18 +7,21 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/maxmcd/bramble/internal/config"
 	"github.com/maxmcd/bramble/internal/types"
 	"github.com/maxmcd/bramble/pkg/chunkedarchive"
 	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/pkg/hasher"
 	"github.com/maxmcd/bramble/pkg/httpx"
+	"github.com/maxmcd/bramble/pkg/reptar"
 	"github.com/maxmcd/bramble/v/cmd/go/mvs"
 	"github.com/pkg/errors"
 	"golang.org/x/mod/semver"
@@ -27,13 +30,26 @@ import (
 type Manager struct {
 	dir dir
 
-	dependencyClient *dependencyClient
+	// registries are the package servers that packages are fetched from
+	registries []config.Registry
+	client     *http.Client
+	// offline managers only use local packages and cached package metadata
+	offline bool
+
+	// verified caches the hashes of package sources, keyed by their path
+	verified sync.Map
 }
 
-func NewManager(dependencyDir string, packageHost string) *Manager {
+// NewManager returns a Manager that keeps packages in dependencyDir and fetches
+// them from the registries, see config.PackageRegistries for how registries
+// are picked. If offline is true registries are never contacted and only
+// packages and metadata that are already in dependencyDir are used.
+func NewManager(dependencyDir string, registries []config.Registry, offline bool) *Manager {
 	return &Manager{
-		dir:              dir(dependencyDir),
-		dependencyClient: &dependencyClient{host: packageHost, client: &http.Client{}},
+		dir:        dir(dependencyDir),
+		registries: registries,
+		client:     &http.Client{},
+		offline:    offline,
 	}
 }
 
@@ -43,38 +59,52 @@ func (dd dir) join(v ...string) string {
 	return filepath.Join(append([]string{string(dd)}, v...)...)
 }
 
-func (dd dir) localPackageVersions(pkg string) ([]string, error) {
+func (dd dir) localPackageVersions(pkg string) (versions []string, err error) {
 	path := dd.join("src", pkg)
-	searchGlob := fmt.Sprintf("%s*", path)
+	searchGlob := fmt.Sprintf("%s@*", path)
 	matches, err := filepath.Glob(searchGlob)
 	if err != nil {
 		return nil, err
 	}
-	for i, match := range matches {
-		matches[i] = strings.TrimPrefix(match, path+"@")
+	for _, match := range matches {
+		versions = append(versions, strings.TrimPrefix(match, path+"@"))
 	}
-	return matches, nil
+	return versions, nil
 }
 
 func (dd dir) localPackageLocation(pkg types.Package) (path string) {
 	return dd.join("src", pkg.String())
 }
 
-func (dm *Manager) PackagePathOrDownload(ctx context.Context, pkg types.Package) (path string, err error) {
+// PackagePathOrDownload returns the location of the source of a package,
+// downloading it if it isn't present locally, along with the hash of the
+// source. If hash isn't empty the source must match it. Sources that don't
+// match are never moved into the dependency directory and a local copy that
+// doesn't match is an error, it must be removed by hand.
+func (dm *Manager) PackagePathOrDownload(ctx context.Context, pkg types.Package, hash string) (path, sourceHash string, err error) {
 	path = dm.dir.localPackageLocation(pkg)
 	if fileutil.DirExists(path) {
-		return path, nil
+		if sourceHash, err = dm.PackageSourceHash(path); err != nil {
+			return "", "", err
+		}
+		if hash != "" && sourceHash != hash {
+			return "", "", errors.Errorf(
+				"the source of package %s at %s has hash %s, but bramble.lock expects %s. "+
+					"The local copy has been modified, remove it to download the package again",
+				pkg, path, sourceHash, hash)
+		}
+		return path, sourceHash, nil
 	}
-	body, err := dm.dependencyClient.getPackageSource(ctx, pkg)
+	body, err := dm.remotePackageSource(ctx, pkg)
 	if err != nil {
 		if err == os.ErrNotExist {
-			return "", errors.Errorf("Package %q doesn't exist in the remote cache, do you need to publish it?", pkg)
+			return "", "", errors.Errorf("Package %q doesn't exist in the remote cache, do you need to publish it?", pkg)
 		}
-		return "", err
+		return "", "", err
 	}
 	defer body.Close()
-	if err := os.MkdirAll(path, 0755); err != nil {
-		return "", err
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", "", err
 	}
 	// Copy body to file, we can stream the unarchive if we figure out how to
 	// get the final size earlier and/or seek over http.
@@ -82,18 +112,64 @@ func (dm *Manager) PackagePathOrDownload(ctx context.Context, pkg types.Package)
 	{
 		f, err := os.CreateTemp("", "")
 		if err != nil {
-			return "", err
+			return "", "", err
 		}
 		name = f.Name()
+		defer os.Remove(name)
 		_, _ = io.Copy(f, body)
 		if err := f.Close(); err != nil {
-			return "", err
+			return "", "", err
 		}
 	}
-	if err := chunkedarchive.FileUnarchive(name, path); err != nil {
-		return "", errors.Wrap(err, "error unwrapping chunked archive")
+	// Unarchive next to the final location so that the source is only moved
+	// into place once it's verified
+	tmpDir, err := os.MkdirTemp(filepath.Dir(path), ".download-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := chunkedarchive.FileUnarchive(name, tmpDir); err != nil {
+		return "", "", errors.Wrap(err, "error unwrapping chunked archive")
+	}
+	if sourceHash, err = hashPackageSource(tmpDir); err != nil {
+		return "", "", err
+	}
+	if hash != "" && sourceHash != hash {
+		return "", "", errors.Errorf(
+			"the package server returned source for package %s with hash %s, but bramble.lock expects %s",
+			pkg, sourceHash, hash)
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return "", "", err
+	}
+	if err := os.Rename(tmpDir, path); err != nil {
+		return "", "", err
+	}
+	dm.verified.Store(path, sourceHash)
+	return path, sourceHash, nil
+}
+
+// PackageSourceHash returns the hash of the package source at path, the hash
+// that is recorded in bramble.lock. Sources are only hashed once per Manager.
+func (dm *Manager) PackageSourceHash(path string) (hash string, err error) {
+	if v, ok := dm.verified.Load(path); ok {
+		return v.(string), nil
+	}
+	if hash, err = hashPackageSource(path); err != nil {
+		return "", err
+	}
+	dm.verified.Store(path, hash)
+	return hash, nil
+}
+
+// hashPackageSource hashes a directory of package source. The hash is recorded
+// in bramble.lock so that sources can be verified when they're used.
+func hashPackageSource(path string) (hash string, err error) {
+	h := hasher.New()
+	if err := reptar.Reptar(path, h); err != nil {
+		return "", errors.Wrap(err, "error hashing package source")
 	}
-	return path, os.RemoveAll(name)
+	return h.String(), nil
 }
 
 func (dm *Manager) FindPackage(name string) {
@@ -135,14 +211,185 @@ func (dm *Manager) localPackageDependencies(pkg types.Package) (vs []types.Packa
 }
 
 func (dm *Manager) CalculateConfigBuildlist(cfg config.Config) (config.Config, error) {
-	versions, err := mvs.BuildList(
-		mvsVersionFromPackage(types.Package{Name: cfg.Package.Name, Version: cfg.Package.Version}),
-		dm.reqs(cfg),
-	)
+	versions, err := mvs.BuildList(configTarget(cfg), dm.reqs(cfg))
+	if err != nil {
+		return config.Config{}, err
+	}
+	return configWithBuildlist(cfg, versions), nil
+}
+
+// UpgradeConfigBuildlist upgrades the passed packages to their newest
+// compatible version and returns the config with the new build list. If no
+// packages are passed every dependency is upgraded.
+func (dm *Manager) UpgradeConfigBuildlist(cfg config.Config, pkgs ...string) (config.Config, error) {
+	reqs := dm.reqs(cfg)
+	var versions []mvs.Version
+	var err error
+	if len(pkgs) == 0 {
+		versions, err = mvs.UpgradeAll(configTarget(cfg), reqs)
+	} else {
+		var upgrades []mvs.Version
+		for _, pkg := range pkgs {
+			dep, found := cfg.Dependencies[pkg]
+			if !found {
+				return config.Config{}, errors.Errorf("%q is not a dependency of this project, add it with \"bramble add\"", pkg)
+			}
+			upgrade, err := reqs.Upgrade(mvsVersionFromPackage(types.Package{Name: pkg, Version: dep.Version}))
+			if err != nil {
+				return config.Config{}, err
+			}
+			upgrades = append(upgrades, upgrade)
+		}
+		versions, err = mvs.Upgrade(configTarget(cfg), reqs, upgrades...)
+	}
+	if err != nil {
+		return config.Config{}, err
+	}
+	return configWithBuildlist(cfg, versions), nil
+}
+
+// DowngradeConfigBuildlist downgrades a dependency and returns the config with
+// the new build list. Dependencies that require a newer version of the package
+// are downgraded as well, or removed if no version of them is old enough.
+func (dm *Manager) DowngradeConfigBuildlist(cfg config.Config, pkg types.Package) (config.Config, error) {
+	dep, found := cfg.Dependencies[pkg.Name]
+	if !found {
+		return config.Config{}, errors.Errorf("%q is not a dependency of this project", pkg.Name)
+	}
+	if !semver.IsValid("v"+pkg.Version) || semver.Major("v"+pkg.Version) != semver.Major("v"+dep.Version) {
+		return config.Config{}, errors.Errorf(
+			"can't downgrade %s from %s to %s, versions must have the same major version", pkg.Name, dep.Version, pkg.Version)
+	}
+	if semver.Compare("v"+pkg.Version, "v"+dep.Version) > 0 {
+		return config.Config{}, errors.Errorf(
+			"%s is newer than the current version %s, use \"bramble update\" to upgrade", pkg, dep.Version)
+	}
+	list, err := mvs.Downgrade(configTarget(cfg), dm.reqs(cfg), mvsVersionFromPackage(pkg))
+	if err != nil {
+		return config.Config{}, err
+	}
+	// Downgrade returns requirements, not a build list, so calculate the build
+	// list from the new requirements
+	cfg = configWithBuildlist(cfg, list)
+	return dm.CalculateConfigBuildlist(cfg)
+}
+
+// TidyConfigBuildlist returns the config with the build list of the required
+// dependencies, which must all be in the config. Dependencies that none of
+// them need are removed. Dependencies that are still needed keep their version
+// if it's newer than the version that is required, so tidying never
+// downgrades.
+func (dm *Manager) TidyConfigBuildlist(cfg config.Config, required []string) (config.Config, error) {
+	tidy := cfg
+	tidy.Dependencies = map[string]config.Dependency{}
+	for _, name := range required {
+		dep, found := cfg.Dependencies[name]
+		if !found {
+			return config.Config{}, errors.Errorf("%q is not a dependency of this project", name)
+		}
+		tidy.Dependencies[name] = dep
+	}
+	tidy, err := dm.CalculateConfigBuildlist(tidy)
 	if err != nil {
 		return config.Config{}, err
 	}
+	for name := range tidy.Dependencies {
+		if dep, found := cfg.Dependencies[name]; found {
+			tidy.Dependencies[name] = dep
+		}
+	}
+	return dm.CalculateConfigBuildlist(tidy)
+}
+
+// FindNewestPackage returns the newest version of the package that contains
+// the module.
+func (dm *Manager) FindNewestPackage(ctx context.Context, module string) (pkg types.Package, err error) {
+	name, _, err := dm.FindPackageFromModuleName(ctx, module)
+	if err != nil {
+		return pkg, err
+	}
+	versions, err := dm.packageVersions(ctx, name)
+	if err != nil {
+		return pkg, err
+	}
+	if len(versions) == 0 {
+		return pkg, errors.Errorf("no versions found for package %s", name)
+	}
+	return types.Package{Name: name, Version: versions[len(versions)-1]}, nil
+}
 
+// Requirement is an edge in the requirement graph: Package requires Requires
+// in its bramble.toml.
+type Requirement struct {
+	Package  types.Package
+	Requires types.Package
+}
+
+// RequirementGraph returns every requirement that is reachable from the
+// config's package, ordered breadth first. The versions are the ones each
+// package asks for, not the versions selected for the build list.
+func (dm *Manager) RequirementGraph(cfg config.Config) (graph []Requirement, err error) {
+	reqs := dm.reqs(cfg)
+	seen := map[mvs.Version]bool{configTarget(cfg): true}
+	queue := []mvs.Version{configTarget(cfg)}
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		required, err := reqs.Required(m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error finding requirements of %s", packageFromMVSVersion(m))
+		}
+		for _, r := range required {
+			graph = append(graph, Requirement{
+				Package:  packageFromMVSVersion(m),
+				Requires: packageFromMVSVersion(r),
+			})
+			if !seen[r] {
+				seen[r] = true
+				queue = append(queue, r)
+			}
+		}
+	}
+	return graph, nil
+}
+
+// RequirementChain returns the shortest chain of requirements in the graph from
+// root to any version of the package name. The chain starts with root and ends
+// with the package, it is nil if root doesn't require the package.
+func RequirementChain(graph []Requirement, root types.Package, name string) (chain []types.Package) {
+	edges := map[types.Package][]types.Package{}
+	for _, r := range graph {
+		edges[r.Package] = append(edges[r.Package], r.Requires)
+	}
+	previous := map[types.Package]types.Package{root: {}}
+	queue := []types.Package{root}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if p.Name == name && p != root {
+			for ; p != root; p = previous[p] {
+				chain = append([]types.Package{p}, chain...)
+			}
+			return append([]types.Package{root}, chain...)
+		}
+		for _, next := range edges[p] {
+			if _, found := previous[next]; !found {
+				previous[next] = p
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
+
+func configTarget(cfg config.Config) mvs.Version {
+	return mvsVersionFromPackage(types.Package{Name: cfg.Package.Name, Version: cfg.Package.Version})
+}
+
+// configWithBuildlist replaces the dependencies of the config with the
+// versions, keeping the path overrides of existing dependencies.
+func configWithBuildlist(cfg config.Config, versions []mvs.Version) config.Config {
+	existing := cfg.Dependencies
 	cfg.Dependencies = make(map[string]config.Dependency)
 	for _, version := range versions {
 		v := packageFromMVSVersion(version)
@@ -150,50 +397,101 @@ func (dm *Manager) CalculateConfigBuildlist(cfg config.Config) (config.Config, e
 			continue
 		}
 		// Support path overrides
-		cfg.Dependencies[v.Name] = config.Dependency{Version: v.Version}
+		cfg.Dependencies[v.Name] = config.Dependency{Version: v.Version, Path: existing[v.Name].Path}
+	}
+	return cfg
+}
+
+// packageVersions returns the versions of a package that are available
+// locally or from the package server, sorted from oldest to newest.
+func (dm *Manager) packageVersions(ctx context.Context, name string) (versions []string, err error) {
+	local, err := dm.dir.localPackageVersions(name)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := dm.remotePackageVersions(ctx, name)
+	if err != nil && err != os.ErrNotExist {
+		return nil, errors.Wrapf(err, "error fetching versions of %s", name)
+	}
+	seen := map[string]struct{}{}
+	for _, v := range append(local, remote...) {
+		if _, ok := seen[v]; ok || !semver.IsValid("v"+v) {
+			continue
+		}
+		seen[v] = struct{}{}
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return semver.Compare("v"+versions[i], "v"+versions[j]) < 0 })
+	return versions, nil
+}
+
+// compatibleVersions returns the versions of the package that m refers to
+// that share its major version, in the form that mvs uses and sorted from
+// oldest to newest.
+func (r dependencyManagerReqs) compatibleVersions(m mvs.Version) (versions []string, err error) {
+	loc := strings.LastIndex(m.Name, "@")
+	name, major := m.Name[:loc], m.Name[loc+1:]
+	all, err := r.deps.packageVersions(context.Background(), name)
+	if err != nil {
+		return nil, err
 	}
-	return cfg, nil
+	for _, v := range all {
+		if strings.HasPrefix(v, major+".") {
+			versions = append(versions, strings.TrimPrefix(v, major+"."))
+		}
+	}
+	return versions, nil
 }
 
 func (dm *Manager) remotePackageDependencies(ctx context.Context, m types.Package) (vs []types.Package, err error) {
-	cfg, err := dm.dependencyClient.getPackageConfig(ctx, m)
+	cfg, err := dm.remotePackageConfig(ctx, m)
 	if err != nil {
 		return nil, err
 	}
 	return configVersions(cfg), nil
 }
 
-func PostJob(ctx context.Context, url, pkg, reference string) (err error) {
-	jr := JobRequest{Package: pkg, Reference: reference}
+// PostJob asks the server at url to build and publish a package and streams
+// the build logs to stdout until the job finishes. If token is set it's sent
+// as a bearer token.
+func PostJob(ctx context.Context, url, pkg, source, reference, token string) (err error) {
+	jr := JobRequest{Package: pkg, Source: source, Reference: reference}
 	dc := &dependencyClient{client: &http.Client{}, host: url}
+	if token != "" {
+		dc.client.Transport = httpx.BearerTokenTransport{Token: token}
+	}
 	fmt.Println("Sending build to build server")
-	id, err := dc.postJob(context.Background(), jr)
+	id, err := dc.postJob(ctx, jr)
 	if err != nil {
 		return err
 	}
-	dur := (time.Millisecond * 1000)
 	fmt.Println("Waiting for build result...")
-	for {
-		select {
-		case <-ctx.Done():
+	if err := dc.getLogs(ctx, id, true, os.Stdout); err != nil {
+		if ctx.Err() != nil {
 			return context.Canceled
-		default:
 		}
-		job, err := dc.getJob(context.Background(), id)
+		return errors.Wrap(err, "error fetching build logs")
+	}
+	// The log stream ends when the job ends, but poll in case the stream was
+	// closed early
+	for {
+		job, err := dc.getJob(ctx, id)
 		if err != nil {
 			return err
 		}
 		if job.Error != "" {
-			_ = dc.getLogs(context.Background(), id, os.Stdout)
 			return errors.Wrap(errors.New(job.ErrWithStack), "got error posting job")
 		}
 		if !job.End.IsZero() {
 			fmt.Printf("Build complete in %s\n", job.End.Sub(job.Start))
-			break
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return context.Canceled
+		case <-time.After(time.Second):
 		}
-		time.Sleep(dur)
 	}
-	return nil
 }
 
 func (dm *Manager) reqs(cfg config.Config) mvs.Reqs {
@@ -221,7 +519,6 @@ func (r dependencyManagerReqs) Required(m mvs.Version) (versions []mvs.Version,
 		pkgs, err = r.deps.localPackageDependencies(p)
 	default:
 		// TODO: tracing
-		// TODO: cache this result locally?
 		pkgs, err = r.deps.remotePackageDependencies(context.Background(), p)
 	}
 	if err != nil {
@@ -242,14 +539,38 @@ func (r dependencyManagerReqs) Max(v1, v2 string) (o string) {
 	}
 }
 
+// Upgrade returns the newest version of m with the same major version.
 func (r dependencyManagerReqs) Upgrade(m mvs.Version) (v mvs.Version, err error) {
-	panic("")
-	return
+	versions, err := r.compatibleVersions(m)
+	if err != nil {
+		return m, err
+	}
+	if len(versions) == 0 && m.Version == "none" {
+		return m, errors.Errorf("no versions found for package %s", packageFromMVSVersion(m).Name)
+	}
+	for _, version := range versions {
+		if r.Max(m.Version, version) != m.Version {
+			m.Version = version
+		}
+	}
+	return m, nil
 }
 
+// Previous returns the version of m immediately before m.Version with the same
+// major version, or "none" if there isn't one.
 func (r dependencyManagerReqs) Previous(m mvs.Version) (v mvs.Version, err error) {
-	panic("")
-	return
+	versions, err := r.compatibleVersions(m)
+	if err != nil {
+		return m, err
+	}
+	previous := "none"
+	for _, version := range versions {
+		if version != m.Version && r.Max(m.Version, version) == m.Version {
+			previous = version
+		}
+	}
+	m.Version = previous
+	return m, nil
 }
 
 type dependencyClient struct {
@@ -287,19 +608,27 @@ func (dc *dependencyClient) getJob(ctx context.Context, id string) (job Job, err
 		&job)
 }
 
-func (dc *dependencyClient) getLogs(ctx context.Context, id string, out io.Writer) (err error) {
-	return dc.request(ctx,
+// getLogs writes the logs of a job to out. If follow is true logs are
+// streamed until the job ends.
+func (dc *dependencyClient) getLogs(ctx context.Context, id string, follow bool, out io.Writer) (err error) {
+	var body io.ReadCloser
+	if err := dc.request(ctx,
 		http.MethodGet,
-		"/job/"+id+"/logs",
+		fmt.Sprintf("/job/%s/logs?follow=%t", id, follow),
 		"",
 		nil,
-		out)
+		&body); err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(out, body)
+	return err
 }
 
 func (dc *dependencyClient) getPackageVersions(ctx context.Context, name string) (vs []string, err error) {
 	return vs, dc.request(ctx,
 		http.MethodGet,
-		"/package/"+name,
+		"/package/versions/"+name,
 		"",
 		nil,
 		&vs)
@@ -315,9 +644,9 @@ func possiblePackageVariants(name string) (variants []string) {
 	return
 }
 
-func (dc *dependencyClient) findPackageFromModuleName(ctx context.Context, name string) (n string, vs []string, err error) {
+func (dm *Manager) findRemotePackageFromModuleName(ctx context.Context, name string) (n string, vs []string, err error) {
 	for _, n := range possiblePackageVariants(name) {
-		vs, err := dc.getPackageVersions(ctx, n)
+		vs, err := dm.remotePackageVersions(ctx, n)
 		if err != nil {
 			if err == os.ErrNotExist {
 				continue
@@ -349,9 +678,12 @@ func (dm *Manager) FindPackageFromModuleName(ctx context.Context, module string)
 		return "", nil, err
 	}
 	if err == os.ErrNotExist {
-		name, vs, err = dm.dependencyClient.findPackageFromModuleName(ctx, module)
+		name, vs, err = dm.findRemotePackageFromModuleName(ctx, module)
 	}
 	if err == os.ErrNotExist {
+		if dm.offline {
+			return "", nil, errors.Errorf("can't find package for module %q in the local dependency cache, bramble is offline", module)
+		}
 		return "", nil, errors.Errorf("can't find package for module %q", module)
 	}
 	return name, vs, err
@@ -363,9 +695,6 @@ func (dc *dependencyClient) getPackageSource(ctx context.Context, pkg types.Pack
 		"/package/source/"+pkg.String(),
 		"",
 		nil, &body); err != nil {
-		if err == os.ErrNotExist {
-			err = errors.Errorf("request to server could not find package %s", pkg)
-		}
 		return nil, err
 	}
 	return body, nil
@@ -379,9 +708,6 @@ func (dc *dependencyClient) getPackageConfig(ctx context.Context, pkg types.Pack
 		"/package/config/"+pkg.String(),
 		"",
 		nil, w); err != nil {
-		if err == os.ErrNotExist {
-			err = errors.Errorf("request to server could not find package %s", pkg)
-		}
 		return cfg, err
 	}
 	return config.ParseConfig(&buf)
@@ -428,35 +754,66 @@ func addDependencyMetadata(dependencyDir, pkg, version, src string, mapping map[
 	return nil
 }
 
-func serverHandler(dependencyDir string, newBuilder types.NewBuilder, downloadGithubRepo func(url string, reference string) (location string, err error)) http.Handler {
+func serverHandler(dependencyDir string, newBuilder types.NewBuilder, fetchSource types.FetchSource, opts ServerOptions) (http.Handler, error) {
 	dependencyDirectory := dir(dependencyDir)
 
+	jq, err := newJobQueue(
+		filepath.Join(dependencyDir, "jobs"),
+		maxConcurrentJobs,
+		func(job *Job, logs io.Writer) error {
+			_, err := buildJob(job, dependencyDir, newBuilder, fetchSource, logs)
+			return err
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading jobs")
+	}
+
 	router := httpx.New()
 	router.GET("/job/:id", func(c httpx.Context) error {
-		job := jq.Lookup(c.Params.ByName("id"))
+		job, err := jq.Lookup(c.Params.ByName("id"))
+		if err != nil {
+			return err
+		}
 		if job == nil {
-			return httpx.ErrNotFound(errors.New("no job found with that id"))
+			return httpx.ErrNotFound(errJobNotFound)
 		}
 		return json.NewEncoder(c.ResponseWriter).Encode(job)
 	})
+	router.GET("/job/:id/logs", func(c httpx.Context) error {
+		follow := c.Request.URL.Query().Get("follow") == "true"
+		c.ResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err := jq.Logs(c.Params.ByName("id"), c.ResponseWriter, follow, c.Request.Context().Done())
+		if err == errJobNotFound {
+			return httpx.ErrNotFound(err)
+		}
+		return err
+	})
 	router.POST("/job", func(c httpx.Context) error {
 		jobRequest := JobRequest{}
 		if err := json.NewDecoder(c.Request.Body).Decode(&jobRequest); err != nil {
 			return httpx.ErrUnprocessableEntity(err)
 		}
+		if jobRequest.Package == "" {
+			return httpx.ErrUnprocessableEntity(errors.New("a package name is required"))
+		}
 		job := &Job{
 			Package:   jobRequest.Package,
+			Source:    jobRequest.Source,
 			Reference: jobRequest.Reference,
 		}
-		jq.AddJob(job)
+		// Don't let clients publish files from the server or make it fetch
+		// from hosts it shouldn't reach
+		if err := opts.checkSource(jobSource(job)); err != nil {
+			return httpx.ErrUnprocessableEntity(err)
+		}
+		if err := jq.AddJob(job); err != nil {
+			if err == errJobQueueFull {
+				return httpx.ErrServiceUnavailable(err)
+			}
+			return err
+		}
 		fmt.Fprint(c.ResponseWriter, job.ID)
-
-		// Run job
-		go func() {
-			_, err := buildJob(job, dependencyDir, newBuilder, downloadGithubRepo)
-			jq.End(job.ID, err)
-		}()
-
 		return nil
 	})
 	// router.GET("/package/outputs/:platform/:name/:version", func(c httpx.Context) error {
@@ -509,27 +866,47 @@ func serverHandler(dependencyDir string, newBuilder types.NewBuilder, downloadGi
 		return nil
 	})
 
-	return router
+	return router, nil
 }
 
-func buildJob(job *Job, dependencyDir string, newBuilder types.NewBuilder, downloadGithubRepo func(url string, reference string) (location string, err error)) (builtDerivations []string, err error) {
-	loc, err := downloadGithubRepo(job.Package, job.Reference)
+// jobSource returns the url that the source of a job is fetched from
+func jobSource(job *Job) string {
+	if job.Source == "" {
+		return "https://" + job.Package + ".git"
+	}
+	return job.Source
+}
+
+func buildJob(job *Job, dependencyDir string, newBuilder types.NewBuilder, fetchSource types.FetchSource, logs io.Writer) (builtDerivations []string, err error) {
+	source := jobSource(job)
+	fmt.Fprintf(logs, "Fetching %s %s\n", source, job.Reference)
+	loc, err := fetchSource(source, job.Reference)
 	if err != nil {
-		return nil, errors.Wrap(err, "error downloading git repo")
+		return nil, errors.Wrap(err, "error fetching package source")
 	}
+	defer os.RemoveAll(loc)
 	builder, err := newBuilder(loc)
 	if err != nil {
 		return
 	}
 	packages := builder.Packages()
+	name := job.Package
+	if name == "" {
+		// Use the name of the package at the root of the source
+		root, found := packages[loc]
+		if !found {
+			return nil, errors.Errorf("no package name was given and there's no bramble.toml at the root of %s", source)
+		}
+		name = root.Name
+	}
 	for path, pkg := range packages {
 		rel, err := filepath.Rel(loc, path)
 		if err != nil {
 			panic(loc + " - " + path)
 		}
-		expectedPackageName := strings.TrimSuffix(job.Package+"/"+strings.Trim(strings.TrimPrefix(rel, "."), "/"), "/")
+		expectedPackageName := strings.TrimSuffix(name+"/"+strings.Trim(strings.TrimPrefix(rel, "."), "/"), "/")
 		if expectedPackageName != pkg.Name {
-			return nil, errors.Errorf("package name %q does not match the location the project was fetched from: %q",
+			return nil, errors.Errorf("package name %q does not match the name it's being published as: %q",
 				pkg.Name,
 				expectedPackageName)
 		}
@@ -537,8 +914,8 @@ func buildJob(job *Job, dependencyDir string, newBuilder types.NewBuilder, downl
 	toRun := []func() error{}
 	// Build each package in the repository
 	for path, pkg := range packages {
-		fmt.Println("Building package", path, pkg)
-		resp, err := builder.Build(context.Background(), path, []string{"./..."}, types.BuildOptions{Check: true})
+		fmt.Fprintln(logs, "Building package", pkg)
+		resp, err := builder.Build(context.Background(), path, []string{"./..."}, types.BuildOptions{Check: true, Logs: logs})
 		if err != nil {
 			return nil, err
 		}
@@ -566,38 +943,76 @@ func buildJob(job *Job, dependencyDir string, newBuilder types.NewBuilder, downl
 	return builtDerivations, nil
 }
 
-func ServerHandler(dependencyDir string, newBuilder types.NewBuilder, dgr types.DownloadGithubRepo) http.Handler {
-	return serverHandler(dependencyDir, newBuilder, dgr)
+// ServerOptions limit where the package server fetches package sources from.
+type ServerOptions struct {
+	// SourceHosts are the hosts that sources can be fetched from. Sources can
+	// be fetched from any host if it's empty.
+	SourceHosts []string
+	// AllowGitTransports allows sources with the ssh and git schemes, only
+	// http and https sources are allowed otherwise.
+	AllowGitTransports bool
 }
 
-func Builder(dependencyDir string, newBuilder types.NewBuilder, dgr types.DownloadGithubRepo) func(*Job) ([]string, error) {
+// checkSource returns an error if a source can't be fetched by the server.
+func (opts ServerOptions) checkSource(source string) error {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return errors.Errorf("source %q is not a remote url", source)
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "ssh", "git":
+		if !opts.AllowGitTransports {
+			return errors.Errorf("source %q can't be fetched, this server only fetches http and https sources", source)
+		}
+	default:
+		return errors.Errorf("source %q is not a remote url", source)
+	}
+	if len(opts.SourceHosts) == 0 {
+		return nil
+	}
+	for _, host := range opts.SourceHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return nil
+		}
+	}
+	return errors.Errorf("source %q can't be fetched, this server only fetches sources from %s",
+		source, strings.Join(opts.SourceHosts, ", "))
+}
+
+// ServerHandler returns the handler for the package server. Jobs are stored in
+// dependencyDir and run a few at a time.
+func ServerHandler(dependencyDir string, newBuilder types.NewBuilder, fetchSource types.FetchSource, opts ServerOptions) (http.Handler, error) {
+	return serverHandler(dependencyDir, newBuilder, fetchSource, opts)
+}
+
+// Builder returns a function that runs jobs locally, build logs are written to
+// stdout.
+func Builder(dependencyDir string, newBuilder types.NewBuilder, fetchSource types.FetchSource) func(*Job) ([]string, error) {
 	return func(job *Job) ([]string, error) {
-		return buildJob(job, dependencyDir, newBuilder, dgr)
+		return buildJob(job, dependencyDir, newBuilder, fetchSource, os.Stdout)
 	}
 }
 
-func DownloadGithubRepo(url string, reference string) (location string, err error) {
-	url = "https://" + url + ".git"
-	location, err = os.MkdirTemp("", "")
+// FetchSource fetches a package source into a new temporary directory. Local
+// directories are copied, unless a reference is passed in which case they
+// must be git repositories. Everything else is fetched with git. Only the
+// files in the tree of the reference, or HEAD, are fetched.
+func FetchSource(source string, reference string) (location string, err error) {
+	location, err = os.MkdirTemp("", "bramble-source-")
 	if err != nil {
 		return
 	}
-
-	// TODO: replace all this with calls to bramble
-	script := fmt.Sprintf(`
-	set -ex
-	git clone %s %s
-	cd %s`, url, location, location)
-	if reference != "" {
-		script += fmt.Sprintf("\ngit checkout %s", reference)
-	}
-	// script += "\nrm -rf ./.git"
-	cmd := exec.Command("bash", "-c", script)
-	var buf bytes.Buffer
-	cmd.Stderr = io.MultiWriter(os.Stderr, &buf)
-	cmd.Stdout = os.Stdout
-	if err := cmd.Run(); err != nil {
-		return "", errors.Wrap(err, buf.String())
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(location)
+		}
+	}()
+	if !strings.Contains(source, "://") && fileutil.DirExists(source) && reference == "" {
+		if err = fileutil.CopyDirectory(source, location); err != nil {
+			return "", err
+		}
+		return location, os.RemoveAll(filepath.Join(location, ".git"))
 	}
-	return
+	return location, checkoutGitSource(source, reference, location)
 }
@@ -3,6 +3,7 @@ package dependency
 import (
 	"context"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
@@ -11,11 +12,15 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/maxmcd/bramble/internal/config"
 	"github.com/maxmcd/bramble/internal/types"
 	"github.com/maxmcd/bramble/pkg/fxt"
 	"github.com/maxmcd/bramble/v/cmd/go/mvs"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/mod/semver"
@@ -143,6 +148,99 @@ func TestDMReqsUpgrade(t *testing.T) {
 	})
 }
 
+func TestDMUpgradeConfigBuildlist(t *testing.T) {
+	cfg, dm := blogScenario(t)
+	cfg, err := dm.CalculateConfigBuildlist(cfg)
+	require.NoError(t, err)
+
+	upgraded, err := dm.UpgradeConfigBuildlist(cfg, "C")
+	require.NoError(t, err)
+	require.Equal(t, "1.3.0", upgraded.Dependencies["C"].Version)
+	require.Equal(t, "1.1.0", upgraded.Dependencies["F"].Version)
+	require.Equal(t, "1.2.0", upgraded.Dependencies["E"].Version, "E is only upgraded when all dependencies are")
+
+	// https://research.swtch.com/vgo-mvs#upgrade_all
+	upgraded, err = dm.UpgradeConfigBuildlist(cfg)
+	require.NoError(t, err)
+	require.Equal(t, map[string]config.Dependency{
+		"B": {Version: "1.2.0"},
+		"C": {Version: "1.3.0"},
+		"D": {Version: "1.4.0"},
+		"E": {Version: "1.3.0"},
+		"F": {Version: "1.1.0"},
+		"G": {Version: "1.1.0"},
+	}, upgraded.Dependencies)
+
+	_, err = dm.UpgradeConfigBuildlist(cfg, "nope")
+	require.Error(t, err)
+}
+
+func TestDMDowngradeConfigBuildlist(t *testing.T) {
+	cfg, dm := blogScenario(t)
+
+	// https://research.swtch.com/vgo-mvs#downgrade
+	downgraded, err := dm.DowngradeConfigBuildlist(cfg, types.Package{Name: "D", Version: "1.2.0"})
+	require.Error(t, err, "D isn't a direct dependency yet")
+	cfg, err = dm.CalculateConfigBuildlist(cfg)
+	require.NoError(t, err)
+	downgraded, err = dm.DowngradeConfigBuildlist(cfg, types.Package{Name: "D", Version: "1.2.0"})
+	require.NoError(t, err)
+	require.Equal(t, "1.1.0", downgraded.Dependencies["B"].Version)
+	require.Equal(t, "1.1.0", downgraded.Dependencies["C"].Version)
+	require.Equal(t, "1.2.0", downgraded.Dependencies["D"].Version)
+
+	_, err = dm.DowngradeConfigBuildlist(cfg, types.Package{Name: "D", Version: "2.0.0"})
+	require.Error(t, err)
+	_, err = dm.DowngradeConfigBuildlist(cfg, types.Package{Name: "B", Version: "1.3.0"})
+	require.Error(t, err)
+}
+
+func TestDMTidyConfigBuildlist(t *testing.T) {
+	cfg, dm := blogScenario(t)
+	cfg, err := dm.UpgradeConfigBuildlist(cfg)
+	require.NoError(t, err)
+
+	tidy, err := dm.TidyConfigBuildlist(cfg, []string{"B"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]config.Dependency{
+		"B": {Version: "1.2.0"},
+		"D": {Version: "1.4.0"},
+		"E": {Version: "1.3.0"},
+	}, tidy.Dependencies, "unused dependencies are removed without downgrading the others")
+
+	_, err = dm.TidyConfigBuildlist(cfg, []string{"nope"})
+	require.Error(t, err)
+
+	pkg, err := dm.FindNewestPackage(context.Background(), "C/lib")
+	require.NoError(t, err)
+	require.Equal(t, types.Package{Name: "C", Version: "1.3.0"}, pkg)
+}
+
+func TestDMRequirementGraph(t *testing.T) {
+	cfg, dm := blogScenario(t)
+	graph, err := dm.RequirementGraph(cfg)
+	require.NoError(t, err)
+	p := func(s string) types.Package {
+		parts := strings.Split(s, "@")
+		return types.Package{Name: parts[0], Version: parts[1]}
+	}
+	require.Equal(t, []Requirement{
+		{p("A@1.1.0"), p("B@1.2.0")},
+		{p("A@1.1.0"), p("C@1.2.0")},
+		{p("B@1.2.0"), p("D@1.3.0")},
+		{p("C@1.2.0"), p("D@1.4.0")},
+		{p("D@1.3.0"), p("E@1.2.0")},
+		{p("D@1.4.0"), p("E@1.2.0")},
+	}, graph)
+
+	root := p("A@1.1.0")
+	require.Equal(t,
+		[]types.Package{root, p("B@1.2.0"), p("D@1.3.0"), p("E@1.2.0")},
+		RequirementChain(graph, root, "E"))
+	require.Equal(t, []types.Package{root, p("C@1.2.0")}, RequirementChain(graph, root, "C"))
+	require.Nil(t, RequirementChain(graph, root, "F"))
+}
+
 func (dm *Manager) deleteHalfDeps(t *testing.T) {
 	list, err := filepath.Glob(dm.dir.join("src", "*"))
 	if err != nil {
@@ -157,6 +255,14 @@ func (dm *Manager) deleteHalfDeps(t *testing.T) {
 	}
 }
 
+func testServer(t *testing.T, dependencyDir string, newBuilder types.NewBuilder, fetchSource types.FetchSource) *httptest.Server {
+	handler, err := serverHandler(dependencyDir, newBuilder, fetchSource, ServerOptions{})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
 func TestDMReqsRemote(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		t.Run(fmt.Sprint(i), func(t *testing.T) {
@@ -169,12 +275,9 @@ func TestDMReqsRemote(t *testing.T) {
 			// partially present subset
 			localDM.deleteHalfDeps(t)
 
-			server := httptest.NewServer(ServerHandler(string(remoteDM.dir), nil, nil))
+			server := testServer(t, string(remoteDM.dir), nil, nil)
 
-			localDM.dependencyClient = &dependencyClient{
-				client: &http.Client{},
-				host:   server.URL,
-			}
+			localDM.registries = []config.Registry{{URL: server.URL}}
 
 			vs, err := mvs.BuildList(mvs.Version{Name: "A@1", Version: "1.0"}, localDM.reqs(cfg))
 			if err != nil {
@@ -197,14 +300,11 @@ func TestDMPathOrDownload(t *testing.T) {
 	remoteCFG, remoteDM := blogScenario(t)
 	_, localDM := testDepMgr(t) // no deps
 
-	server := httptest.NewServer(ServerHandler(string(remoteDM.dir), nil, nil))
+	server := testServer(t, string(remoteDM.dir), nil, nil)
 
-	localDM.dependencyClient = &dependencyClient{
-		client: &http.Client{},
-		host:   server.URL,
-	}
+	localDM.registries = []config.Registry{{URL: server.URL}}
 
-	path, err := localDM.PackagePathOrDownload(context.Background(), types.Package{"A", "1.1.0"})
+	path, _, err := localDM.PackagePathOrDownload(context.Background(), types.Package{"A", "1.1.0"}, "")
 	if err != nil {
 		fxt.Printpvln(err)
 		t.Fatal(err)
@@ -219,6 +319,25 @@ func TestDMPathOrDownload(t *testing.T) {
 	require.Equal(t, cfg, remoteCFG)
 }
 
+func TestDMPathOrDownload_verify(t *testing.T) {
+	_, dm := blogScenario(t)
+	a := types.Package{Name: "A", Version: "1.1.0"}
+	path, hash, err := dm.PackagePathOrDownload(context.Background(), a, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, hash)
+
+	_, _, err = dm.PackagePathOrDownload(context.Background(), a, hash)
+	require.NoError(t, err)
+	_, _, err = dm.PackagePathOrDownload(context.Background(), a, "nope")
+	require.Error(t, err)
+
+	// A modified local copy doesn't match the lockfile
+	require.NoError(t, os.WriteFile(filepath.Join(path, "default.bramble"), []byte("# changed"), 0644))
+	_, _, err = (&Manager{dir: dm.dir}).PackagePathOrDownload(context.Background(), a, hash)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bramble.lock expects")
+}
+
 func TestVersion_mvsVersionFromPackage(t *testing.T) {
 	tests := []struct {
 		name string
@@ -339,11 +458,9 @@ func TestPushJob(t *testing.T) {
 		},
 	}
 
-	server := httptest.NewServer(
-		serverHandler(t.TempDir(), tb.NewBuilder, tb.testGithubDownloader),
-	)
+	server := testServer(t, t.TempDir(), tb.NewBuilder, tb.testGithubDownloader)
 
-	if err := PostJob(context.Background(), server.URL, "x.y/z", ""); err != nil {
+	if err := PostJob(context.Background(), server.URL, "x.y/z", "", "", ""); err != nil {
 		t.Fatal(err)
 	}
 	dc := &dependencyClient{
@@ -368,3 +485,177 @@ func TestPushJob(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildJob_sources(t *testing.T) {
+	tb := testBuilder{
+		t: t,
+		packages: map[string]types.Package{
+			"":    {Name: "x.y/z", Version: "2.0.0"},
+			"./a": {Name: "x.y/z/a", Version: "1.2.0"},
+		},
+	}
+	src, err := tb.testGithubDownloader("", "")
+	require.NoError(t, err)
+	publish := func(job *Job) (dependencyDir string, err error) {
+		dependencyDir = t.TempDir()
+		_, err = buildJob(job, dependencyDir, tb.NewBuilder, FetchSource, io.Discard)
+		return dependencyDir, err
+	}
+	published := func(dependencyDir string) {
+		for _, pkg := range tb.packages {
+			require.FileExists(t, filepath.Join(dependencyDir, "src", pkg.String(), "bramble.toml"))
+		}
+		require.NoDirExists(t, filepath.Join(dependencyDir, "src", "x.y/z@2.0.0", ".git"))
+	}
+
+	// A local directory, the name is taken from its bramble.toml if it's not
+	// passed
+	dependencyDir, err := publish(&Job{Source: src})
+	require.NoError(t, err)
+	published(dependencyDir)
+	_, err = publish(&Job{Package: "x.y/other", Source: src})
+	require.Error(t, err)
+
+	repo, err := git.PlainInit(src, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, wt.AddGlob("."))
+	commit, err := wt.Commit("init", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	require.NoError(t, err)
+	_, err = repo.CreateTag("v2.0.0", commit, nil)
+	require.NoError(t, err)
+	// The .git directory of a repository has the same layout as a bare
+	// repository
+	bare := filepath.Join(src, ".git")
+
+	// A bare repository, published with a name that doesn't match its url
+	dependencyDir, err = publish(&Job{Package: "x.y/z", Source: "file://" + bare, Reference: "v2.0.0"})
+	require.NoError(t, err)
+	published(dependencyDir)
+	_, err = publish(&Job{Package: "x.y/z", Source: "file://" + bare, Reference: "v9.9.9"})
+	require.Error(t, err)
+
+	// Package servers don't publish local files
+	server := testServer(t, t.TempDir(), tb.NewBuilder, FetchSource)
+	require.Error(t, PostJob(context.Background(), server.URL, "x.y/z", "file://"+bare, "", ""))
+	require.Error(t, PostJob(context.Background(), server.URL, "x.y/z", src, "", ""))
+
+	// Sources are checked against the hosts that the server fetches from
+	// before they're fetched
+	fetched := false
+	handler, err := serverHandler(t.TempDir(), tb.NewBuilder, func(source, reference string) (string, error) {
+		fetched = true
+		return "", errors.New("not fetched")
+	}, ServerOptions{SourceHosts: []string{"github.com"}})
+	require.NoError(t, err)
+	allowlisted := httptest.NewServer(handler)
+	defer allowlisted.Close()
+	require.Error(t, PostJob(context.Background(), allowlisted.URL, "x.y/z", "", "", ""))
+	require.Error(t, PostJob(context.Background(), allowlisted.URL, "x.y/z", "http://127.0.0.1/z.git", "", ""))
+	require.False(t, fetched)
+}
+
+func TestServerOptions_checkSource(t *testing.T) {
+	github := ServerOptions{SourceHosts: []string{"github.com"}}
+	for _, tt := range []struct {
+		opts   ServerOptions
+		source string
+		ok     bool
+	}{
+		{ServerOptions{}, "https://example.com/a.git", true},
+		{ServerOptions{}, "http://example.com/a.git", true},
+		{ServerOptions{}, "ssh://git@example.com/a.git", false},
+		{ServerOptions{}, "git://example.com/a.git", false},
+		{ServerOptions{AllowGitTransports: true}, "ssh://git@example.com/a.git", true},
+		{ServerOptions{AllowGitTransports: true}, "git://example.com/a.git", true},
+		{ServerOptions{}, "file:///tmp/a", false},
+		{ServerOptions{}, "/tmp/a", false},
+		{github, "https://github.com/maxmcd/bramble.git", true},
+		{github, "https://GitHub.com:443/maxmcd/bramble.git", true},
+		{github, "https://169.254.169.254/latest/meta-data", false},
+		{github, "https://github.com.example.com/a.git", false},
+	} {
+		t.Run(tt.source, func(t *testing.T) {
+			err := tt.opts.checkSource(tt.source)
+			if tt.ok {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestDMOffline(t *testing.T) {
+	_, remoteDM := blogScenario(t)
+	server := testServer(t, string(remoteDM.dir), nil, nil)
+	dependencyDir := t.TempDir()
+	ctx := context.Background()
+	b := types.Package{Name: "B", Version: "1.2.0"}
+
+	offlineDM := NewManager(dependencyDir, []config.Registry{{URL: server.URL}}, true)
+	_, err := offlineDM.remotePackageConfig(ctx, b)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "offline")
+	_, _, err = offlineDM.FindPackageFromModuleName(ctx, "B/lib")
+	require.Error(t, err)
+
+	// Fetching metadata online caches it
+	onlineDM := NewManager(dependencyDir, []config.Registry{{URL: server.URL}}, false)
+	deps, err := onlineDM.remotePackageDependencies(ctx, b)
+	require.NoError(t, err)
+	require.Equal(t, []types.Package{{Name: "D", Version: "1.3.0"}}, deps)
+	name, vs, err := onlineDM.FindPackageFromModuleName(ctx, "B/lib")
+	require.NoError(t, err)
+	require.Equal(t, "B", name)
+	require.Equal(t, []string{"1.1.0", "1.2.0"}, vs)
+
+	server.Close()
+	// Expired version lists are still used offline
+	old := time.Now().Add(-2 * versionsCacheExpiry)
+	require.NoError(t, os.Chtimes(offlineDM.dir.cachedVersionsLocation("B"), old, old))
+	deps, err = offlineDM.remotePackageDependencies(ctx, b)
+	require.NoError(t, err)
+	require.Equal(t, []types.Package{{Name: "D", Version: "1.3.0"}}, deps)
+	versions, err := offlineDM.packageVersions(ctx, "B")
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.1.0", "1.2.0"}, versions)
+
+	_, _, err = offlineDM.PackagePathOrDownload(ctx, b, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "offline")
+}
+
+func TestDMRegistries(t *testing.T) {
+	_, remoteDM := blogScenario(t)
+	server := testServer(t, string(remoteDM.dir), nil, nil)
+	empty := testServer(t, t.TempDir(), nil, nil)
+	ctx := context.Background()
+
+	dm := NewManager(t.TempDir(), []config.Registry{
+		{URL: empty.URL},
+		{URL: "http://127.0.0.1:1"}, // unreachable
+		{URL: server.URL},
+	}, false)
+	vs, err := dm.packageVersions(ctx, "B")
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.1.0", "1.2.0"}, vs, "lookups fall through to the registry with the package")
+	_, err = dm.remotePackageConfig(ctx, types.Package{Name: "B", Version: "1.2.0"})
+	require.NoError(t, err)
+
+	_, err = dm.remotePackageConfig(ctx, types.Package{Name: "nope", Version: "1.0.0"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "127.0.0.1:1", "registry errors are returned if no registry has the package")
+
+	// Packages that match a prefix are only fetched from matching registries
+	dm = NewManager(t.TempDir(), []config.Registry{
+		{URL: empty.URL, Prefix: "B"},
+		{URL: server.URL},
+	}, false)
+	vs, err = dm.packageVersions(ctx, "B")
+	require.NoError(t, err)
+	require.Empty(t, vs)
+}
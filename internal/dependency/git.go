@@ -0,0 +1,98 @@
+package dependency
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/pkg/errors"
+)
+
+// openGitRepository opens the git repository at source. Repositories on the
+// local filesystem, as paths or file:// urls, are opened in place and
+// everything else is cloned into memory.
+func openGitRepository(source string) (repo *git.Repository, cloned bool, err error) {
+	if path := strings.TrimPrefix(source, "file://"); !strings.Contains(path, "://") {
+		repo, err = git.PlainOpen(path)
+		return repo, false, errors.Wrapf(err, "error opening git repository %s", source)
+	}
+	repo, err = git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
+		URL:  source,
+		Tags: git.AllTags,
+	})
+	return repo, true, errors.Wrapf(err, "error cloning %s", source)
+}
+
+// checkoutGitSource writes the files in the tree of reference, or HEAD if the
+// reference is empty, in the git repository at source to location. Branches
+// of cloned repositories can be referenced by their name.
+func checkoutGitSource(source, reference, location string) (err error) {
+	repo, cloned, err := openGitRepository(source)
+	if err != nil {
+		return err
+	}
+	if reference == "" {
+		reference = "HEAD"
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(reference))
+	if err != nil && cloned {
+		// Only the default branch is a local branch in a clone
+		hash, err = repo.ResolveRevision(plumbing.Revision("refs/remotes/origin/" + reference))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error finding reference %q in %s", reference, source)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	return tree.Files().ForEach(func(f *object.File) error {
+		path := filepath.Join(location, filepath.FromSlash(f.Name))
+		if err := fileutil.PathWithinDir(location, path); err != nil {
+			return err
+		}
+		return writeGitFile(f, path)
+	})
+}
+
+func writeGitFile(f *object.File, path string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if f.Mode == filemode.Symlink {
+		target, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, path)
+	}
+	mode, err := f.Mode.ToOSFileMode()
+	if err != nil {
+		return err
+	}
+	r, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
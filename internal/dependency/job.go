@@ -1,91 +1,340 @@
 package dependency
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/pkg/errors"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
 )
 
 type Job struct {
-	ID           string
+	ID     string
+	Status JobStatus
+	// Queued is when the job was received, Start and End are when it started
+	// and finished running.
+	Queued       time.Time
 	Start        time.Time
 	End          time.Time
 	Error        string
 	ErrWithStack string
 	Package      string
+	Source       string
 	Reference    string
 }
 
 type JobRequest struct {
-	// The location of the version control repository.
+	// The name of the package. If Source is empty the package is fetched from
+	// the git repository at https://<Package>.git.
 	Package string
+	// Source is the git url that the package is fetched from, the package is
+	// published with the name in Package regardless of where it's fetched
+	// from. Package servers only accept remote urls.
+	Source string
 	// Reference is a version control reference. With Git this could be a
 	// branch, tag, or commit. This value is optional.
 	Reference string
 }
 
+var (
+	errJobQueueFull = errors.New("too many jobs are queued, try again later")
+	errJobNotFound  = errors.New("no job found with that id")
+)
+
+const (
+	// maxConcurrentJobs is the number of jobs that are run at once
+	maxConcurrentJobs = 2
+	// maxQueuedJobs is the number of jobs that can wait to be run, new jobs
+	// are rejected once it's reached
+	maxQueuedJobs = 1000
+	// maxFinishedJobs is the number of finished jobs that are kept, the
+	// oldest are removed along with their logs
+	maxFinishedJobs = 100
+)
+
+// jobQueue runs jobs with a fixed number of workers. Jobs and their logs are
+// written to dir so that they are available after a restart.
 type jobQueue struct {
-	jobs map[string]*Job
-	lock sync.Mutex
+	dir   string
+	run   func(job *Job, logs io.Writer) error
+	queue chan *Job
+	lock  sync.Mutex
+
+	maxQueued   int
+	maxFinished int
+}
+
+// newJobQueue loads the jobs in dir and starts workers that call run for
+// every job. Queued jobs are run again, even if there are more than
+// maxQueuedJobs of them, running jobs were interrupted by a restart and are
+// marked as failed.
+func newJobQueue(dir string, workers int, run func(job *Job, logs io.Writer) error) (jq *jobQueue, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	jobs, err := (&jobQueue{dir: dir}).list()
+	if err != nil {
+		return nil, err
+	}
+	var queued []*Job
+	for _, job := range jobs {
+		if job.Status == JobQueued {
+			queued = append(queued, job)
+		}
+	}
+	size := maxQueuedJobs
+	if len(queued) > size {
+		size = len(queued)
+	}
+	jq = &jobQueue{
+		dir:         dir,
+		run:         run,
+		queue:       make(chan *Job, size),
+		maxQueued:   maxQueuedJobs,
+		maxFinished: maxFinishedJobs,
+	}
+	for _, job := range jobs {
+		if job.Status == JobRunning {
+			job.End = time.Now()
+			job.Status = JobFailed
+			job.Error = "the server was restarted before the job finished"
+			job.ErrWithStack = job.Error
+			if err := jq.write(job); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, job := range queued {
+		jq.queue <- job
+	}
+	if err := jq.prune(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < workers; i++ {
+		go jq.worker()
+	}
+	return jq, nil
+}
+
+func (jq *jobQueue) worker() {
+	for job := range jq.queue {
+		jq.runJob(job)
+	}
+}
+
+func (jq *jobQueue) runJob(job *Job) {
+	logs, err := os.OpenFile(jq.logPath(job.ID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		job.Status = JobRunning
+		job.Start = time.Now()
+		err = jq.write(job)
+	}
+	if err == nil {
+		err = jq.run(job, logs)
+		if err != nil {
+			fmt.Fprintf(logs, "\nError: %+v\n", err)
+		}
+	}
+	if logs != nil {
+		_ = logs.Close()
+	}
+	jq.end(job, err)
+}
+
+func (jq *jobQueue) end(job *Job, err error) {
+	job.Status = JobSucceeded
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+		job.ErrWithStack = fmt.Sprintf("%+v", err)
+	}
+	job.End = time.Now()
+	if err := jq.write(job); err != nil {
+		fmt.Printf("error writing job %s: %v\n", job.ID, err)
+	}
+	if err := jq.prune(); err != nil {
+		fmt.Printf("error removing old jobs: %v\n", err)
+	}
 }
 
-func (jq *jobQueue) AddJob(job *Job) {
+// prune removes the oldest finished jobs, and their logs, once there are more
+// than maxFinished of them.
+func (jq *jobQueue) prune() (err error) {
 	jq.lock.Lock()
 	defer jq.lock.Unlock()
+	jobs, err := jq.list()
+	if err != nil {
+		return err
+	}
+	var finished []*Job
+	for _, job := range jobs {
+		if job.Status == JobSucceeded || job.Status == JobFailed {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= jq.maxFinished {
+		return nil
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].End.Before(finished[j].End) })
+	for _, job := range finished[:len(finished)-jq.maxFinished] {
+		if err := os.Remove(jq.logPath(job.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(jq.jobPath(job.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// AddJob assigns the job an ID and queues it to be run. If maxQueued jobs are
+// already waiting the job is rejected with errJobQueueFull.
+func (jq *jobQueue) AddJob(job *Job) (err error) {
+	jq.lock.Lock()
+	defer jq.lock.Unlock()
+	if len(jq.queue) >= jq.maxQueued {
+		return errJobQueueFull
+	}
 	for {
 		// unique id
 		job.ID = fmt.Sprint(rand.Int())
-		if _, found := jq.jobs[job.ID]; !found {
+		if !fileutil.FileExists(jq.jobPath(job.ID)) {
 			break
 		}
 	}
-	job.Start = time.Now()
-	// Remove stale jobs from in-memory
-	if len(jq.jobs) > 100 {
-		jq.kickOldest()
+	job.Status = JobQueued
+	job.Queued = time.Now()
+	if err := jq.writeLocked(job); err != nil {
+		return err
 	}
-	jq.jobs[job.ID] = job
+	// The queue has room for at least maxQueuedJobs, so this doesn't block
+	jq.queue <- job
+	return nil
 }
 
-func (jq *jobQueue) End(id string, err error) {
+// Lookup returns a copy of the job with the id, or nil if it doesn't exist.
+func (jq *jobQueue) Lookup(id string) (*Job, error) {
 	jq.lock.Lock()
 	defer jq.lock.Unlock()
-	job := jq.jobs[id]
+	b, err := ioutil.ReadFile(jq.jobPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
-		job.Error = err.Error()
-		job.ErrWithStack = fmt.Sprintf("%+v", err)
+		return nil, err
 	}
-	job.End = time.Now()
+	var job Job
+	return &job, json.Unmarshal(b, &job)
 }
 
-func (jq *jobQueue) Lookup(id string) *Job {
-	jq.lock.Lock()
-	defer jq.lock.Unlock()
-	job := jq.jobs[id]
-	if job != nil {
-		// make copy, a read only record
-		v := *job
-		return &v
+// Logs writes the logs of a job to w. If follow is true Logs keeps writing
+// new logs until the job ends or done is closed.
+func (jq *jobQueue) Logs(id string, w io.Writer, follow bool, done <-chan struct{}) (err error) {
+	job, err := jq.Lookup(id)
+	if err != nil {
+		return err
 	}
-	return nil
+	if job == nil {
+		return errJobNotFound
+	}
+	var offset int64
+	for {
+		// Look up the job before reading so that we don't miss logs that
+		// are written before the job ends
+		job, err := jq.Lookup(id)
+		if err != nil {
+			return err
+		}
+		n, err := copyLogs(jq.logPath(id), offset, w)
+		if err != nil {
+			return err
+		}
+		offset += n
+		if f, ok := w.(interface{ Flush() }); ok && n > 0 {
+			f.Flush()
+		}
+		if !follow || !job.End.IsZero() {
+			return nil
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func copyLogs(path string, offset int64, w io.Writer) (n int64, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// The job hasn't started
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, f)
 }
 
-func (jq *jobQueue) kickOldest() {
-	oldest := time.Now()
-	id := ""
-	for i, j := range jq.jobs {
-		if j.End.IsZero() {
-			// Skip running jobs
-			continue
+func (jq *jobQueue) list() (jobs []*Job, err error) {
+	matches, err := filepath.Glob(filepath.Join(jq.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		b, err := ioutil.ReadFile(match)
+		if err != nil {
+			return nil, err
 		}
-		if j.Start.Before(oldest) {
-			oldest = j.Start
-			id = i
+		var job Job
+		if err := json.Unmarshal(b, &job); err != nil {
+			return nil, errors.Wrapf(err, "error reading job %q", match)
 		}
+		jobs = append(jobs, &job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Queued.Before(jobs[j].Queued) })
+	return jobs, nil
+}
+
+func (jq *jobQueue) write(job *Job) (err error) {
+	jq.lock.Lock()
+	defer jq.lock.Unlock()
+	return jq.writeLocked(job)
+}
+
+func (jq *jobQueue) writeLocked(job *Job) (err error) {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	// Write and rename so that readers never see a partial file
+	tmp := jq.jobPath(job.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
 	}
-	delete(jq.jobs, id)
+	return os.Rename(tmp, jq.jobPath(job.ID))
 }
 
-var jq = &jobQueue{jobs: map[string]*Job{}}
+func (jq *jobQueue) jobPath(id string) string { return filepath.Join(jq.dir, id+".json") }
+func (jq *jobQueue) logPath(id string) string { return filepath.Join(jq.dir, id+".log") }
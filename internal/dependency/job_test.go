@@ -0,0 +1,152 @@
+package dependency
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobQueue(t *testing.T) {
+	dir := t.TempDir()
+	release := make(chan struct{})
+	jq, err := newJobQueue(dir, 1, func(job *Job, logs io.Writer) error {
+		fmt.Fprintln(logs, "building", job.Package)
+		<-release
+		fmt.Fprintln(logs, "done")
+		if job.Package == "fail" {
+			return errors.New("oh no")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	first, second := &Job{Package: "first"}, &Job{Package: "fail"}
+	require.NoError(t, jq.AddJob(first))
+	require.NoError(t, jq.AddJob(second))
+
+	// Following the logs blocks until the job ends
+	logs := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		_ = jq.Logs(first.ID, &buf, true, nil)
+		logs <- buf.String()
+	}()
+	waitForStatus(t, jq, first.ID, JobRunning)
+	job, err := jq.Lookup(second.ID)
+	require.NoError(t, err)
+	require.Equal(t, JobQueued, job.Status, "only one job runs at a time")
+
+	close(release)
+	require.Equal(t, "building first\ndone\n", <-logs)
+	waitForStatus(t, jq, first.ID, JobSucceeded)
+	job = waitForStatus(t, jq, second.ID, JobFailed)
+	require.Equal(t, "oh no", job.Error)
+	require.False(t, job.Start.IsZero())
+
+	var buf bytes.Buffer
+	require.NoError(t, jq.Logs(second.ID, &buf, false, nil))
+	require.Contains(t, buf.String(), "building fail\ndone\n\nError: oh no")
+	require.Equal(t, errJobNotFound, jq.Logs("nope", &buf, false, nil))
+	job, err = jq.Lookup("nope")
+	require.NoError(t, err)
+	require.Nil(t, job)
+}
+
+func TestJobQueue_restart(t *testing.T) {
+	dir := t.TempDir()
+	for _, job := range []Job{
+		{ID: "1", Status: JobRunning, Queued: time.Now()},
+		{ID: "2", Status: JobQueued, Queued: time.Now()},
+	} {
+		b, err := json.Marshal(job)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, job.ID+".json"), b, 0644))
+	}
+	jq, err := newJobQueue(dir, 1, func(job *Job, logs io.Writer) error { return nil })
+	require.NoError(t, err)
+
+	job := waitForStatus(t, jq, "1", JobFailed)
+	require.Contains(t, job.Error, "restarted")
+	waitForStatus(t, jq, "2", JobSucceeded)
+}
+
+func TestJobQueue_restartFullQueue(t *testing.T) {
+	dir := t.TempDir()
+	for _, id := range []string{"1", "2", "3"} {
+		b, err := json.Marshal(Job{ID: id, Status: JobQueued, Queued: time.Now()})
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, id+".json"), b, 0644))
+	}
+	release := make(chan struct{})
+	jq, err := newJobQueue(dir, 1, func(job *Job, logs io.Writer) error {
+		<-release
+		return nil
+	})
+	require.NoError(t, err, "every queued job is loaded")
+	jq.maxQueued = 1
+	require.Equal(t, errJobQueueFull, jq.AddJob(&Job{Package: "new"}))
+
+	close(release)
+	for _, id := range []string{"1", "2", "3"} {
+		waitForStatus(t, jq, id, JobSucceeded)
+	}
+	job := &Job{Package: "new"}
+	require.NoError(t, jq.AddJob(job))
+	waitForStatus(t, jq, job.ID, JobSucceeded)
+}
+
+func TestJobQueue_prune(t *testing.T) {
+	dir := t.TempDir()
+	jq, err := newJobQueue(dir, 1, func(job *Job, logs io.Writer) error {
+		fmt.Fprintln(logs, "building", job.Package)
+		return nil
+	})
+	require.NoError(t, err)
+	jq.maxFinished = 2
+
+	var jobs []*Job
+	for i := 0; i < 4; i++ {
+		job := &Job{Package: fmt.Sprint(i)}
+		require.NoError(t, jq.AddJob(job))
+		jobs = append(jobs, job)
+	}
+	for i := 0; i < 500; i++ {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		require.NoError(t, err)
+		if len(matches) == jq.maxFinished {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// The oldest jobs are removed along with their logs
+	for _, job := range jobs[:2] {
+		require.NoFileExists(t, filepath.Join(dir, job.ID+".json"))
+		require.NoFileExists(t, filepath.Join(dir, job.ID+".log"))
+	}
+	for _, job := range jobs[2:] {
+		waitForStatus(t, jq, job.ID, JobSucceeded)
+		require.FileExists(t, filepath.Join(dir, job.ID+".log"))
+	}
+}
+
+func waitForStatus(t *testing.T, jq *jobQueue, id string, status JobStatus) *Job {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		job, err := jq.Lookup(id)
+		require.NoError(t, err)
+		if job != nil && job.Status == status {
+			return job
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("job %s never reached status %s", id, status)
+	return nil
+}
@@ -0,0 +1,144 @@
+package project
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxmcd/bramble/internal/config"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StdLibModule is the module that contains the bramble standard library
+	StdLibModule = "github.com/maxmcd/bramble"
+
+	// StdLibVersion is the version of the standard library that new projects
+	// depend on
+	StdLibVersion = "0.0.3"
+
+	initialVersion = "0.0.1"
+
+	starterBramblefile = `load("github.com/maxmcd/bramble/lib/std")
+
+
+def hello():
+    return std.fetch_url("https://example.com")
+`
+)
+
+// InitProject creates a new bramble project in dir. A bramble.toml that
+// depends on the standard library, an empty bramble.lock and a starter
+// default.bramble file are created. If name is
+// empty the package name is inferred from the git remote of the directory, or
+// the directory name. InitProject will not create a project within an existing
+// project.
+func InitProject(dir string, name string) (p *Project, err error) {
+	if dir, err = filepath.Abs(dir); err != nil {
+		return nil, err
+	}
+	if found, location := findConfig(dir); found {
+		return nil, errors.Errorf("can't create a project, %q is already within the project at %q", dir, location)
+	}
+	if name == "" {
+		name = inferPackageName(dir)
+	}
+	cfg := config.Config{
+		Package: config.Package{
+			Name:    name,
+			Version: initialVersion,
+		},
+		Dependencies: map[string]config.Dependency{
+			StdLibModule: {Version: StdLibVersion},
+		},
+	}
+	var buf bytes.Buffer
+	cfg.Render(&buf)
+	// Make sure we're writing a config that we can read
+	if _, err := config.ParseConfig(bytes.NewReader(buf.Bytes())); err != nil {
+		return nil, errors.Wrap(err, "error validating bramble.toml")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bramble.toml"), buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bramble.lock"), nil, 0644); err != nil {
+		return nil, err
+	}
+	// Don't overwrite existing bramble files in the directory
+	if defaultBramble := filepath.Join(dir, "default.bramble"); !fileutil.FileExists(defaultBramble) {
+		if err := ioutil.WriteFile(defaultBramble, []byte(starterBramblefile), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return NewProject(dir)
+}
+
+// inferPackageName returns a package name for a directory. If the directory is
+// within a git repository with an "origin" remote the remote url is used,
+// otherwise the name of the directory.
+func inferPackageName(dir string) string {
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+	remote := gitRemoteToPackageName(git("config", "--get", "remote.origin.url"))
+	if remote == "" {
+		return filepath.Base(dir)
+	}
+	// Add the path to the directory if we're in a subdirectory of the repo
+	if top := git("rev-parse", "--show-toplevel"); top != "" {
+		// Resolve symlinks so that the paths are comparable
+		top, _ = filepath.EvalSymlinks(top)
+		resolved, _ := filepath.EvalSymlinks(dir)
+		if rel, err := filepath.Rel(top, resolved); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return remote + "/" + filepath.ToSlash(rel)
+		}
+	}
+	return remote
+}
+
+// gitRemoteToPackageName converts a git remote url into a package name:
+//
+//	git@github.com:maxmcd/bramble.git       => github.com/maxmcd/bramble
+//	https://github.com/maxmcd/bramble.git   => github.com/maxmcd/bramble
+//	ssh://git@gitlab.com:22/maxmcd/bramble  => gitlab.com/maxmcd/bramble
+func gitRemoteToPackageName(remote string) string {
+	if remote == "" {
+		return ""
+	}
+	name := remote
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[i+3:]
+	} else if i := strings.Index(name, ":"); i >= 0 {
+		// scp-like syntax, user@host:path
+		name = name[:i] + "/" + name[i+1:]
+	}
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[i+1:]
+	}
+	host, path := name, ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		host, path = name[:i], name[i+1:]
+	}
+	if i := strings.Index(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if host == "" || path == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", host, path)
+}
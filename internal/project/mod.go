@@ -0,0 +1,218 @@
+package project
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/maxmcd/bramble/internal/config"
+	"github.com/maxmcd/bramble/internal/dependency"
+	"github.com/maxmcd/bramble/internal/types"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/pkg/errors"
+)
+
+// Formats that the requirement graph can be printed in
+const (
+	GraphFormatText = "text"
+	GraphFormatDOT  = "dot"
+	GraphFormatJSON = "json"
+)
+
+// loadedDependencies scans the project's bramble files for load statements
+// and returns the names of the dependencies that they load. Loads that aren't
+// part of the project or any dependency are returned as unknown.
+func (p *Project) loadedDependencies() (deps []string, unknown []string, err error) {
+	names, err := p.scanForLoadNames()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error scanning for load statements")
+	}
+	sort.Strings(names)
+	seen := map[string]bool{}
+	for _, name := range names {
+		dep := p.config.LoadValueToDependency(name)
+		switch {
+		case dep != "" && !seen[dep]:
+			seen[dep] = true
+			deps = append(deps, dep)
+		case dep == "" && !strings.HasPrefix(name, p.config.Package.Name):
+			unknown = append(unknown, name)
+		}
+	}
+	return deps, unknown, nil
+}
+
+// directRequirements returns the project config with only the dependencies
+// that are loaded by the project's bramble files. bramble.toml lists the whole
+// build list, so without this every dependency would look like it's required
+// by the project itself.
+func (p *Project) directRequirements() (cfg config.Config, err error) {
+	deps, _, err := p.loadedDependencies()
+	if err != nil {
+		return cfg, err
+	}
+	cfg = p.config
+	cfg.Dependencies = map[string]config.Dependency{}
+	for _, dep := range deps {
+		cfg.Dependencies[dep] = p.config.Dependencies[dep]
+	}
+	return cfg, nil
+}
+
+// TidyDependencies makes bramble.toml match the load statements of the
+// project. Packages are found for loads that don't match a dependency and are
+// added at their newest version, dependencies that aren't needed anymore are
+// removed and the build list is recalculated.
+func (p *Project) TidyDependencies(ctx context.Context) (err error) {
+	required, unknown, err := p.loadedDependencies()
+	if err != nil {
+		return err
+	}
+	cfg := p.config
+	cfg.Dependencies = map[string]config.Dependency{}
+	for name, dep := range p.config.Dependencies {
+		cfg.Dependencies[name] = dep
+	}
+	for _, name := range unknown {
+		if dep := cfg.LoadValueToDependency(name); dep != "" {
+			// Found while resolving an earlier load
+			continue
+		}
+		pkg, err := p.dm.FindNewestPackage(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "error finding a package for load(%q)", name)
+		}
+		cfg.Dependencies[pkg.Name] = config.Dependency{Version: pkg.Version}
+		required = append(required, pkg.Name)
+	}
+	if cfg, err = p.dm.TidyConfigBuildlist(cfg, required); err != nil {
+		return err
+	}
+	return p.replaceConfig(cfg)
+}
+
+// VendorDependencies copies the source of every dependency into the vendor
+// directory of the project and records their hashes in bramble.lock. Once a
+// project has a vendor directory dependencies are only loaded from it.
+// Dependencies with a path aren't vendored.
+func (p *Project) VendorDependencies(ctx context.Context) (err error) {
+	tmp, err := os.MkdirTemp(p.location, ".vendor-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	var names []string
+	for name := range p.config.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dep := p.config.Dependencies[name]
+		if dep.Path != "" {
+			continue
+		}
+		pkg := types.Package{Name: name, Version: dep.Version}
+		// Vendor from the dependency directory, not from an existing vendor
+		// directory that might have been modified
+		expected, _ := p.lockFile.LookupDependency(pkg)
+		src, hash, err := p.dm.PackagePathOrDownload(ctx, pkg, expected)
+		if err != nil {
+			return err
+		}
+		if expected == "" {
+			if err := p.lockFile.AddDependency(pkg, hash); err != nil {
+				return err
+			}
+		}
+		dest := filepath.Join(tmp, pkg.String())
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		if err := fileutil.CopyDirectory(src, dest); err != nil {
+			return errors.Wrapf(err, "error vendoring package %s", pkg)
+		}
+		fmt.Printf("vendored %s\n", pkg)
+	}
+	vendor := filepath.Join(p.location, vendorDirectory)
+	if err := os.RemoveAll(vendor); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, vendor); err != nil {
+		return err
+	}
+	if err := os.Chmod(vendor, 0755); err != nil {
+		return err
+	}
+	return p.WriteLockfile()
+}
+
+func (p *Project) requirementGraph() (root types.Package, graph []dependency.Requirement, err error) {
+	cfg, err := p.directRequirements()
+	if err != nil {
+		return root, nil, err
+	}
+	graph, err = p.dm.RequirementGraph(cfg)
+	return types.Package{Name: cfg.Package.Name, Version: cfg.Package.Version}, graph, err
+}
+
+// ModGraph prints the requirement graph of the project in the passed format.
+// Every line of the text format is a package followed by a package it
+// requires.
+func (p *Project) ModGraph(w io.Writer, format string) (err error) {
+	_, graph, err := p.requirementGraph()
+	if err != nil {
+		return err
+	}
+	switch format {
+	case GraphFormatText, "":
+		for _, r := range graph {
+			fmt.Fprintf(w, "%s %s\n", r.Package, r.Requires)
+		}
+	case GraphFormatDOT:
+		fmt.Fprintln(w, "digraph {")
+		for _, r := range graph {
+			fmt.Fprintf(w, "\t%q -> %q\n", r.Package.String(), r.Requires.String())
+		}
+		fmt.Fprintln(w, "}")
+	case GraphFormatJSON:
+		type requirement struct {
+			Package  string `json:"package"`
+			Requires string `json:"requires"`
+		}
+		out := []requirement{}
+		for _, r := range graph {
+			out = append(out, requirement{Package: r.Package.String(), Requires: r.Requires.String()})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	default:
+		return errors.Errorf("unknown graph format %q, must be one of %q, %q or %q",
+			format, GraphFormatText, GraphFormatDOT, GraphFormatJSON)
+	}
+	return nil
+}
+
+// ModWhy prints the shortest chain of requirements from the project to the
+// package.
+func (p *Project) ModWhy(w io.Writer, pkg string) (err error) {
+	root, graph, err := p.requirementGraph()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# %s\n", pkg)
+	chain := dependency.RequirementChain(graph, root, pkg)
+	if chain == nil {
+		fmt.Fprintf(w, "(%s does not need package %s)\n", root.Name, pkg)
+		return nil
+	}
+	for _, p := range chain {
+		fmt.Fprintln(w, p)
+	}
+	return nil
+}
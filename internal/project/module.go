@@ -120,32 +120,99 @@ func (p *Project) scanForLoadNames() (moduleNames []string, err error) {
 	return moduleNames, nil
 }
 
-// TODO: function that takes load() argument values and references the config and pulls down the needed version
+// findOrDownloadModulePath returns the location of a module. Modules in the
+// project are in the project directory, modules of dependencies are found
+// within the source of the dependency.
 func (p *Project) findOrDownloadModulePath(ctx context.Context, module string) (path string, err error) {
 	if strings.HasPrefix(module, p.config.Package.Name) {
 		path = module[len(p.config.Package.Name):]
 		path = filepath.Join(p.location, path)
 		return path, nil
 	}
-	cd, found := p.config.Dependencies[module]
-	if !found {
+	dep := p.config.LoadValueToDependency(module)
+	if dep == "" {
 		return "", errors.Errorf("%q is not a dependency of this project, do you need to add it?", module)
 	}
+	if path, err = p.dependencyPath(ctx, dep); err != nil {
+		return "", err
+	}
+	return filepath.Join(path, strings.TrimPrefix(module, dep)), nil
+}
+
+// vendorDirectory is the directory in a project that dependencies are
+// vendored into by "bramble mod vendor"
+const vendorDirectory = "vendor"
+
+func (p *Project) vendorPath(pkg types.Package) string {
+	return filepath.Join(p.location, vendorDirectory, pkg.String())
+}
+
+// dependencyPath returns the location of the source of a dependency.
+// Dependencies with a path are used from that directory. If the project has a
+// vendor directory every other dependency must be vendored, otherwise sources
+// are downloaded into the dependency directory. Vendored and downloaded
+// sources must match the hash in bramble.lock.
+func (p *Project) dependencyPath(ctx context.Context, name string) (path string, err error) {
+	cd := p.config.Dependencies[name]
+	pkg := types.Package{Name: name, Version: cd.Version}
 	if cd.Path != "" {
-		// TODO: Does this actually work
-		// TODO: cd.Path must be relative?
-		return filepath.Join(p.location, cd.Path), nil
+		return p.localDependencyPath(pkg, cd.Path)
+	}
+	expected, _ := p.lockFile.LookupDependency(pkg)
+	if fileutil.DirExists(filepath.Join(p.location, vendorDirectory)) {
+		path = p.vendorPath(pkg)
+		if !fileutil.DirExists(path) {
+			return "", errors.Errorf("package %s is not vendored, run \"bramble mod vendor\" to vendor it", pkg)
+		}
+		if expected == "" {
+			return "", errors.Errorf("vendored package %s has no hash in bramble.lock, run \"bramble mod vendor\" to vendor it again", pkg)
+		}
+		hash, err := p.dm.PackageSourceHash(path)
+		if err != nil {
+			return "", err
+		}
+		if hash != expected {
+			return "", errors.Errorf(
+				"the vendored source of package %s has hash %s, but bramble.lock expects %s. "+
+					"Run \"bramble mod vendor\" to vendor it again",
+				pkg, hash, expected)
+		}
+		return path, nil
 	}
-	path, err = p.dm.PackagePathOrDownload(ctx, types.Package{Name: module, Version: cd.Version})
-	return path, err
+	path, hash, err := p.dm.PackagePathOrDownload(ctx, pkg, expected)
+	if err != nil {
+		return "", err
+	}
+	if expected == "" {
+		if err := p.lockFile.AddDependency(pkg, hash); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// localDependencyPath returns the location of a dependency that is used from
+// a local directory. Relative paths are relative to the project, and the
+// directory must contain the package.
+func (p *Project) localDependencyPath(pkg types.Package, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.location, path)
+	}
+	cfg, err := config.ReadConfig(filepath.Join(path, "bramble.toml"))
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading the config of dependency %s at path %q", pkg.Name, path)
+	}
+	if cfg.Package.Name != pkg.Name {
+		return "", errors.Errorf("dependency %s has the path %q, but the package there is %s", pkg.Name, path, cfg.Package.Name)
+	}
+	return path, nil
 }
 
 func (p *Project) moduleInProject(module string) bool {
 	if strings.HasPrefix(module, p.config.Package.Name) {
 		return true
 	}
-	_, found := p.config.Dependencies[module]
-	return found
+	return p.config.LoadValueToDependency(module) != ""
 }
 
 func (p *Project) filepathToModuleName(path string) (module string, err error) {
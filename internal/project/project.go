@@ -3,9 +3,12 @@ package project
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/maxmcd/bramble/internal/config"
@@ -13,7 +16,6 @@ import (
 	"github.com/maxmcd/bramble/internal/tracing"
 	"github.com/maxmcd/bramble/internal/types"
 	"github.com/maxmcd/bramble/pkg/fileutil"
-	"github.com/maxmcd/bramble/pkg/fxt"
 	"github.com/pkg/errors"
 )
 
@@ -149,31 +151,6 @@ func (p *Project) findAllBramblefiles(path string) (files []string, err error) {
 	)
 }
 
-func (p *Project) CalculateDependencies() (err error) {
-	names, err := p.scanForLoadNames()
-	if err != nil {
-		return errors.Wrap(err, "error scanning for load statements")
-	}
-
-	if len(names) == 0 {
-		return nil
-	}
-	external := []string{}
-	for _, name := range names {
-		if v := p.config.LoadValueToDependency(name); v == "" {
-			external = append(external, name)
-		}
-	}
-	if len(external) == 0 {
-		return nil
-	}
-
-	fxt.Printqln(external)
-
-	// TODO: lots of magic to navigate here, do it sometime
-	return nil
-}
-
 func (p *Project) AddDependency(v types.Package) (err error) {
 	existing, found := p.config.Dependencies[v.Name]
 	if found {
@@ -192,6 +169,70 @@ func (p *Project) AddDependency(v types.Package) (err error) {
 	return p.writeConfig(cfg)
 }
 
+// UpdateDependencies upgrades the passed packages, or every dependency if none
+// are passed, to their newest compatible version and writes the new build list
+// to bramble.toml.
+func (p *Project) UpdateDependencies(pkgs ...string) (err error) {
+	cfg, err := p.dm.UpgradeConfigBuildlist(p.config, pkgs...)
+	if err != nil {
+		return err
+	}
+	return p.replaceConfig(cfg)
+}
+
+// DowngradeDependency downgrades a dependency, along with any dependencies that
+// require a newer version of it, and writes the new build list to
+// bramble.toml.
+func (p *Project) DowngradeDependency(v types.Package) (err error) {
+	cfg, err := p.dm.DowngradeConfigBuildlist(p.config, v)
+	if err != nil {
+		return err
+	}
+	return p.replaceConfig(cfg)
+}
+
+// replaceConfig prints the dependencies that changed and writes the config.
+func (p *Project) replaceConfig(cfg config.Config) (err error) {
+	printDependencyChanges(os.Stdout, p.config.Dependencies, cfg.Dependencies)
+	if err := p.writeConfig(cfg); err != nil {
+		return err
+	}
+	p.config = cfg
+	return nil
+}
+
+func printDependencyChanges(w io.Writer, old, new map[string]config.Dependency) {
+	var names []string
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changed := false
+	for _, name := range names {
+		o, inOld := old[name]
+		n, inNew := new[name]
+		switch {
+		case !inOld:
+			fmt.Fprintf(w, "added %s@%s\n", name, n.Version)
+		case !inNew:
+			fmt.Fprintf(w, "removed %s@%s\n", name, o.Version)
+		case o.Version != n.Version:
+			fmt.Fprintf(w, "%s %s => %s\n", name, o.Version, n.Version)
+		default:
+			continue
+		}
+		changed = true
+	}
+	if !changed {
+		fmt.Fprintln(w, "dependencies are up to date")
+	}
+}
+
 func (p *Project) writeConfig(cfg config.Config) (err error) {
 	f, err := os.Create(filepath.Join(p.location, "bramble.toml"))
 	if err != nil {
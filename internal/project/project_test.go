@@ -1,8 +1,13 @@
 package project
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/maxmcd/bramble/internal/dependency"
+	"github.com/maxmcd/bramble/internal/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -26,3 +31,100 @@ func TestNewProject(t *testing.T) {
 		}
 	}
 }
+
+func TestInitProject(t *testing.T) {
+	dir := t.TempDir()
+	p, err := InitProject(filepath.Join(dir, "my-project"), "")
+	require.NoError(t, err)
+	assert.Equal(t, "my-project", p.Module())
+	assert.Equal(t, "0.0.1", p.Version())
+	assert.Equal(t, StdLibVersion, p.config.Dependencies[StdLibModule].Version)
+	for _, name := range []string{"bramble.toml", "bramble.lock", "default.bramble"} {
+		assert.FileExists(t, filepath.Join(dir, "my-project", name))
+	}
+
+	_, err = InitProject(filepath.Join(dir, "my-project", "sub"), "foo")
+	require.Error(t, err)
+}
+
+func TestGitRemoteToPackageName(t *testing.T) {
+	for _, tt := range []struct {
+		remote string
+		name   string
+	}{
+		{"git@github.com:maxmcd/bramble.git", "github.com/maxmcd/bramble"},
+		{"https://github.com/maxmcd/bramble.git", "github.com/maxmcd/bramble"},
+		{"https://github.com/maxmcd/bramble/", "github.com/maxmcd/bramble"},
+		{"ssh://git@gitlab.com:22/maxmcd/bramble", "gitlab.com/maxmcd/bramble"},
+		{"", ""},
+	} {
+		t.Run(tt.remote, func(t *testing.T) {
+			assert.Equal(t, tt.name, gitRemoteToPackageName(tt.remote))
+		})
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+	}
+}
+
+func TestProject_dependencyPaths(t *testing.T) {
+	ctx := context.Background()
+	dependencyDir := t.TempDir()
+	writeTestFiles(t, filepath.Join(dependencyDir, "src", "test.com/dep@1.0.0"), map[string]string{
+		"bramble.toml":        "[package]\nname = \"test.com/dep\"\nversion = \"1.0.0\"\n",
+		"sub/default.bramble": "def sub():\n    pass\n",
+	})
+	location := t.TempDir()
+	writeTestFiles(t, location, map[string]string{
+		"bramble.toml": `[package]
+name = "test.com/project"
+version = "0.0.1"
+
+[dependencies]
+"test.com/dep" = "1.0.0"
+"test.com/local" = {version = "1.0.0", path = "./local"}
+"test.com/wrong" = {version = "1.0.0", path = "./local"}
+`,
+		"local/bramble.toml":        "[package]\nname = \"test.com/local\"\nversion = \"1.0.0\"\n",
+		"local/lib/default.bramble": "",
+	})
+	newProject := func() *Project {
+		p, err := NewProject(location)
+		require.NoError(t, err)
+		p.AddModuleFetcher(dependency.NewManager(dependencyDir, nil, true))
+		return p
+	}
+	p := newProject()
+
+	path, err := p.findOrDownloadModulePath(ctx, "test.com/dep/sub")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dependencyDir, "src", "test.com/dep@1.0.0", "sub"), path)
+	hash, found := p.lockFile.LookupDependency(types.Package{Name: "test.com/dep", Version: "1.0.0"})
+	require.True(t, found)
+	require.NotEmpty(t, hash)
+
+	path, err = p.findOrDownloadModulePath(ctx, "test.com/local/lib")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(location, "local", "lib"), path)
+	_, err = p.findOrDownloadModulePath(ctx, "test.com/wrong")
+	require.Error(t, err, "the package at the path must match the dependency")
+
+	require.NoError(t, p.VendorDependencies(ctx))
+	require.NoDirExists(t, filepath.Join(location, "vendor", "test.com/local@1.0.0"))
+	path, err = newProject().findOrDownloadModulePath(ctx, "test.com/dep/sub")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(location, "vendor", "test.com/dep@1.0.0", "sub"), path)
+
+	// Modified vendored sources don't match the lockfile
+	writeTestFiles(t, filepath.Join(location, "vendor", "test.com/dep@1.0.0"), map[string]string{
+		"sub/default.bramble": "def sub():\n    fail()\n",
+	})
+	_, err = newProject().findOrDownloadModulePath(ctx, "test.com/dep/sub")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bramble mod vendor")
+}
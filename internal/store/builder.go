@@ -31,16 +31,38 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
-func (s *Store) NewBuilder(lockfileWriter types.LockfileWriter) *Builder {
+// NewBuilder creates a new Builder. If substituters are passed the builder will
+// try and download outputs from them before building a derivation.
+func (s *Store) NewBuilder(lockfileWriter types.LockfileWriter, substituters ...Substituter) *Builder {
 	return &Builder{
 		store:          s,
 		lockfileWriter: lockfileWriter,
+		substituters:   substituters,
 	}
 }
 
 type Builder struct {
 	store          *Store
 	lockfileWriter types.LockfileWriter
+	substituters   []Substituter
+	trustedKeys    trustedKeys
+}
+
+// TrustPublicKeys adds public keys that are trusted to sign derivations.
+// Derivations from substituters are only used if they have a valid signature
+// from a trusted key.
+func (b *Builder) TrustPublicKeys(keys ...string) error {
+	tk, err := parseTrustedKeys(keys)
+	if err != nil {
+		return err
+	}
+	if b.trustedKeys == nil {
+		b.trustedKeys = trustedKeys{}
+	}
+	for name, key := range tk {
+		b.trustedKeys[name] = key
+	}
+	return nil
 }
 
 type BuildDerivationOptions struct {
@@ -49,6 +71,15 @@ type BuildDerivationOptions struct {
 
 	Shell   bool
 	Verbose bool
+	// Logs receives the output of the builder in addition to the normal
+	// output, if set
+	Logs io.Writer
+	// Stdout receives the output of verbose builds instead of os.Stdout, if
+	// set
+	Stdout io.Writer
+	// Remote builds the derivation on a build server, if set. Derivations
+	// that fetch files and shells are always built locally.
+	Remote RemoteBuilder
 }
 
 func (b *Builder) BuildDerivation(ctx context.Context, drv Derivation, opts BuildDerivationOptions) (builtDrv Derivation, didBuild bool, err error) {
@@ -58,7 +89,40 @@ func (b *Builder) BuildDerivation(ctx context.Context, drv Derivation, opts Buil
 	span.SetAttributes(attribute.String("name", drv.Name))
 
 	drv = formatDerivation(drv)
+	drv.store = b.store
+	unlock, err := b.store.lockBuild(ctx, drv)
+	if err != nil {
+		return drv, false, err
+	}
+	defer unlock()
+	if existing, found, err := b.existingDerivation(ctx, drv, opts); err != nil || found {
+		return existing, false, err
+	}
+	return b.build(ctx, drv, opts)
+}
 
+// lockBuild takes a shared lock on the store and an exclusive lock on the
+// derivation. If another process is building the derivation this waits until
+// it's done, its outputs are then found by existingDerivation.
+func (s *Store) lockBuild(ctx context.Context, drv Derivation) (unlock func(), err error) {
+	unlockStore, err := s.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	unlockDrv, err := s.lockDerivation(ctx, drv.Filename())
+	if err != nil {
+		_ = unlockStore()
+		return nil, err
+	}
+	return func() {
+		_ = unlockDrv()
+		_ = unlockStore()
+	}, nil
+}
+
+// existingDerivation returns the derivation with its outputs if it has already
+// been built or if its outputs can be downloaded from a substituter.
+func (b *Builder) existingDerivation(ctx context.Context, drv Derivation, opts BuildDerivationOptions) (_ Derivation, found bool, err error) {
 	outputs, drvExists, err := b.store.checkForBuiltDerivationOutputs(drv)
 	drv.Outputs = outputs
 	if err != nil {
@@ -73,10 +137,38 @@ func (b *Builder) BuildDerivation(ctx context.Context, drv Derivation, opts Buil
 		}
 	}
 
-	filename := drv.Filename()
-	span.SetAttributes(attribute.String("filename", filename))
 	if drvExists && outputsExist && !opts.ForceBuild {
-		return drv, false, nil
+		return drv, true, nil
+	}
+	if !opts.ForceBuild {
+		substituted, found, err := b.substitute(ctx, drv)
+		if err != nil {
+			return drv, false, err
+		}
+		if found {
+			// Fetched content must match the lockfile whether it's downloaded
+			// by the builder or from a cache
+			if err := b.checkFetchDerivation(substituted); err != nil {
+				return drv, false, err
+			}
+			_, err = b.store.WriteDerivation(substituted)
+			return substituted, true, err
+		}
+	}
+	return drv, false, nil
+}
+
+// build builds the derivation, remotely if opts.Remote is set and the
+// derivation can be built remotely.
+func (b *Builder) build(ctx context.Context, drv Derivation, opts BuildDerivationOptions) (builtDrv Derivation, didBuild bool, err error) {
+	filename := drv.Filename()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("filename", filename))
+	if opts.Remote != nil && !opts.Shell && drv.localBuildOnly() == nil {
+		if drv, err = b.buildRemotely(ctx, opts.Remote, drv, opts); err != nil {
+			return drv, false, errors.Wrap(err, "error building "+filename+" remotely")
+		}
+		_, err = b.store.WriteDerivation(drv)
+		return drv, true, err
 	}
 	// logger.Print("Building derivation", filename)
 	logger.Debugw(drv.PrettyJSON())
@@ -84,7 +176,6 @@ func (b *Builder) BuildDerivation(ctx context.Context, drv Derivation, opts Buil
 		return drv, false, errors.Wrap(err, "error building "+filename)
 	}
 	_, err = b.store.WriteDerivation(drv)
-	// TODO: lock store on write
 	return drv, true, err
 }
 
@@ -147,10 +238,19 @@ func (b *Builder) buildDerivation(ctx context.Context, drv Derivation, opts Buil
 	}
 
 	drv.Outputs, err = outputsToOutput(drv.OutputNames, outputs)
+	if err != nil {
+		return drv, err
+	}
+	return drv, b.checkFetchDerivation(drv)
+}
 
+// checkFetchDerivation checks the output hash of a fetch derivation against
+// the lockfile, or adds it to the lockfile if there's no entry yet. Other
+// derivations are ignored.
+func (b *Builder) checkFetchDerivation(drv Derivation) error {
 	switch {
 	case drv.Builder == "basic_fetch_url":
-		return drv, b.checkFetchDerivationHashes(drv, "basic_fetch_url "+drv.Env["url"])
+		return b.checkFetchDerivationHashes(drv, "basic_fetch_url "+drv.Env["url"])
 
 	// These two are just a contract with an environment variable. Any
 	// derivation could set these. I think that's ok from a security standpoint,
@@ -162,17 +262,16 @@ func (b *Builder) buildDerivation(ctx context.Context, drv Derivation, opts Buil
 	// use this for their own lockfile needs. Would need to be sure it can't be
 	// abused to interact with our expected lockfile values.
 	case drv.Env["confirm_fetch_url"] == "true":
-		return drv, b.checkFetchDerivationHashes(drv, "fetch_url "+drv.Env["url"])
+		return b.checkFetchDerivationHashes(drv, "fetch_url "+drv.Env["url"])
 	case drv.Env["confirm_fetch_git"] == "true":
 		url := "fetch_git " + drv.Env["url"]
 		reference := drv.Env["reference"]
 		if reference != "" {
 			url += "@" + reference
 		}
-		return drv, b.checkFetchDerivationHashes(drv, url)
+		return b.checkFetchDerivationHashes(drv, url)
 	}
-
-	return drv, err
+	return nil
 }
 
 func (b *Builder) checkFetchDerivationHashes(drv Derivation, url string) error {
@@ -314,6 +413,9 @@ func (b *Builder) regularBuilder(ctx context.Context, drv Derivation, buildDir s
 		mounts = append(mounts, outputPath)
 	}
 	var stdout io.Writer = os.Stdout
+	if opts.Stdout != nil {
+		stdout = opts.Stdout
+	}
 	var stderr io.Writer = os.Stderr
 	var f *os.File
 	var buf *bufio.Writer
@@ -334,6 +436,9 @@ func (b *Builder) regularBuilder(ctx context.Context, drv Derivation, buildDir s
 			err = os.Remove(f.Name())
 		}()
 	}
+	if opts.Logs != nil {
+		stdout, stderr = io.MultiWriter(stdout, opts.Logs), io.MultiWriter(stderr, opts.Logs)
+	}
 	sbx := sandbox.Sandbox{
 		Args:    append([]string{builderLocation}, drv.Args...),
 		Stdout:  stdout,
@@ -393,14 +498,14 @@ func (s *Store) hashAndMoveBuildOutputs(ctx context.Context, drv Derivation, out
 		newPath := s.joinStorePath(hashedFolderName)
 
 		if !fileutil.PathExists(newPath) {
-			if err := s.unarchiveAndReplaceOutputFolderName(
-				ctx,
-				reptarFile.Name(),
-				newPath,
-				outputFolder,
-				hashedFolderName); err != nil {
+			if err := s.moveOutputIntoStore(ctx, reptarFile.Name(), newPath, outputFolder, hashedFolderName); err != nil {
 				return nil, err
 			}
+			if s.AutoOptimise {
+				if err := s.optimiseOutput(hashedFolderName, map[uint64]os.FileMode{}, &OptimiseResult{}); err != nil {
+					return nil, errors.Wrap(err, "error optimising output")
+				}
+			}
 		}
 		if err := os.RemoveAll(reptarFile.Name()); err != nil {
 			return nil, err
@@ -411,6 +516,29 @@ func (s *Store) hashAndMoveBuildOutputs(ctx context.Context, drv Derivation, out
 	return
 }
 
+// moveOutputIntoStore unarchives an output into a temporary directory and
+// then renames it to its path in the store, so that other processes never see
+// a partially written output.
+func (s *Store) moveOutputIntoStore(ctx context.Context, archive, dst, outputFolder, hashedFolderName string) (err error) {
+	tempDir, err := s.storeLengthTempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	location := filepath.Join(tempDir, "out")
+	if err := s.unarchiveAndReplaceOutputFolderName(ctx, archive, location, outputFolder, hashedFolderName); err != nil {
+		return err
+	}
+	if err := os.Rename(location, dst); err != nil {
+		// Another process might have built the same output
+		if fileutil.DirExists(dst) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
 func (s *Store) unarchiveAndReplaceOutputFolderName(ctx context.Context, archive, dst, outputFolder, hashedFolderName string) (err error) {
 	var span trace.Span
 	_, span = tracer.Start(ctx, "store.store.unarchiveAndReplaceOutputFolderName")
@@ -467,13 +595,22 @@ func (s *Store) archiveAndScanOutputDirectory(ctx context.Context, tarOutput, ha
 
 	for _, do := range drv.Dependencies {
 		drv, found, err := s.LoadDerivation(do.Filename)
-		if err != nil || !found {
-			panic(fmt.Sprint(drv, err, do.Filename, found))
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, errors.Errorf("dependency %s is missing from the store", do.Filename)
 		}
 		storeValues = append(storeValues,
 			s.joinStorePath(drv.output(do.OutputName).Path),
 		)
 	}
+	// References to the output itself also use the prefix of record so that
+	// the hash doesn't depend on the location of the store and outputs can be
+	// substituted from caches. Self-referencing outputs built before this was
+	// added have a different hash, "bramble store verify" reports them.
+	selfReference := s.joinStorePath(storeFolder)
+	storeValues = append(storeValues, selfReference)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -568,6 +705,9 @@ func (s *Store) archiveAndScanOutputDirectory(ctx context.Context, tarOutput, ha
 		return nil, err
 	case result := <-resultChan:
 		for match := range result {
+			if match == selfReference {
+				continue
+			}
 			// remove prefix from dependency path
 			match = strings.TrimPrefix(strings.Replace(match, s.StorePath, "", 1), "/")
 			matches = append(matches, match)
@@ -583,6 +723,9 @@ func (s *Store) archiveAndScanOutputDirectory(ctx context.Context, tarOutput, ha
 	return
 }
 
+// hashNormalizedBuildOutput confirms that the output at location matches its
+// hash. The output must be normalized, references to the bramble store must
+// use BramblePrefixOfRecord.
 func (s *Store) hashNormalizedBuildOutput(location string, hash string) (err error) {
 	pipeReader, pipeWriter := io.Pipe()
 	errChan := make(chan error)
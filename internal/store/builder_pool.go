@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/maxmcd/bramble/internal/types"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BuilderPool distributes builds across the local builder and remote builders.
+// Every builder in the pool has a platform and a maximum number of concurrent
+// builds, derivations are built by a builder with a matching platform as soon
+// as one has a free slot. Outputs built remotely are downloaded into the local
+// store and uploaded to other remote builders when they're needed as inputs.
+type BuilderPool struct {
+	builder *Builder
+	members []*poolMember
+
+	lock sync.Mutex
+	// released is closed and replaced every time a build finishes
+	released chan struct{}
+}
+
+type poolMember struct {
+	// remote is nil for the local builder
+	remote         RemoteBuilder
+	platform       string
+	maxConcurrency int
+	running        int
+}
+
+// NewPool returns a pool that builds up to maxConcurrency derivations at once
+// with the builder. Remote builders can be added with AddRemote.
+func (b *Builder) NewPool(maxConcurrency int) *BuilderPool {
+	return &BuilderPool{
+		builder:  b,
+		released: make(chan struct{}),
+		members: []*poolMember{{
+			platform:       types.Platform(),
+			maxConcurrency: maxConcurrency,
+		}},
+	}
+}
+
+// AddRemote adds a remote builder that builds derivations for platform, up to
+// maxConcurrency at once.
+func (p *BuilderPool) AddRemote(rb RemoteBuilder, platform string, maxConcurrency int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.members = append(p.members, &poolMember{
+		remote:         rb,
+		platform:       platform,
+		maxConcurrency: maxConcurrency,
+	})
+}
+
+// MaxConcurrency returns the number of builds the pool can run at once.
+func (p *BuilderPool) MaxConcurrency() (n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, m := range p.members {
+		n += m.maxConcurrency
+	}
+	return n
+}
+
+// BuildDerivation builds a derivation with the first builder in the pool that
+// can build it. Derivations that are already built or that can be substituted
+// don't wait for a builder.
+func (p *BuilderPool) BuildDerivation(ctx context.Context, drv Derivation, opts BuildDerivationOptions) (builtDrv Derivation, didBuild bool, err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.BuilderPool.BuildDerivation")
+	defer span.End()
+	span.SetAttributes(attribute.String("name", drv.Name))
+
+	drv = formatDerivation(drv)
+	unlock, err := p.builder.store.lockBuild(ctx, drv)
+	if err != nil {
+		return drv, false, err
+	}
+	defer unlock()
+	if existing, found, err := p.builder.existingDerivation(ctx, drv, opts); err != nil || found {
+		return existing, false, err
+	}
+	m, err := p.acquire(ctx, drv, opts)
+	if err != nil {
+		return drv, false, err
+	}
+	defer p.release(m)
+	opts.Remote = m.remote
+	return p.builder.build(ctx, drv, opts)
+}
+
+func (m *poolMember) canBuild(drv Derivation, opts BuildDerivationOptions) bool {
+	if m.remote != nil && (opts.Shell || drv.localBuildOnly() != nil) {
+		return false
+	}
+	platform := drv.Platform
+	if platform == "" {
+		platform = types.Platform()
+	}
+	return m.platform == platform
+}
+
+// acquire waits for a builder that can build the derivation to have a free
+// slot. The least busy builder is picked if more than one is free.
+func (p *BuilderPool) acquire(ctx context.Context, drv Derivation, opts BuildDerivationOptions) (*poolMember, error) {
+	for {
+		p.lock.Lock()
+		var (
+			candidates int
+			best       *poolMember
+		)
+		for _, m := range p.members {
+			if !m.canBuild(drv, opts) || m.maxConcurrency <= 0 {
+				continue
+			}
+			candidates++
+			if m.running >= m.maxConcurrency {
+				continue
+			}
+			if best == nil || m.running*best.maxConcurrency < best.running*m.maxConcurrency {
+				best = m
+			}
+		}
+		if best != nil {
+			best.running++
+			p.lock.Unlock()
+			return best, nil
+		}
+		released := p.released
+		p.lock.Unlock()
+		if candidates == 0 {
+			return nil, errors.Errorf("no builder can build derivation %s for platform %s", drv.Name, drv.Platform)
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *BuilderPool) release(m *poolMember) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	m.running--
+	close(p.released)
+	p.released = make(chan struct{})
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/bramble/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+type testRemoteBuilder struct {
+	RemoteBuilder
+	name string
+}
+
+func TestBuilderPool_acquire(t *testing.T) {
+	ctx := context.Background()
+	pool := (&Builder{}).NewPool(1)
+	fast := testRemoteBuilder{name: "fast"}
+	other := testRemoteBuilder{name: "other"}
+	pool.AddRemote(fast, types.Platform(), 2)
+	pool.AddRemote(other, "plan9_arm", 1)
+	require.Equal(t, 4, pool.MaxConcurrency())
+
+	drv := Derivation{Name: "a", Platform: types.Platform()}
+	fetch := Derivation{Name: "fetch", Builder: "basic_fetch_url", Platform: types.Platform()}
+
+	local, err := pool.acquire(ctx, drv, BuildDerivationOptions{})
+	require.NoError(t, err)
+	require.Nil(t, local.remote, "the local builder is used first")
+
+	// The local builder is busy, so derivations go to the remote builder
+	for i := 0; i < 2; i++ {
+		m, err := pool.acquire(ctx, drv, BuildDerivationOptions{})
+		require.NoError(t, err)
+		require.Equal(t, fast, m.remote)
+	}
+
+	// Fetch derivations wait for the local builder
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = pool.acquire(timeout, fetch, BuildDerivationOptions{})
+	require.Equal(t, context.DeadlineExceeded, err)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.release(local)
+	}()
+	m, err := pool.acquire(ctx, fetch, BuildDerivationOptions{})
+	require.NoError(t, err)
+	require.Nil(t, m.remote)
+
+	m, err = pool.acquire(ctx, Derivation{Name: "b", Platform: "plan9_arm"}, BuildDerivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, other, m.remote)
+
+	_, err = pool.acquire(ctx, Derivation{Name: "c", Platform: "js_wasm"}, BuildDerivationOptions{})
+	require.Error(t, err)
+}
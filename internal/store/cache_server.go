@@ -1,14 +1,16 @@
 package store
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/maxmcd/bramble/pkg/chunkedarchive"
+	"github.com/maxmcd/bramble/pkg/fileutil"
 	"github.com/maxmcd/bramble/pkg/httpx"
 	"github.com/pkg/errors"
 )
@@ -43,7 +45,7 @@ func (s *Store) CacheServer() http.Handler {
 		return err
 	})
 	router.GET("/output/:hash", func(c httpx.Context) (err error) {
-		f, err := os.Open(s.joinStorePath(c.Params.ByName("hash")))
+		f, err := os.Open(s.joinStorePath(c.Params.ByName("hash") + ".output"))
 		if err != nil {
 			return httpx.ErrNotFound(err)
 		}
@@ -65,16 +67,24 @@ func (s *Store) CacheServer() http.Handler {
 		return err
 	})
 
+	router.POST("/missing", func(c httpx.Context) (err error) {
+		var req CacheObjects
+		if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+			return httpx.ErrNotAcceptable(err)
+		}
+		missing, err := s.cacheMissing(req)
+		if err != nil {
+			return httpx.ErrNotAcceptable(err)
+		}
+		return c.JSON(missing)
+	})
+
 	router.POST("/derivation", func(c httpx.Context) (err error) {
 		var drv Derivation
 		if err := json.NewDecoder(c.Request.Body).Decode(&drv); err != nil {
 			return httpx.ErrNotAcceptable(err)
 		}
-		var buf bytes.Buffer
-		if err := json.NewEncoder(&buf).Encode(drv); err != nil {
-			return err
-		}
-		filename, err := s.WriteDerivation(drv)
+		filename, err := s.cacheDerivation(drv)
 		if err != nil {
 			return err
 		}
@@ -86,45 +96,155 @@ func (s *Store) CacheServer() http.Handler {
 		if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
 			return httpx.ErrNotAcceptable(err)
 		}
-
-		tempDir, err := os.MkdirTemp("", "")
-		if err != nil {
-			return err
-		}
-		defer os.RemoveAll(tempDir)
-		if err := chunkedarchive.Unarchive(req.TOC, &storeHashFetcher{store: s}, tempDir); err != nil {
-			return err
-		}
-		if err := s.hashNormalizedBuildOutput(tempDir, req.Output.Path); err != nil {
-			return err
-		}
-		f, err := os.Create(s.joinStorePath(req.Output.Path + ".output"))
-		if err != nil {
-			return err
-		}
-		if err := json.NewEncoder(f).Encode(req.TOC); err != nil {
-			return err
-		}
-		return nil
+		return s.cacheOutput(req)
 	})
 	router.POST("/chunk", func(c httpx.Context) (err error) {
-		hash, err := s.WriteBlob(c.Request.Body)
-		if err != nil {
-			return err
+		hash, err := s.cacheChunk(c.Request.Body)
+		if err == errChunkTooLarge {
+			return httpx.ErrNotAcceptable(err)
 		}
-		loc := s.joinStorePath(hash)
-		fi, err := os.Stat(loc)
 		if err != nil {
 			return err
 		}
-		if fi.Size() > 4e6 {
-			_ = os.Remove(loc)
-			return httpx.ErrNotAcceptable(errors.New("chunk size can't be larger than 4MB"))
-		}
-
 		fmt.Fprint(c.ResponseWriter, hash)
 		return nil
 	})
 
 	return router
 }
+
+// cacheMissing returns the objects that aren't in the cache
+func (s *Store) cacheMissing(objects CacheObjects) (missing CacheObjects, err error) {
+	for _, list := range []struct {
+		names   []string
+		suffix  string
+		missing *[]string
+	}{
+		{objects.Chunks, "", &missing.Chunks},
+		{objects.Outputs, ".output", &missing.Outputs},
+		{objects.Derivations, "", &missing.Derivations},
+	} {
+		for _, name := range list.names {
+			if err := validCacheName(name); err != nil {
+				return missing, err
+			}
+			if !fileutil.FileExists(s.joinStorePath(name + list.suffix)) {
+				*list.missing = append(*list.missing, name)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// isCacheObject returns true if a file in the store is a chunk or an output
+// TOC stored by the cache server. Chunks are named with their hash and TOCs
+// with the hash of their output followed by ".output". Every other regular
+// file in the store is a derivation or a temporary file.
+func isCacheObject(file os.DirEntry) bool {
+	name := file.Name()
+	if !file.Type().IsRegular() || strings.HasPrefix(name, buildDirPrefix) {
+		return false
+	}
+	return strings.HasSuffix(name, ".output") || !strings.Contains(name, ".")
+}
+
+// validCacheName returns an error if name can't be the name of an object in the
+// cache, names must not reference files outside of the store
+func validCacheName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return errors.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+func (s *Store) cacheDerivation(drv Derivation) (filename string, err error) {
+	// Keep the signatures of previous uploads of the derivation so that
+	// many keys can sign the same derivation
+	if b, err := os.ReadFile(s.joinStorePath(drv.Filename())); err == nil {
+		var existing Derivation
+		if err := json.Unmarshal(b, &existing); err == nil {
+			drv = mergeSignatures(drv, existing)
+		}
+	}
+	return s.WriteDerivation(drv)
+}
+
+// cacheOutput confirms that the chunks in the TOC make up the normalized
+// output and then stores the TOC
+func (s *Store) cacheOutput(req OutputRequestBody) (err error) {
+	tempDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	if err := chunkedarchive.Unarchive(req.TOC, &storeHashFetcher{store: s}, tempDir); err != nil {
+		return err
+	}
+	if err := s.hashNormalizedBuildOutput(tempDir, req.Output.Path); err != nil {
+		return err
+	}
+	f, err := os.Create(s.joinStorePath(req.Output.Path + ".output"))
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(req.TOC); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var errChunkTooLarge = errors.New("chunk size can't be larger than 4MB")
+
+func (s *Store) cacheChunk(chunk io.Reader) (hash string, err error) {
+	hash, err = s.WriteBlob(chunk)
+	if err != nil {
+		return "", err
+	}
+	loc := s.joinStorePath(hash)
+	fi, err := os.Stat(loc)
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() > 4e6 {
+		_ = os.Remove(loc)
+		return "", errChunkTooLarge
+	}
+	return hash, nil
+}
+
+// cachedOutputTOC returns the TOC of an output in the cache
+func (s *Store) cachedOutputTOC(hash string) (toc []chunkedarchive.TOCEntry, exists bool, err error) {
+	b, err := os.ReadFile(s.joinStorePath(hash + ".output"))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return toc, true, json.Unmarshal(b, &toc)
+}
+
+// localCache stores cache objects in the store, it's used by remote build
+// workers to make their build outputs available to clients
+type localCache struct {
+	store *Store
+}
+
+var _ CacheClient = localCache{}
+
+func (lc localCache) PostChunk(_ context.Context, chunk io.Reader) (string, error) {
+	return lc.store.cacheChunk(chunk)
+}
+
+func (lc localCache) PostDerivation(_ context.Context, drv Derivation) (string, error) {
+	return lc.store.cacheDerivation(drv)
+}
+
+func (lc localCache) PostOutput(_ context.Context, req OutputRequestBody) error {
+	return lc.store.cacheOutput(req)
+}
+
+func (lc localCache) Missing(_ context.Context, objects CacheObjects) (CacheObjects, error) {
+	return lc.store.cacheMissing(objects)
+}
@@ -49,6 +49,12 @@ type Derivation struct {
 	// Platform is the platform we've built this derivation on
 	Platform string
 
+	// Signatures are signatures of the derivation filename and its outputs
+	// from the keys of caches that have published it.
+	//
+	// This attribute is removed when hashing the derivation.
+	Signatures []string `json:",omitempty"`
+
 	Source Source
 
 	// Target is the platform we've built this derivation for. If Target is
@@ -181,6 +187,9 @@ func (drv Derivation) makeConsistentNullJSONValues() Derivation {
 	if len(drv.Dependencies) == 0 {
 		drv.Dependencies = nil
 	}
+	if len(drv.Signatures) == 0 {
+		drv.Signatures = nil
+	}
 	return drv
 }
 
@@ -215,6 +224,7 @@ func (drv Derivation) Hash() string {
 	// TODO: replace references to store path
 	copy := drv.copy()
 	copy.Outputs = nil
+	copy.Signatures = nil
 	for i, input := range copy.Dependencies {
 		// Only use the output name and value when hashing and the output is available
 		if input.Output != "" {
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxmcd/bramble/pkg/chunkedarchive"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/pkg/hasher"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exported closures are tar archives with the same layout as a binary cache:
+// chunks are stored at chunk/<hash>, the TOC of each normalized output at
+// output/<hash> and normalized derivations at derivation/<filename>. Chunks
+// come first, then outputs and then derivations, so an archive can be imported
+// as it's read. An extracted archive can also be served over http and used as
+// a substituter.
+
+const (
+	exportChunkPrefix      = "chunk/"
+	exportOutputPrefix     = "output/"
+	exportDerivationPrefix = "derivation/"
+)
+
+// ExportClosure writes the passed derivations, along with every derivation
+// whose outputs they need at runtime, and all of their outputs to w.
+func (s *Store) ExportClosure(ctx context.Context, derivations []Derivation, w io.Writer) (exported []Derivation, err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.ExportClosure")
+	defer span.End()
+
+	unlock, err := s.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = unlock() }()
+
+	closure, err := s.RuntimeClosure(derivations)
+	if err != nil {
+		return nil, err
+	}
+	ac := &archiveCacheClient{tw: tar.NewWriter(w)}
+	if err := s.uploadToCache(ctx, closure, nil, ac, ioutil.Discard); err != nil {
+		return nil, err
+	}
+	return closure, ac.tw.Close()
+}
+
+// archiveCacheClient is a cache client that writes every object to a tar
+// archive
+type archiveCacheClient struct {
+	lock sync.Mutex
+	tw   *tar.Writer
+}
+
+var _ CacheClient = new(archiveCacheClient)
+
+func (ac *archiveCacheClient) write(name string, body []byte) (err error) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	if err := ac.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(body)),
+		ModTime:  time.Unix(0, 0),
+	}); err != nil {
+		return err
+	}
+	_, err = ac.tw.Write(body)
+	return err
+}
+
+func (ac *archiveCacheClient) PostChunk(_ context.Context, chunk io.Reader) (string, error) {
+	var buf bytes.Buffer
+	h := hasher.New()
+	if _, err := io.Copy(io.MultiWriter(&buf, h), chunk); err != nil {
+		return "", err
+	}
+	return h.String(), ac.write(exportChunkPrefix+h.String(), buf.Bytes())
+}
+
+func (ac *archiveCacheClient) PostDerivation(_ context.Context, drv Derivation) (string, error) {
+	return drv.Filename(), ac.write(exportDerivationPrefix+drv.Filename(), drv.JSON())
+}
+
+func (ac *archiveCacheClient) PostOutput(_ context.Context, req OutputRequestBody) error {
+	b, err := json.Marshal(req.TOC)
+	if err != nil {
+		return err
+	}
+	return ac.write(exportOutputPrefix+req.Output.Path, b)
+}
+
+// Missing returns every object, the archive starts out empty
+func (ac *archiveCacheClient) Missing(_ context.Context, objects CacheObjects) (CacheObjects, error) {
+	return objects, nil
+}
+
+// ImportClosure reads an archive written by ExportClosure and adds its
+// derivations and outputs to the store. Chunks are checked against their hash
+// and outputs are relocated to the local store and checked against their hash
+// the same way substituted outputs are. The imported derivations are returned.
+func (s *Store) ImportClosure(ctx context.Context, r io.Reader) (imported []Derivation, err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.ImportClosure")
+	defer span.End()
+
+	unlock, err := s.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = unlock() }()
+
+	chunkDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(chunkDir)
+
+	tocs := map[string][]chunkedarchive.TOCEntry{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading archive")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		var name string
+		switch {
+		case strings.HasPrefix(hdr.Name, exportChunkPrefix):
+			name = strings.TrimPrefix(hdr.Name, exportChunkPrefix)
+			if err = validCacheName(name); err == nil {
+				err = importChunk(tr, filepath.Join(chunkDir, name), name)
+			}
+		case strings.HasPrefix(hdr.Name, exportOutputPrefix):
+			name = strings.TrimPrefix(hdr.Name, exportOutputPrefix)
+			var toc []chunkedarchive.TOCEntry
+			if err = validCacheName(name); err == nil {
+				err = json.NewDecoder(tr).Decode(&toc)
+			}
+			tocs[name] = toc
+		case strings.HasPrefix(hdr.Name, exportDerivationPrefix):
+			name = strings.TrimPrefix(hdr.Name, exportDerivationPrefix)
+			var drv Derivation
+			if drv, err = s.importDerivation(tr, name, tocs, chunkDir); err == nil {
+				imported = append(imported, drv)
+			}
+		default:
+			err = errors.New("unexpected file in archive")
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error importing %s", hdr.Name)
+		}
+	}
+	return imported, nil
+}
+
+// importChunk writes a chunk to path and confirms that it matches its hash
+func importChunk(r io.Reader, path, hash string) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	h := hasher.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if h.String() != hash {
+		return errors.Errorf("chunk has unexpected hash %s", h.String())
+	}
+	return nil
+}
+
+// importDerivation moves the outputs of a derivation into the store and then
+// writes the derivation. Outputs that are already in the store are skipped.
+func (s *Store) importDerivation(r io.Reader, filename string, tocs map[string][]chunkedarchive.TOCEntry, chunkDir string) (drv Derivation, err error) {
+	if err := validCacheName(filename); err != nil {
+		return drv, err
+	}
+	drv = s.newDerivation()
+	if err := json.NewDecoder(r).Decode(&drv); err != nil {
+		return drv, errors.Wrap(err, "error parsing derivation")
+	}
+	if drv.Filename() != filename {
+		return drv, errors.Errorf("derivation hashes to %s", drv.Filename())
+	}
+	if drv.missingOutput() {
+		return drv, errors.New("derivation is missing outputs")
+	}
+	for _, output := range drv.Outputs {
+		if fileutil.DirExists(s.joinStorePath(output.Path)) {
+			continue
+		}
+		toc, found := tocs[output.Path]
+		if !found {
+			return drv, errors.Errorf("output %s is missing from the archive", output.Path)
+		}
+		if err := s.unarchiveSubstitutedOutput(toc, dirHashFetcher(chunkDir), output); err != nil {
+			return drv, errors.Wrapf(err, "error importing output %s", output.Path)
+		}
+	}
+	if _, err := s.cacheDerivation(drv); err != nil {
+		return drv, err
+	}
+	return drv, nil
+}
+
+// dirHashFetcher fetches chunks from a directory
+type dirHashFetcher string
+
+var _ chunkedarchive.HashFetcher = dirHashFetcher("")
+
+func (hf dirHashFetcher) Lookup(hash string) (file io.ReadCloser, err error) {
+	if err := validCacheName(hash); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(string(hf), hash))
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_ExportImportClosure(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	runtimeDep := buildFetchDerivation(t, s, "runtime", "runtime")
+	buildDep := buildFetchDerivation(t, s, "build", "build")
+	root := buildFetchDerivation(t, s, "root",
+		"I reference "+s.joinStorePath(runtimeDep.output("out").Path),
+		runtimeDep, buildDep)
+
+	var buf bytes.Buffer
+	exported, err := s.ExportClosure(ctx, []Derivation{root}, &buf)
+	require.NoError(t, err)
+	require.Len(t, exported, 2)
+
+	other, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	imported, err := other.ImportClosure(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, imported, 2)
+	require.FileExists(t, other.joinStorePath(root.Filename()))
+	require.NoFileExists(t, other.joinStorePath(buildDep.Filename()))
+	result, err := other.Verify(ctx, VerifyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, result.Problems)
+
+	// References to the exporting store are relocated to the importing store
+	files := outputFiles(t, other, root)
+	require.Len(t, files, 1)
+	b, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	require.Equal(t, "I reference "+other.joinStorePath(runtimeDep.output("out").Path), string(b))
+
+	t.Run("corrupted chunk", func(t *testing.T) {
+		var corrupted bytes.Buffer
+		tw := tar.NewWriter(&corrupted)
+		tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			body, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			body = bytes.ReplaceAll(body, []byte("runtime"), []byte("RUNTIME"))
+			require.NoError(t, tw.WriteHeader(hdr))
+			_, err = tw.Write(body)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+
+		other, err := NewStore(test.TmpDir(t))
+		require.NoError(t, err)
+		_, err = other.ImportClosure(ctx, &corrupted)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "unexpected hash")
+	})
+}
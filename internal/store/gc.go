@@ -0,0 +1,333 @@
+package store
+
+import (
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	ds "github.com/maxmcd/bramble/internal/types"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/pkg/hasher"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ConfigLinks returns the project locations that have been registered with
+// WriteConfigLink.
+func (s *Store) ConfigLinks() (locations []string, err error) {
+	reg := s.joinBramblePath("var/config-registry")
+	files, err := ioutil.ReadDir(reg)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing config registry")
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(filepath.Join(reg, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, string(b))
+	}
+	sort.Strings(locations)
+	return locations, nil
+}
+
+// RemoveConfigLink removes a project location from the config registry.
+func (s *Store) RemoveConfigLink(location string) (err error) {
+	hshr := hasher.New()
+	if _, err = hshr.Write([]byte(location)); err != nil {
+		return
+	}
+	return os.Remove(s.joinBramblePath("var/config-registry", hshr.String()))
+}
+
+type GCOptions struct {
+	// DryRun will calculate what would be deleted without deleting anything
+	DryRun bool
+	// KeepCache keeps every chunk and output stored by the cache server, along
+	// with the derivations they're served with
+	KeepCache bool
+}
+
+type GCResult struct {
+	// Removed is the list of store paths that were removed
+	Removed []string
+	// BytesFreed is the total size of all removed paths
+	BytesFreed int64
+	// StaleRoots are registered roots whose links no longer point to a store
+	// output, they are removed from the registry
+	StaleRoots []string
+}
+
+// CollectGarbage removes every path in the store that isn't needed to build or
+// run the derivations returned by roots. The derivation files, sources and
+// outputs of the build closure and runtime closure of each derivation are kept. Outputs
+// referenced by registered roots are kept along with their runtime closure.
+// Outputs stored by the cache server are kept, with their chunks, if the
+// output is kept. Other chunks and cached outputs are removed unless
+// opts.KeepCache is set.
+// Garbage collection waits for running builds and blocks new builds until it's
+// done. roots is called once the store is locked so that derivations can't be
+// built or removed while they're being found, it must not build anything or
+// lock the store. A nil roots keeps only registered roots.
+func (s *Store) CollectGarbage(ctx context.Context, roots func() ([]Derivation, error), opts GCOptions) (result GCResult, err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.CollectGarbage")
+	defer span.End()
+
+	unlock, err := s.lockStore(ctx, true)
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = unlock() }()
+
+	var drvs []Derivation
+	if roots != nil {
+		if drvs, err = roots(); err != nil {
+			return result, err
+		}
+	}
+	keep, err := s.gcKeepSet(drvs)
+	if err != nil {
+		return result, err
+	}
+	gcRoots, err := s.Roots()
+	if err != nil {
+		return result, err
+	}
+	if err := s.keepRootClosures(keep, gcRoots); err != nil {
+		return result, err
+	}
+	if opts.KeepCache {
+		if err := s.keepCachedDerivations(keep); err != nil {
+			return result, err
+		}
+	} else if err := s.keepCachedOutputs(keep); err != nil {
+		return result, err
+	}
+	for _, root := range gcRoots {
+		if root.Stale() {
+			result.StaleRoots = append(result.StaleRoots, root.Link)
+		}
+	}
+	if !opts.DryRun {
+		if err := s.removeStaleRoots(gcRoots); err != nil {
+			return result, err
+		}
+	}
+
+	files, err := os.ReadDir(s.StorePath)
+	if err != nil {
+		return result, errors.Wrap(err, "error listing store")
+	}
+	for _, file := range files {
+		if _, ok := keep[file.Name()]; ok || file.Name() == linksDirectory || (opts.KeepCache && isCacheObject(file)) {
+			continue
+		}
+		loc := s.joinStorePath(file.Name())
+		size, err := diskUsage(loc)
+		if err != nil {
+			return result, err
+		}
+		if !opts.DryRun {
+			if err := os.RemoveAll(loc); err != nil {
+				return result, errors.Wrapf(err, "error removing %q", loc)
+			}
+		}
+		result.Removed = append(result.Removed, file.Name())
+		result.BytesFreed += size
+	}
+	if !opts.DryRun {
+		if err := s.pruneLinks(); err != nil {
+			return result, errors.Wrap(err, "error removing unused links")
+		}
+		if err := s.removeLockFiles(); err != nil {
+			return result, errors.Wrap(err, "error removing lock files")
+		}
+	}
+	return result, nil
+}
+
+// gcKeepSet returns the names of all store paths that are referenced by the
+// build and runtime closures of the passed derivations.
+func (s *Store) gcKeepSet(roots []Derivation) (keep map[string]struct{}, err error) {
+	keep = map[string]struct{}{}
+	add := func(paths ...string) {
+		for _, p := range paths {
+			if p != "" {
+				keep[p] = struct{}{}
+			}
+		}
+	}
+	keepDerivationOutput := func(do DerivationOutput, inputs bool) error {
+		drv, found, err := s.LoadDerivation(do.Filename)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errors.Errorf("derivation not found with name %s", do.Filename)
+		}
+		if inputs {
+			add(drv.inputFiles()...)
+		}
+		add(drv.runtimeFiles(do.OutputName)...)
+		return nil
+	}
+
+	for _, drv := range roots {
+		drv.store = s
+		graph, err := drv.BuildDependencyGraph()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error calculating build dependencies of %s", drv.Filename())
+		}
+		for _, v := range graph.Vertices() {
+			if v == ds.FakeRoot {
+				continue
+			}
+			if err := keepDerivationOutput(v.(DerivationOutput), true); err != nil {
+				return nil, err
+			}
+		}
+		// Derivations without outputs have no runtime dependencies
+		if drv.missingOutput() {
+			continue
+		}
+		runtimeGraph, err := drv.RuntimeDependencyGraph()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error calculating runtime dependencies of %s", drv.Filename())
+		}
+		for _, v := range runtimeGraph.Vertices() {
+			if err := keepDerivationOutput(v.(DerivationOutput), false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return keep, nil
+}
+
+// keepRootClosures adds the outputs referenced by roots to the keep set, along
+// with their runtime dependencies and the derivations that created them.
+func (s *Store) keepRootClosures(keep map[string]struct{}, roots []Root) (err error) {
+	var toKeep []string
+	for _, root := range roots {
+		if !root.Stale() {
+			toKeep = append(toKeep, root.Path)
+		}
+	}
+	if len(toKeep) == 0 {
+		return nil
+	}
+
+	// Roots only reference output paths, so index every derivation in the
+	// store by its outputs.
+	derivations, err := s.allDerivations()
+	if err != nil {
+		return err
+	}
+	producers := map[string][]Derivation{}
+	for _, drv := range derivations {
+		for _, output := range drv.Outputs {
+			producers[output.Path] = append(producers[output.Path], drv)
+		}
+	}
+	seen := map[string]struct{}{}
+	for len(toKeep) > 0 {
+		path := toKeep[0]
+		toKeep = toKeep[1:]
+		if _, ok := seen[path]; ok {
+			continue
+		}
+		seen[path] = struct{}{}
+		keep[path] = struct{}{}
+		for _, drv := range producers[path] {
+			keep[drv.Filename()] = struct{}{}
+			for _, output := range drv.Outputs {
+				if output.Path == path {
+					toKeep = append(toKeep, output.Dependencies...)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// keepCachedOutputs adds the TOCs of kept outputs that are in the cache to the
+// keep set, along with the chunks they reference.
+func (s *Store) keepCachedOutputs(keep map[string]struct{}) (err error) {
+	var cached []string
+	for path := range keep {
+		toc, exists, err := s.cachedOutputTOC(path)
+		if err != nil {
+			return errors.Wrapf(err, "error reading cached output %q", path)
+		}
+		if !exists {
+			continue
+		}
+		cached = append(cached, path+".output")
+		for _, entry := range toc {
+			cached = append(cached, entry.Body...)
+		}
+	}
+	for _, name := range cached {
+		keep[name] = struct{}{}
+	}
+	return nil
+}
+
+// keepCachedDerivations adds derivations whose outputs are all in the cache to
+// the keep set, the cache server serves them so that the outputs can be
+// substituted.
+func (s *Store) keepCachedDerivations(keep map[string]struct{}) (err error) {
+	derivations, err := s.allDerivations()
+	if err != nil {
+		return err
+	}
+	for _, drv := range derivations {
+		if drv.missingOutput() {
+			continue
+		}
+		cached := true
+		for _, output := range drv.Outputs {
+			if !fileutil.FileExists(s.joinStorePath(output.Path + ".output")) {
+				cached = false
+			}
+		}
+		if cached {
+			keep[drv.Filename()] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// allDerivations loads every derivation file in the store
+func (s *Store) allDerivations() (derivations []Derivation, err error) {
+	files, err := filepath.Glob(s.joinStorePath("*.drv"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		drv, _, err := s.LoadDerivation(filepath.Base(file))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error loading derivation %q", file)
+		}
+		derivations = append(derivations, drv)
+	}
+	return derivations, nil
+}
+
+// diskUsage returns the apparent size of all files at a path
+func diskUsage(path string) (size int64, err error) {
+	return size, filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+// buildFetchDerivation builds a "basic_fetch_url" derivation that downloads a
+// file with the passed body. Dependencies are added as build inputs and any
+// references to their outputs in the body become runtime dependencies.
+func buildFetchDerivation(t *testing.T, s *Store, name, body string, dependencies ...Derivation) Derivation {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	var dos DerivationOutputs
+	for _, dep := range dependencies {
+		dos = append(dos, DerivationOutput{
+			Filename:   dep.Filename(),
+			OutputName: "out",
+			Output:     dep.output("out").Path,
+		})
+	}
+	drv, _, err := s.NewBuilder(testLockfileWriter{}).BuildDerivation(context.Background(), Derivation{
+		Name:         name,
+		Builder:      "basic_fetch_url",
+		OutputNames:  []string{"out"},
+		Dependencies: dos,
+		Env:          map[string]string{"url": server.URL + "/" + name},
+		store:        s,
+	}, BuildDerivationOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return drv
+}
+
+// gcRoots returns a roots function for CollectGarbage that returns drvs.
+func gcRoots(drvs ...Derivation) func() ([]Derivation, error) {
+	return func() ([]Derivation, error) { return drvs, nil }
+}
+
+func TestStore_CollectGarbage(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtimeDep := buildFetchDerivation(t, s, "runtime", "runtime")
+	buildDep := buildFetchDerivation(t, s, "build", "build")
+	root := buildFetchDerivation(t, s, "root",
+		"I reference "+s.joinStorePath(runtimeDep.output("out").Path),
+		runtimeDep, buildDep)
+	garbage := buildFetchDerivation(t, s, "garbage", "garbage")
+	require.Equal(t, []string{runtimeDep.output("out").Path}, root.output("out").Dependencies)
+
+	keep := []string{}
+	for _, drv := range []Derivation{runtimeDep, buildDep, root} {
+		keep = append(keep, drv.Filename(), drv.output("out").Path)
+	}
+	remove := []string{garbage.Filename(), garbage.output("out").Path}
+
+	result, err := s.CollectGarbage(context.Background(), gcRoots(root), GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.ElementsMatch(t, remove, result.Removed)
+	require.NotZero(t, result.BytesFreed)
+	for _, path := range append(keep, remove...) {
+		require.True(t, fileutil.PathExists(s.joinStorePath(path)), path)
+	}
+
+	if _, err := s.CollectGarbage(context.Background(), gcRoots(root), GCOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range keep {
+		require.True(t, fileutil.PathExists(s.joinStorePath(path)), path)
+	}
+	for _, path := range remove {
+		_, err := os.Stat(s.joinStorePath(path))
+		require.True(t, os.IsNotExist(err), path)
+	}
+}
+
+func TestStore_ConfigLinks(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, loc := range []string{"/b", "/a"} {
+		require.NoError(t, s.WriteConfigLink(loc))
+	}
+	locations, err := s.ConfigLinks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"/a", "/b"}, locations)
+
+	require.NoError(t, s.RemoveConfigLink("/a"))
+	locations, err = s.ConfigLinks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"/b"}, locations)
+}
+
+func TestStore_CollectGarbageCache(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	kept := buildFetchDerivation(t, s, "kept", "kept")
+	cached := buildFetchDerivation(t, s, "cached", "cached")
+	require.NoError(t, s.uploadToCache(ctx, []Derivation{kept, cached}, nil, localCache{store: s}, ioutil.Discard))
+	cacheObjects := func(drv Derivation) []string {
+		toc, exists, err := s.cachedOutputTOC(drv.output("out").Path)
+		require.NoError(t, err)
+		require.True(t, exists)
+		objects := []string{drv.output("out").Path + ".output"}
+		for _, entry := range toc {
+			objects = append(objects, entry.Body...)
+		}
+		return objects
+	}
+	keptObjects, cachedObjects := cacheObjects(kept), cacheObjects(cached)
+
+	result, err := s.CollectGarbage(ctx, gcRoots(kept), GCOptions{})
+	require.NoError(t, err)
+	require.ElementsMatch(t,
+		append([]string{cached.Filename(), cached.output("out").Path}, cachedObjects...),
+		result.Removed)
+	for _, name := range keptObjects {
+		require.FileExists(t, s.joinStorePath(name))
+	}
+}
+
+func TestStore_CollectGarbageKeepCache(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	cached := buildFetchDerivation(t, s, "cached", "cached")
+	require.NoError(t, s.uploadToCache(ctx, []Derivation{cached}, nil, localCache{store: s}, ioutil.Discard))
+	toc, exists, err := s.cachedOutputTOC(cached.output("out").Path)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	result, err := s.CollectGarbage(ctx, nil, GCOptions{KeepCache: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{cached.output("out").Path}, result.Removed)
+
+	// The cache can still serve the derivation and its output
+	require.FileExists(t, s.joinStorePath(cached.Filename()))
+	require.FileExists(t, s.joinStorePath(cached.output("out").Path+".output"))
+	for _, entry := range toc {
+		for _, chunk := range entry.Body {
+			require.FileExists(t, s.joinStorePath(chunk))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/maxmcd/bramble/internal/logger"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Bramble processes that share a BRAMBLE_PATH coordinate with advisory file
+// locks in var/locks. Processes that write to the store hold a shared lock on
+// the store while they write and garbage collection holds an exclusive one.
+// Each derivation is built while holding an exclusive lock on that
+// derivation, so a second process waits for the build to finish and uses its
+// outputs.
+//
+// These are flock(2) locks rather than the fcntl locks used for the config
+// because the store lock must be shareable, and flock locks also exclude
+// goroutines in the same process that open the lock file separately.
+
+const (
+	storeLockName = "store.lock"
+	// lockPollInterval is how often a lock that is held by another process
+	// is tried again
+	lockPollInterval = 50 * time.Millisecond
+)
+
+// Lock takes a shared lock on the store so that garbage collection waits
+// until unlock is called. Callers that add several things to the store, like
+// sources and then the outputs built from them, hold it throughout so that
+// nothing is collected in between.
+func (s *Store) Lock(ctx context.Context) (unlock func() error, err error) {
+	return s.lockStore(ctx, false)
+}
+
+// lockStore takes a shared lock on the store, or an exclusive lock if
+// exclusive is true.
+func (s *Store) lockStore(ctx context.Context, exclusive bool) (unlock func() error, err error) {
+	return s.lockFile(ctx, storeLockName, exclusive, "the store to be released by another bramble process")
+}
+
+// lockDerivation takes an exclusive lock on building a derivation.
+func (s *Store) lockDerivation(ctx context.Context, filename string) (unlock func() error, err error) {
+	return s.lockFile(ctx, filename+".lock", true, "another bramble process to finish building "+filename)
+}
+
+// lockFile locks a file in var/locks, waiting until it's available or the
+// context is cancelled. waitingFor is printed if the lock isn't available
+// right away.
+func (s *Store) lockFile(ctx context.Context, name string, exclusive bool, waitingFor string) (unlock func() error, err error) {
+	location := s.joinBramblePath("var", "locks", name)
+	f, err := os.OpenFile(location, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening lock file")
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	waiting := false
+	for {
+		err = unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			return f.Close, nil
+		}
+		if err != unix.EWOULDBLOCK {
+			_ = f.Close()
+			return nil, errors.Wrapf(err, "error locking %q", location)
+		}
+		if !waiting {
+			waiting = true
+			logger.Print("Waiting for " + waitingFor)
+		}
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// removeLockFiles removes the derivation lock files in var/locks. It must only
+// be called while holding an exclusive lock on the store, when no derivations
+// can be building.
+func (s *Store) removeLockFiles() (err error) {
+	dir := s.joinBramblePath("var", "locks")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.Name() == storeLockName {
+			continue
+		}
+		if err := os.Remove(s.joinBramblePath("var", "locks", file.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
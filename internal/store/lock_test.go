@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_concurrentBuilds(t *testing.T) {
+	bramblePath := test.TmpDir(t)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// Give the other builds time to wait for this one
+		time.Sleep(100 * time.Millisecond)
+		_, _ = rw.Write([]byte("shared"))
+	}))
+	t.Cleanup(server.Close)
+
+	// Each store stands in for a separate bramble process
+	const processes = 4
+	var wg sync.WaitGroup
+	outputs := make([]string, processes)
+	builds := make([]bool, processes)
+	errs := make([]error, processes)
+	for i := 0; i < processes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := NewStore(bramblePath)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			drv, didBuild, err := s.NewBuilder(testLockfileWriter{}).BuildDerivation(context.Background(), Derivation{
+				Name:        "shared",
+				Builder:     "basic_fetch_url",
+				OutputNames: []string{"out"},
+				Env:         map[string]string{"url": server.URL + "/shared"},
+			}, BuildDerivationOptions{})
+			outputs[i], builds[i], errs[i] = drv.output("out").Path, didBuild, err
+		}(i)
+	}
+	wg.Wait()
+	built := 0
+	for i := 0; i < processes; i++ {
+		require.NoError(t, errs[i])
+		require.Equal(t, outputs[0], outputs[i])
+		if builds[i] {
+			built++
+		}
+	}
+	require.Equal(t, 1, built, "the derivation is only built once")
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestStore_CollectGarbageWaitsForBuilds(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	unlock, err := s.lockBuild(ctx, Derivation{Name: "building"})
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := s.CollectGarbage(ctx, nil, GCOptions{})
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("garbage collection didn't wait for the build")
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlock()
+	require.NoError(t, <-done)
+
+	// Builds wait for garbage collection as well
+	unlockStore, err := s.lockStore(ctx, true)
+	require.NoError(t, err)
+	timeout, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = s.lockBuild(timeout, Derivation{Name: "building"})
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.NoError(t, unlockStore())
+}
+
+func TestStore_LockKeepsSources(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	unlock, err := s.Lock(ctx)
+	require.NoError(t, err)
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	source, err := s.StoreLocalSources(ctx, SourceFiles{
+		ProjectLocation: wd,
+		Location:        wd,
+		Files:           []string{"lock_test.go"},
+	})
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := s.CollectGarbage(ctx, nil, GCOptions{})
+		done <- err
+	}()
+	// A build can take its own lock while the store is locked
+	unlockBuild, err := s.lockBuild(ctx, Derivation{Name: "building"})
+	require.NoError(t, err)
+	unlockBuild()
+	select {
+	case <-done:
+		t.Fatal("garbage collection didn't wait for the store to be unlocked")
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.DirExists(t, s.joinStorePath(source.Path))
+	require.NoError(t, unlock())
+	require.NoError(t, <-done)
+	// Nothing uses the sources, so they're collected once the store is
+	// unlocked
+	require.NoDirExists(t, s.joinStorePath(source.Path))
+}
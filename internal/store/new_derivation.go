@@ -37,13 +37,53 @@ func (s *Store) StoreLocalSources(ctx context.Context, sources SourceFiles) (out
 	if len(sources.Files) == 0 {
 		return
 	}
+	unlock, err := s.lockStore(ctx, false)
+	if err != nil {
+		return
+	}
+	defer func() { _ = unlock() }()
 	// TODO: could extend reptar to handle hashing the files before moving them
 	// to a tempdir
 	tmpDir, err := s.storeLengthTempDir()
 	if err != nil {
 		return
 	}
+	if out, err = copyLocalSources(sources, tmpDir); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return Source{}, err
+	}
+	storeLocation := s.joinStorePath(out.Path)
+	if fileutil.PathExists(storeLocation) {
+		err = os.RemoveAll(tmpDir)
+	} else if err = os.Rename(tmpDir, storeLocation); err != nil {
+		// Another process might have added the same sources
+		if !fileutil.DirExists(storeLocation) {
+			return
+		}
+		err = os.RemoveAll(tmpDir)
+	}
+	return
+}
+
+// HashLocalSources returns the source that StoreLocalSources would return
+// without writing anything to the store.
+func (s *Store) HashLocalSources(ctx context.Context, sources SourceFiles) (out Source, err error) {
+	_, span := tracer.Start(ctx, "store.HashLocalSources")
+	defer span.End()
+
+	if len(sources.Files) == 0 {
+		return
+	}
+	tmpDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	return copyLocalSources(sources, tmpDir)
+}
 
+// copyLocalSources copies source files into dir and hashes them
+func copyLocalSources(sources SourceFiles, dir string) (out Source, err error) {
 	if !filepath.IsAbs(sources.ProjectLocation) {
 		return Source{}, errors.New("Project location must be absolute")
 	}
@@ -70,30 +110,20 @@ func (s *Store) StoreLocalSources(ctx context.Context, sources SourceFiles) (out
 		return
 	}
 
-	if err = fileutil.CopyFilesByPath(prefix, files, tmpDir); err != nil {
+	if err = fileutil.CopyFilesByPath(prefix, files, dir); err != nil {
 		err = errors.Wrap(err, "error copying files from source into temp folder")
 		return
 	}
 	// sometimes the location the derivation runs from is not present
 	// in the structure of the copied source files. ensure that we add it
-	runLocation := filepath.Join(tmpDir, relBramblefileLocation)
+	runLocation := filepath.Join(dir, relBramblefileLocation)
 	if err = os.MkdirAll(runLocation, 0755); err != nil {
 		return
 	}
 	hshr := hasher.New()
-	if err = reptar.Reptar(tmpDir, hshr); err != nil {
+	if err = reptar.Reptar(dir, hshr); err != nil {
 		return
 	}
-	storeLocation := s.joinStorePath(hshr.String())
-	if fileutil.PathExists(storeLocation) {
-		if err = os.RemoveAll(tmpDir); err != nil {
-			return
-		}
-	} else {
-		if err = os.Rename(tmpDir, storeLocation); err != nil {
-			return
-		}
-	}
 	out.Path = hshr.String()
 	out.RelativeBuildPath = relBramblefileLocation
 	return
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStore_StoreLocalSources(t *testing.T) {
@@ -51,3 +52,24 @@ func TestStore_StoreLocalSources(t *testing.T) {
 		})
 	}
 }
+
+func TestStore_HashLocalSources(t *testing.T) {
+	store, err := NewStore(test.TmpDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := filepath.Abs("./")
+	sources := SourceFiles{
+		ProjectLocation: filepath.Dir(wd),
+		Location:        wd,
+		Files:           []string{"store/new_derivation_test.go"},
+	}
+	hashed, err := store.HashLocalSources(context.Background(), sources)
+	require.NoError(t, err)
+	require.NoDirExists(t, store.joinStorePath(hashed.Path))
+
+	stored, err := store.StoreLocalSources(context.Background(), sources)
+	require.NoError(t, err)
+	require.Equal(t, stored, hashed)
+	require.DirExists(t, store.joinStorePath(hashed.Path))
+}
@@ -0,0 +1,289 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/maxmcd/bramble/pkg/hasher"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Identical files in store outputs are replaced with hard links to a single
+// copy in the .links directory of the store. Every file in an optimised output
+// is linked and made read-only so that writing to one link can't change the
+// others. Directories are left writable so that outputs can still be removed.
+//
+// Files in .links are named with the hash of their contents and the
+// permissions they had before they were made read-only. Output hashes include
+// file permissions, so the original permissions are restored when an output
+// is normalized to be hashed or uploaded.
+
+const linksDirectory = ".links"
+
+type OptimiseResult struct {
+	// Files is the number of files that were checked
+	Files int
+	// Linked is the number of files that were replaced with a hard link
+	Linked int
+	// BytesSaved is the total size of the files that were replaced
+	BytesSaved int64
+}
+
+// Optimise replaces identical files in the outputs in the store with hard
+// links.
+func (s *Store) Optimise(ctx context.Context) (result OptimiseResult, err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.Optimise")
+	defer span.End()
+
+	unlock, err := s.lockStore(ctx, false)
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = unlock() }()
+
+	derivations, err := s.allDerivations()
+	if err != nil {
+		return result, err
+	}
+	modes, err := s.linkedFileModes()
+	if err != nil {
+		return result, err
+	}
+	seen := map[string]struct{}{}
+	for _, drv := range derivations {
+		for _, output := range drv.Outputs {
+			if _, ok := seen[output.Path]; ok || output.Path == "" {
+				continue
+			}
+			seen[output.Path] = struct{}{}
+			if _, err := os.Stat(s.joinStorePath(output.Path)); os.IsNotExist(err) {
+				// Missing outputs are reported by "bramble store verify"
+				continue
+			}
+			if err := s.optimiseOutput(output.Path, modes, &result); err != nil {
+				return result, errors.Wrapf(err, "error optimising output %s", output.Path)
+			}
+		}
+	}
+	return result, nil
+}
+
+// optimiseOutput makes the files in an output read-only and links them into
+// .links, files that are already in .links are replaced with hard links. modes
+// are the original permissions of the files in .links by inode, new links are
+// added to it.
+func (s *Store) optimiseOutput(outputPath string, modes map[uint64]os.FileMode, result *OptimiseResult) (err error) {
+	links := s.joinStorePath(linksDirectory)
+	if err := os.MkdirAll(links, 0755); err != nil {
+		return err
+	}
+	return filepath.Walk(s.joinStorePath(outputPath), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		result.Files++
+		if _, linked := modes[inode(fi)]; linked {
+			return nil
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		if linkCount(fi) > 1 {
+			// The file might have been linked by another process
+			if linked, err := findLink(links, hash, fi, modes); err != nil || linked {
+				return err
+			}
+		}
+		link := filepath.Join(links, fmt.Sprintf("%s-%o", hash, fi.Mode().Perm()))
+		linkFi, err := os.Lstat(link)
+		if os.IsNotExist(err) {
+			// This is the first copy of the file, it's only read-only if it's
+			// linked so that its permissions can be restored
+			if err := os.Chmod(path, fi.Mode().Perm()&^0222); err != nil {
+				return err
+			}
+			if err := os.Link(path, link); err != nil {
+				_ = os.Chmod(path, fi.Mode().Perm())
+				if os.IsExist(err) {
+					// Another process linked the same file
+					return nil
+				}
+				return err
+			}
+			modes[inode(fi)] = fi.Mode().Perm()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Link to a temporary file and rename it over the file so that the file
+		// is never missing
+		tmp := filepath.Join(filepath.Dir(path), ".tmp-link-"+randStringBytes(8))
+		if err := os.Link(link, tmp); err != nil {
+			if errors.Is(err, syscall.EMLINK) || os.IsPermission(err) {
+				// The file has too many links or the directory isn't writable,
+				// it keeps its permissions because they can't be restored
+				return nil
+			}
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		modes[inode(linkFi)] = fi.Mode().Perm()
+		result.Linked++
+		result.BytesSaved += fi.Size()
+		return nil
+	})
+}
+
+// findLink returns true if a file is already linked to a file in .links with
+// the passed hash, the link is added to modes.
+func findLink(links, hash string, fi os.FileInfo, modes map[uint64]os.FileMode) (linked bool, err error) {
+	matches, err := filepath.Glob(filepath.Join(links, hash+"-*"))
+	if err != nil {
+		return false, err
+	}
+	for _, match := range matches {
+		linkFi, err := os.Lstat(match)
+		if err != nil {
+			return false, err
+		}
+		if !os.SameFile(fi, linkFi) {
+			continue
+		}
+		mode, err := linkMode(filepath.Base(match))
+		if err != nil {
+			return false, err
+		}
+		modes[inode(fi)] = mode
+		return true, nil
+	}
+	return false, nil
+}
+
+// pruneLinks removes files in .links that are no longer linked to by an
+// output.
+func (s *Store) pruneLinks() (err error) {
+	links := s.joinStorePath(linksDirectory)
+	files, err := os.ReadDir(links)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fi, err := file.Info()
+		if err != nil {
+			return err
+		}
+		if linkCount(fi) == 1 {
+			if err := os.Remove(filepath.Join(links, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreLinkedFileModes sets the permissions of the files in a copy of an
+// output to the permissions that the linked files in the output had before
+// they were optimised. modes is the result of linkedFileModes.
+func (s *Store) restoreLinkedFileModes(outputPath, copyLocation string, modes map[uint64]os.FileMode) (err error) {
+	if len(modes) == 0 {
+		return nil
+	}
+	location := s.joinStorePath(outputPath)
+	return filepath.Walk(location, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || linkCount(fi) == 1 {
+			return err
+		}
+		mode, found := modes[inode(fi)]
+		if !found {
+			return nil
+		}
+		rel, err := filepath.Rel(location, path)
+		if err != nil {
+			return err
+		}
+		return os.Chmod(filepath.Join(copyLocation, rel), mode)
+	})
+}
+
+// linkedFileModes returns the original permissions of each file in .links by
+// inode.
+func (s *Store) linkedFileModes() (modes map[uint64]os.FileMode, err error) {
+	modes = map[uint64]os.FileMode{}
+	links := s.joinStorePath(linksDirectory)
+	files, err := os.ReadDir(links)
+	if os.IsNotExist(err) {
+		return modes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		mode, err := linkMode(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Lstat(filepath.Join(links, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		modes[inode(fi)] = mode
+	}
+	return modes, nil
+}
+
+// linkMode parses the original permissions of a file in .links from its name
+func linkMode(name string) (mode os.FileMode, err error) {
+	perm, err := strconv.ParseUint(name[strings.LastIndex(name, "-")+1:], 8, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error parsing permissions of link %q", name)
+	}
+	return os.FileMode(perm), nil
+}
+
+// inode returns the inode number of a file
+func inode(fi os.FileInfo) uint64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// linkCount returns the number of hard links to a file
+func linkCount(fi os.FileInfo) uint64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
+
+func hashFile(path string) (hash string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hshr := hasher.New()
+	if _, err := io.Copy(hshr, f); err != nil {
+		return "", err
+	}
+	return hshr.String(), nil
+}
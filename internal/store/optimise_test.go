@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+// outputFiles returns the regular files in an output
+func outputFiles(t *testing.T, s *Store, drv Derivation) (files []string) {
+	require.NoError(t, filepath.Walk(s.joinStorePath(drv.output("out").Path), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return err
+	}))
+	return files
+}
+
+func TestStore_Optimise(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	a := buildFetchDerivation(t, s, "a", "shared")
+	b := buildFetchDerivation(t, s, "b", "shared")
+	require.NotEqual(t, a.output("out").Path, b.output("out").Path)
+	aFiles, bFiles := outputFiles(t, s, a), outputFiles(t, s, b)
+	require.Len(t, aFiles, 1)
+	require.Len(t, bFiles, 1)
+	// Empty files and files that already have more than one link are linked
+	// too
+	c := buildFetchDerivation(t, s, "c", "")
+	d := buildFetchDerivation(t, s, "d", "")
+	cFiles, dFiles := outputFiles(t, s, c), outputFiles(t, s, d)
+	extraLink := filepath.Join(t.TempDir(), "a")
+	require.NoError(t, os.Link(aFiles[0], extraLink))
+
+	result, err := s.Optimise(ctx)
+	require.NoError(t, err)
+	require.Equal(t, OptimiseResult{Files: 4, Linked: 2, BytesSaved: int64(len("shared"))}, result)
+
+	for _, files := range [][]string{{aFiles[0], bFiles[0]}, {cFiles[0], dFiles[0]}} {
+		fi, err := os.Stat(files[0])
+		require.NoError(t, err)
+		other, err := os.Stat(files[1])
+		require.NoError(t, err)
+		require.True(t, os.SameFile(fi, other))
+		require.Zero(t, fi.Mode().Perm()&0222, "optimised files are read-only")
+	}
+
+	// Optimising again doesn't change anything
+	result, err = s.Optimise(ctx)
+	require.NoError(t, err)
+	require.Zero(t, result.Linked)
+
+	// Optimised outputs still match their hash
+	verified, err := s.Verify(ctx, VerifyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, verified.Problems)
+
+	// Links are removed once no output uses them
+	require.NoError(t, os.Remove(extraLink))
+	_, err = s.CollectGarbage(ctx, nil, GCOptions{})
+	require.NoError(t, err)
+	links, err := ioutil.ReadDir(s.joinStorePath(linksDirectory))
+	require.NoError(t, err)
+	require.Empty(t, links)
+}
+
+func TestStore_AutoOptimise(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	s.AutoOptimise = true
+
+	a := buildFetchDerivation(t, s, "a", "shared")
+	b := buildFetchDerivation(t, s, "b", "shared")
+	aFi, err := os.Stat(outputFiles(t, s, a)[0])
+	require.NoError(t, err)
+	bFi, err := os.Stat(outputFiles(t, s, b)[0])
+	require.NoError(t, err)
+	require.True(t, os.SameFile(aFi, bFi))
+}
@@ -0,0 +1,300 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Relocate moves the bramble directory, and the store within it, to
+// bramblePath. The store directory is padded so that the store path has the
+// same length wherever it is, so references to the old store path in outputs
+// are rewritten in place with references to the new one. Derivations only
+// reference outputs by their hash, so they don't need to change.
+//
+// If bramblePath is on a different filesystem the bramble directory is
+// copied, and the original is only removed once the copy has been verified.
+// If relocation fails the store is moved back. If that fails too the
+// relocated store is returned and the error says where the store was left.
+// The relocated store is returned along with the result of verifying it.
+func (s *Store) Relocate(ctx context.Context, bramblePath string) (relocated *Store, result VerifyResult, err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.Relocate")
+	defer span.End()
+
+	if !filepath.IsAbs(bramblePath) {
+		return nil, result, errors.Errorf("bramble path %s must be absolute", bramblePath)
+	}
+	bramblePath = filepath.Clean(bramblePath)
+	if fileutil.PathExists(bramblePath) {
+		return nil, result, errors.Errorf("won't relocate the store to %q, a file already exists at that location", bramblePath)
+	}
+	if err := fileutil.PathWithinDir(s.BramblePath, bramblePath); err == nil {
+		return nil, result, errors.New("can't relocate the store to a path inside the bramble directory")
+	}
+	storeDirectoryName, err := calculatePaddedDirectoryName(bramblePath, PathPaddingLength)
+	if err != nil {
+		return nil, result, err
+	}
+	relocated = &Store{
+		BramblePath:     bramblePath,
+		StorePath:       filepath.Join(bramblePath, storeDirectoryName),
+		AutoOptimise:    s.AutoOptimise,
+		derivationCache: newDerivationsMap(),
+	}
+
+	unlock, err := s.lockStore(ctx, true)
+	if err != nil {
+		return nil, result, err
+	}
+	copied, err := s.relocate(relocated)
+	// The relocated store must be unlocked before it can be verified
+	_ = unlock()
+	if err != nil {
+		if fileutil.DirExists(relocated.BramblePath) {
+			return relocated, result, err
+		}
+		return nil, result, err
+	}
+	if result, err = relocated.Verify(ctx, VerifyOptions{}); err != nil {
+		return relocated, result, err
+	}
+	if copied {
+		if len(result.Problems) > 0 {
+			return relocated, result, errors.Errorf(
+				"found %d problems in the copy of the store, the original store at %q wasn't removed",
+				len(result.Problems), s.BramblePath)
+		}
+		if err := os.RemoveAll(s.BramblePath); err != nil {
+			return relocated, result, errors.Wrap(err, "error removing the original store")
+		}
+	}
+	return relocated, result, nil
+}
+
+// relocate moves the bramble directory to the location of relocated and
+// rewrites references to the old store path. copied is true if the bramble
+// directory had to be copied. If rewriting fails the copy is removed, or the
+// bramble directory is moved back and references to the new store path are
+// rewritten again.
+func (s *Store) relocate(relocated *Store) (copied bool, err error) {
+	if err := os.Rename(s.BramblePath, relocated.BramblePath); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return false, errors.Wrap(err, "error moving the bramble directory")
+		}
+		if err := copyPreservingLinks(s.BramblePath, relocated.BramblePath); err != nil {
+			_ = os.RemoveAll(relocated.BramblePath)
+			return false, errors.Wrap(err, "error copying the bramble directory")
+		}
+		copied = true
+	}
+	err = relocated.relocateFrom(s)
+	if err == nil {
+		return copied, nil
+	}
+	err = errors.Wrap(err, "error relocating the store")
+	if copied {
+		if rmErr := os.RemoveAll(relocated.BramblePath); rmErr != nil {
+			return copied, errors.Wrapf(err, "the incomplete copy of the store at %q couldn't be removed", relocated.BramblePath)
+		}
+		return copied, err
+	}
+	if mvErr := os.Rename(relocated.BramblePath, s.BramblePath); mvErr != nil {
+		return copied, errors.Wrapf(err, "the store couldn't be moved back, it's at %q", relocated.BramblePath)
+	}
+	if undoErr := s.relocateFrom(relocated); undoErr != nil {
+		return copied, errors.Wrapf(err, "the store was moved back to %q but it couldn't be restored: %v", s.BramblePath, undoErr)
+	}
+	return copied, errors.Wrapf(err, "the store was moved back to %q", s.BramblePath)
+}
+
+// relocateFrom moves the store directory of from, which has been moved along
+// with the bramble directory, to the store path and rewrites references to
+// the store path of from.
+func (s *Store) relocateFrom(from *Store) (err error) {
+	if err := s.moveStoreDirectory(strings.TrimPrefix(from.StorePath, from.BramblePath)); err != nil {
+		return err
+	}
+	derivations, err := s.allDerivations()
+	if err != nil {
+		return err
+	}
+	seen := map[string]struct{}{}
+	for _, drv := range derivations {
+		for _, output := range drv.Outputs {
+			if _, ok := seen[output.Path]; ok || output.Path == "" {
+				continue
+			}
+			seen[output.Path] = struct{}{}
+			location := s.joinStorePath(output.Path)
+			if !fileutil.DirExists(location) {
+				// Missing outputs are reported when the store is verified
+				continue
+			}
+			// Linked files are shared between outputs, they're only rewritten
+			// the first time because the old store path is gone after that
+			if err := s.relocateOutput(location, output, from.StorePath, s.StorePath); err != nil {
+				return errors.Wrapf(err, "error relocating output %s", output.Path)
+			}
+		}
+	}
+	if err := s.renameLinks(); err != nil {
+		return err
+	}
+	return s.relocateRoots(from.StorePath)
+}
+
+// moveStoreDirectory moves the store directory, which was at oldName within
+// the bramble directory, to the store path and updates the store symlink.
+// Empty padding directories of the old store directory are removed. A store
+// directory that was only partly moved by an earlier call is moved the rest
+// of the way.
+func (s *Store) moveStoreDirectory(oldName string) (err error) {
+	storeDirectoryName := strings.TrimPrefix(s.StorePath, s.BramblePath)
+	if oldName != storeDirectoryName {
+		// The new store directory could be inside of the old one, or the other
+		// way around, so move the store out of the way first
+		tmp := s.joinBramblePath("store.relocating")
+		if !fileutil.DirExists(tmp) {
+			if err := os.Rename(s.joinBramblePath(oldName), tmp); err != nil {
+				return errors.Wrap(err, "error moving the store directory")
+			}
+		}
+		for dir := filepath.Dir(s.joinBramblePath(oldName)); dir != s.BramblePath; dir = filepath.Dir(dir) {
+			if err := os.Remove(dir); err != nil {
+				break
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(s.StorePath), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, s.StorePath); err != nil {
+			return errors.Wrap(err, "error moving the store directory")
+		}
+	}
+	link := s.joinBramblePath("store")
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink("."+storeDirectoryName, link)
+}
+
+// renameLinks renames the files in .links that were changed by relocation so
+// that they're named with the hash of their new contents.
+func (s *Store) renameLinks() (err error) {
+	links := s.joinStorePath(linksDirectory)
+	files, err := os.ReadDir(links)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		hash, err := hashFile(filepath.Join(links, name))
+		if err != nil {
+			return err
+		}
+		perm := name[strings.LastIndex(name, "-")+1:]
+		if newName := fmt.Sprintf("%s-%s", hash, perm); newName != name {
+			if err := os.Rename(filepath.Join(links, name), filepath.Join(links, newName)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// relocateRoots points root links that point into the old store path at the
+// same output in the store.
+func (s *Store) relocateRoots(oldStorePath string) (err error) {
+	reg := s.joinBramblePath("var/gc-roots")
+	files, err := ioutil.ReadDir(reg)
+	if err != nil {
+		return errors.Wrap(err, "error listing gc roots")
+	}
+	for _, f := range files {
+		link, err := os.Readlink(filepath.Join(reg, f.Name()))
+		if err != nil {
+			return err
+		}
+		target, err := os.Readlink(link)
+		if err != nil || filepath.Dir(target) != oldStorePath {
+			// Stale roots are removed during the next gc
+			continue
+		}
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+		if err := os.Symlink(s.joinStorePath(filepath.Base(target)), link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyPreservingLinks copies the directory src to dst. Files that are hard
+// linked to each other in src are hard linked to each other in dst.
+func copyPreservingLinks(src, dst string) (err error) {
+	copies := map[uint64]string{}
+	var dirs []string
+	if err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			// Permissions are set once the directory is populated in case
+			// it's read-only
+			dirs = append(dirs, path)
+			return os.Mkdir(target, 0755)
+		case fi.Mode()&os.ModeSymlink != 0:
+			return fileutil.CopySymLink(path, target)
+		case fi.Mode().IsRegular():
+			ino := fi.Sys().(*syscall.Stat_t).Ino
+			if existing, ok := copies[ino]; ok {
+				return os.Link(existing, target)
+			}
+			if linkCount(fi) > 1 {
+				copies[ino] = target
+			}
+			if err := fileutil.CopyFile(path, target); err != nil {
+				return err
+			}
+			return os.Chmod(target, fi.Mode().Perm())
+		}
+		// Sockets and other special files, like those of a running server,
+		// aren't copied
+		return nil
+	}); err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Stat(dirs[i])
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, dirs[i])
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(filepath.Join(dst, rel), fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_Relocate(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	runtimeDep := buildFetchDerivation(t, s, "runtime", "runtime")
+	root := buildFetchDerivation(t, s, "root",
+		"I reference "+s.joinStorePath(runtimeDep.output("out").Path), runtimeDep)
+	// An identical output so that relocation rewrites a linked file
+	copied := buildFetchDerivation(t, s, "copied",
+		"I reference "+s.joinStorePath(runtimeDep.output("out").Path), runtimeDep)
+	_, err = s.Optimise(ctx)
+	require.NoError(t, err)
+	link := filepath.Join(test.TmpDir(t), "result")
+	require.NoError(t, s.AddRoot(link, root, "out"))
+
+	// A longer path so that the store directory has different padding
+	bramblePath := filepath.Join(test.TmpDir(t), "a", "much", "longer", "path")
+	require.NoError(t, os.MkdirAll(filepath.Dir(bramblePath), 0755))
+	relocated, result, err := s.Relocate(ctx, bramblePath)
+	require.NoError(t, err)
+	require.Empty(t, result.Problems)
+	require.NoDirExists(t, s.BramblePath)
+	require.Equal(t, len(s.StorePath), len(relocated.StorePath))
+
+	expected := "I reference " + relocated.joinStorePath(runtimeDep.output("out").Path)
+	for _, drv := range []Derivation{root, copied} {
+		files := outputFiles(t, relocated, drv)
+		require.Len(t, files, 1)
+		b, err := ioutil.ReadFile(files[0])
+		require.NoError(t, err)
+		require.Equal(t, expected, string(b))
+	}
+
+	storeLink, err := filepath.EvalSymlinks(relocated.joinBramblePath("store"))
+	require.NoError(t, err)
+	require.Equal(t, relocated.StorePath, storeLink)
+	roots, err := relocated.Roots()
+	require.NoError(t, err)
+	require.Equal(t, []Root{{Link: link, Path: root.output("out").Path}}, roots)
+
+	// The relocated store can be opened and optimised again
+	reopened, err := NewStore(bramblePath)
+	require.NoError(t, err)
+	require.Equal(t, relocated.StorePath, reopened.StorePath)
+	optimised, err := reopened.Optimise(ctx)
+	require.NoError(t, err)
+	require.Zero(t, optimised.Linked)
+}
+
+func TestCopyPreservingLinks(t *testing.T) {
+	src := test.TmpDir(t)
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a"), []byte("a"), 0444))
+	require.NoError(t, os.Link(filepath.Join(src, "a"), filepath.Join(src, "dir", "b")))
+	require.NoError(t, os.Symlink("a", filepath.Join(src, "c")))
+
+	dst := filepath.Join(test.TmpDir(t), "dst")
+	require.NoError(t, copyPreservingLinks(src, dst))
+	a, err := os.Stat(filepath.Join(dst, "a"))
+	require.NoError(t, err)
+	b, err := os.Stat(filepath.Join(dst, "dir", "b"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(a, b))
+	require.Equal(t, os.FileMode(0444), a.Mode().Perm())
+	target, err := os.Readlink(filepath.Join(dst, "c"))
+	require.NoError(t, err)
+	require.Equal(t, "a", target)
+}
+
+func TestStore_RelocateFailure(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	runtimeDep := buildFetchDerivation(t, s, "runtime", "runtime")
+	root := buildFetchDerivation(t, s, "root",
+		"I reference "+s.joinStorePath(runtimeDep.output("out").Path), runtimeDep)
+
+	bramblePath := filepath.Join(test.TmpDir(t), "a", "much", "longer", "path")
+	require.NoError(t, os.MkdirAll(filepath.Dir(bramblePath), 0755))
+	storeDirectoryName, err := calculatePaddedDirectoryName(bramblePath, PathPaddingLength)
+	require.NoError(t, err)
+	// A file where the new store directory would be makes moving it fail
+	blocker := s.joinBramblePath(storeDirectoryName)
+	require.NoError(t, os.MkdirAll(filepath.Dir(blocker), 0755))
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+
+	relocated, _, err := s.Relocate(ctx, bramblePath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("moved back to %q", s.BramblePath))
+	require.Nil(t, relocated)
+	require.NoDirExists(t, bramblePath)
+
+	// The original store is intact
+	files := outputFiles(t, s, root)
+	require.Len(t, files, 1)
+	b, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	require.Equal(t, "I reference "+s.joinStorePath(runtimeDep.output("out").Path), string(b))
+	result, err := s.Verify(ctx, VerifyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, result.Problems)
+}
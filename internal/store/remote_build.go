@@ -0,0 +1,267 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/maxmcd/bramble/internal/types"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/pkg/httpx"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RemoteBuilder builds derivations on another machine. Build inputs are
+// uploaded to its cache before a build and outputs are downloaded from its
+// cache afterwards.
+type RemoteBuilder interface {
+	CacheClient
+	Substituter
+	Build(ctx context.Context, req BuildRequest, logs io.Writer) (drv Derivation, err error)
+}
+
+// BuildRequest asks a build server to build a derivation. Inputs are the
+// derivation source and the outputs it needs to build, they must already be in
+// the build server's cache.
+type BuildRequest struct {
+	Derivation Derivation
+	Inputs     []Output
+}
+
+// BuildMessage is sent by the build server as newline delimited json while a
+// derivation builds. Log messages are followed by a single message with either
+// the built derivation or an error.
+type BuildMessage struct {
+	Log        string      `json:",omitempty"`
+	Derivation *Derivation `json:",omitempty"`
+	Error      string      `json:",omitempty"`
+}
+
+// BuildServerInfo describes the derivations a build server can build.
+type BuildServerInfo struct {
+	Platform string
+	// Workers is the number of derivations the server builds at once
+	Workers int
+}
+
+// localBuildOnly returns an error if the derivation must be built locally.
+// Fetch derivations write to the lockfile and can't be checked remotely.
+func (drv Derivation) localBuildOnly() error {
+	if drv.Builder == "basic_fetch_url" ||
+		drv.Env["confirm_fetch_url"] == "true" ||
+		drv.Env["confirm_fetch_git"] == "true" {
+		return errors.Errorf("derivation %s fetches files and must be built locally", drv.Name)
+	}
+	return nil
+}
+
+// buildRemotely uploads the inputs of a derivation to a remote builder, builds
+// it there and then downloads its outputs into the store.
+func (b *Builder) buildRemotely(ctx context.Context, rb RemoteBuilder, drv Derivation, opts BuildDerivationOptions) (_ Derivation, err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.buildRemotely")
+	defer span.End()
+	span.SetAttributes(attribute.String("name", drv.Name))
+
+	dependencies, inputs, err := b.store.remoteBuildInputs(drv)
+	if err != nil {
+		return drv, err
+	}
+	// Dependencies are uploaded with their outputs because the builder needs
+	// them to find references to their outputs
+	var source []Output
+	if drv.Source.Path != "" {
+		source = append(source, Output{Path: drv.Source.Path})
+	}
+	if err := b.store.uploadToCache(ctx, dependencies, source, rb, ioutil.Discard); err != nil {
+		return drv, errors.Wrap(err, "error uploading build inputs")
+	}
+
+	// Logs are always kept so that they can be attached to a build error,
+	// verbose builds print them as well
+	f, err := os.CreateTemp("", "")
+	if err != nil {
+		return drv, err
+	}
+	defer func() {
+		if _, ok := err.(ExecError); ok {
+			// The logs are read from the error
+			return
+		}
+		_ = f.Close()
+		if rmErr := os.Remove(f.Name()); err == nil {
+			err = rmErr
+		}
+	}()
+	var logs io.Writer = f
+	if opts.Verbose {
+		var stdout io.Writer = os.Stdout
+		if opts.Stdout != nil {
+			stdout = opts.Stdout
+		}
+		logs = io.MultiWriter(stdout, f)
+	}
+	if opts.Logs != nil {
+		logs = io.MultiWriter(logs, opts.Logs)
+	}
+	built, err := rb.Build(ctx, BuildRequest{Derivation: drv, Inputs: inputs}, logs)
+	if err != nil {
+		return drv, ExecError{Err: err, Logs: f}
+	}
+	if built.Filename() != drv.Filename() {
+		return drv, errors.Errorf("build server returned derivation %s when %s was built", built.Filename(), drv.Filename())
+	}
+	if built.missingOutput() || len(built.Outputs) != len(drv.OutputNames) {
+		return drv, errors.Errorf("build server returned derivation %s without its outputs", drv.Filename())
+	}
+	found, err := b.substituteOutputs(ctx, rb, built.Outputs)
+	if err != nil {
+		return drv, errors.Wrap(err, "error downloading build outputs")
+	}
+	if !found {
+		return drv, errors.New("build outputs are missing from the build server's cache")
+	}
+	drv.Outputs = built.Outputs
+	return drv, nil
+}
+
+// remoteBuildInputs returns everything a derivation needs to be built in
+// another store: its dependencies along with their runtime dependencies, and
+// inputs, which are its source and the outputs of those dependencies.
+func (s *Store) remoteBuildInputs(drv Derivation) (closure []Derivation, inputs []Output, err error) {
+	var dependencies []Derivation
+	for _, do := range drv.Dependencies {
+		dep, found, err := s.LoadDerivation(do.Filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !found {
+			return nil, nil, errors.Errorf("derivation not found with name %s", do.Filename)
+		}
+		dependencies = append(dependencies, dep)
+	}
+	if closure, err = s.RuntimeClosure(dependencies); err != nil {
+		return nil, nil, err
+	}
+	for _, dep := range closure {
+		inputs = append(inputs, dep.Outputs...)
+	}
+	if drv.Source.Path != "" {
+		// Sources are hashed like outputs without any dependencies
+		inputs = append(inputs, Output{Path: drv.Source.Path})
+	}
+	return closure, inputs, nil
+}
+
+// unarchiveCachedOutputs moves outputs from the store's cache into the store.
+func (s *Store) unarchiveCachedOutputs(outputs []Output) (err error) {
+	for _, output := range outputs {
+		if err := validCacheName(output.Path); err != nil {
+			return err
+		}
+		if fileutil.DirExists(s.joinStorePath(output.Path)) {
+			continue
+		}
+		toc, exists, err := s.cachedOutputTOC(output.Path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.Errorf("input %s is not in the cache", output.Path)
+		}
+		if err := s.unarchiveSubstitutedOutput(toc, &storeHashFetcher{store: s}, output); err != nil {
+			return errors.Wrapf(err, "error unarchiving input %s", output.Path)
+		}
+	}
+	return nil
+}
+
+// BuildServer returns a handler that builds derivations for remote builders.
+// Build inputs are taken from the store's cache and outputs are added to it so
+// that the client can download them, the cache server must be served from the
+// same store. At most workers derivations are built at once.
+func (s *Store) BuildServer(workers int) http.Handler {
+	builder := s.NewBuilder(nil)
+	sem := make(chan struct{}, workers)
+	router := httpx.New()
+	router.GET("/info", func(c httpx.Context) (err error) {
+		return c.JSON(BuildServerInfo{Platform: types.Platform(), Workers: workers})
+	})
+	router.POST("/derivation", func(c httpx.Context) (err error) {
+		var req BuildRequest
+		if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+			return httpx.ErrNotAcceptable(err)
+		}
+		drv := req.Derivation
+		drv.store = s
+		if err := drv.localBuildOnly(); err != nil {
+			return httpx.ErrUnprocessableEntity(err)
+		}
+		if drv.Platform != "" && drv.Platform != types.Platform() {
+			return httpx.ErrUnprocessableEntity(errors.Errorf(
+				"derivation %s is for platform %s, this server builds %s",
+				drv.Name, drv.Platform, types.Platform()))
+		}
+		ctx := c.Request.Context()
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-sem }()
+		if err := s.unarchiveCachedOutputs(req.Inputs); err != nil {
+			return httpx.ErrUnprocessableEntity(err)
+		}
+
+		c.ResponseWriter.Header().Set("Content-Type", "application/x-ndjson")
+		mw := &buildMessageWriter{w: c.ResponseWriter, enc: json.NewEncoder(c.ResponseWriter)}
+		built, _, err := builder.BuildDerivation(ctx, drv, BuildDerivationOptions{Logs: mw})
+		if er, ok := errors.Cause(err).(ExecError); ok && er.Logs != nil {
+			// The logs have already been sent to the client
+			_ = er.Logs.Close()
+			_ = os.Remove(er.Logs.Name())
+		}
+		if err == nil {
+			// Add the outputs to the cache so that the client can fetch them
+			err = s.uploadToCache(ctx, []Derivation{built}, nil, localCache{store: s}, ioutil.Discard)
+		}
+		// The response has started, so errors are sent as messages
+		if err != nil {
+			return mw.send(BuildMessage{Error: err.Error()})
+		}
+		return mw.send(BuildMessage{Derivation: &built})
+	})
+	return router
+}
+
+// buildMessageWriter sends everything written to it as log messages
+type buildMessageWriter struct {
+	w    http.ResponseWriter
+	enc  *json.Encoder
+	lock sync.Mutex
+}
+
+func (mw *buildMessageWriter) Write(b []byte) (n int, err error) {
+	if err := mw.send(BuildMessage{Log: string(b)}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (mw *buildMessageWriter) send(msg BuildMessage) (err error) {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	if err := mw.enc.Encode(msg); err != nil {
+		return err
+	}
+	if f, ok := mw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
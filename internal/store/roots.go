@@ -0,0 +1,125 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/pkg/hasher"
+	"github.com/pkg/errors"
+)
+
+// Root is a symlink outside of the store that points at a build output. Roots
+// are registered under var/gc-roots so that garbage collection won't delete
+// the output, or anything the output needs at runtime.
+type Root struct {
+	// Link is the absolute path of the symlink
+	Link string
+	// Path is the name of the store output the link points to. It is empty if
+	// the link no longer exists or no longer points into the store.
+	Path string
+}
+
+// Stale returns true if the root no longer points to a store output.
+func (r Root) Stale() bool { return r.Path == "" }
+
+func (s *Store) rootRegistryPath(link string) string {
+	return s.joinBramblePath("var/gc-roots", hasher.HashString(link))
+}
+
+// AddRoot creates a symlink at link that points to the store output of the
+// derivation and registers the link as a garbage collection root. An existing
+// symlink at link is replaced, but any other existing file is not.
+func (s *Store) AddRoot(link string, drv Derivation, outputName string) (err error) {
+	if link, err = filepath.Abs(link); err != nil {
+		return err
+	}
+	output := drv.output(outputName)
+	if output.Path == "" {
+		return errors.Errorf("derivation %s has no built output %q", drv.Name, outputName)
+	}
+	if fi, err := os.Lstat(link); err == nil {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return errors.Errorf("can't create link at %q, a file already exists at that location", link)
+		}
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink(s.joinStorePath(output.Path), link); err != nil {
+		return err
+	}
+	registryPath := s.rootRegistryPath(link)
+	_ = os.Remove(registryPath)
+	return os.Symlink(link, registryPath)
+}
+
+// Roots lists all registered garbage collection roots.
+func (s *Store) Roots() (roots []Root, err error) {
+	reg := s.joinBramblePath("var/gc-roots")
+	files, err := ioutil.ReadDir(reg)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing gc roots")
+	}
+	for _, f := range files {
+		link, err := os.Readlink(filepath.Join(reg, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, Root{Link: link, Path: s.rootPath(link)})
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Link < roots[j].Link })
+	return roots, nil
+}
+
+// rootPath returns the store output that a root link points to, or an empty
+// string if it doesn't point to one.
+func (s *Store) rootPath(link string) string {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return ""
+	}
+	if filepath.Dir(target) != s.StorePath {
+		return ""
+	}
+	path := filepath.Base(target)
+	if strings.HasSuffix(path, ".drv") || !fileutil.DirExists(target) {
+		return ""
+	}
+	return path
+}
+
+// RemoveRoot removes a garbage collection root. The link is deleted if it
+// still points into the store.
+func (s *Store) RemoveRoot(link string) (err error) {
+	if link, err = filepath.Abs(link); err != nil {
+		return err
+	}
+	registryPath := s.rootRegistryPath(link)
+	if _, err := os.Lstat(registryPath); err != nil {
+		return errors.Errorf("%q is not a registered root", link)
+	}
+	if s.rootPath(link) != "" {
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	}
+	return os.Remove(registryPath)
+}
+
+// removeStaleRoots removes registry entries for roots that no longer point to
+// a store output.
+func (s *Store) removeStaleRoots(roots []Root) (err error) {
+	for _, root := range roots {
+		if !root.Stale() {
+			continue
+		}
+		if err := os.Remove(s.rootRegistryPath(root.Link)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
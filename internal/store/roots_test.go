@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_Roots(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv := buildFetchDerivation(t, s, "rooted", "rooted")
+	link := filepath.Join(test.TmpDir(t), "result")
+
+	require.NoError(t, s.AddRoot(link, drv, "out"))
+	// Adding the same link again replaces it
+	require.NoError(t, s.AddRoot(link, drv, "out"))
+	roots, err := s.Roots()
+	require.NoError(t, err)
+	require.Equal(t, []Root{{Link: link, Path: drv.output("out").Path}}, roots)
+
+	target, err := os.Readlink(link)
+	require.NoError(t, err)
+	require.Equal(t, s.joinStorePath(drv.output("out").Path), target)
+
+	require.NoError(t, s.RemoveRoot(link))
+	require.False(t, fileutil.PathExists(link))
+	roots, err = s.Roots()
+	require.NoError(t, err)
+	require.Len(t, roots, 0)
+	require.Error(t, s.RemoveRoot(link))
+
+	// Don't overwrite regular files
+	require.NoError(t, os.WriteFile(link, nil, 0644))
+	require.Error(t, s.AddRoot(link, drv, "out"))
+}
+
+func TestStore_CollectGarbageRoots(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtimeDep := buildFetchDerivation(t, s, "runtime", "runtime")
+	buildDep := buildFetchDerivation(t, s, "build", "build")
+	root := buildFetchDerivation(t, s, "root",
+		"I reference "+s.joinStorePath(runtimeDep.output("out").Path),
+		runtimeDep, buildDep)
+
+	dir := test.TmpDir(t)
+	link := filepath.Join(dir, "result")
+	staleLink := filepath.Join(dir, "stale")
+	require.NoError(t, s.AddRoot(link, root, "out"))
+	require.NoError(t, s.AddRoot(staleLink, buildDep, "out"))
+	require.NoError(t, os.Remove(staleLink))
+
+	result, err := s.CollectGarbage(context.Background(), nil, GCOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{staleLink}, result.StaleRoots)
+	// The build dependency is only needed to build, so it is removed
+	require.ElementsMatch(t, []string{buildDep.Filename(), buildDep.output("out").Path}, result.Removed)
+	for _, drv := range []Derivation{runtimeDep, root} {
+		for _, path := range []string{drv.Filename(), drv.output("out").Path} {
+			require.True(t, fileutil.PathExists(s.joinStorePath(path)), path)
+		}
+	}
+	roots, err := s.Roots()
+	require.NoError(t, err)
+	require.Equal(t, []Root{{Link: link, Path: root.output("out").Path}}, roots)
+}
@@ -0,0 +1,171 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Keys and signatures are formatted as "<key name>:<base64 value>". The key
+// name is included in signatures so that we know which key to verify a
+// signature with.
+
+// GenerateSigningKey generates an ed25519 key pair that can be used to sign
+// derivations that are uploaded to a cache.
+func GenerateSigningKey(name string) (secretKey, publicKey string, err error) {
+	if name == "" || strings.Contains(name, ":") {
+		return "", "", errors.Errorf("invalid key name %q, names can't be blank or contain a colon", name)
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return formatKey(name, private), formatKey(name, public), nil
+}
+
+func formatKey(name string, key []byte) string {
+	return name + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func parseKey(key string, size int) (name string, value []byte, err error) {
+	i := strings.Index(key, ":")
+	if i <= 0 {
+		return "", nil, errors.Errorf("key %q is not in the format <name>:<base64 value>", key)
+	}
+	name = key[:i]
+	value, err = base64.StdEncoding.DecodeString(strings.TrimSpace(key[i+1:]))
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "error decoding key %q", name)
+	}
+	if len(value) != size {
+		return "", nil, errors.Errorf("key %q has length %d, expected %d", name, len(value), size)
+	}
+	return name, value, nil
+}
+
+// fingerprint is the value that is signed. It ties the derivation filename to
+// the output paths, output paths are content addressed so the output contents
+// can be verified with the hash.
+func (drv Derivation) fingerprint() string {
+	var sb strings.Builder
+	sb.WriteString("bramble-1;")
+	sb.WriteString(drv.Filename())
+	for i, output := range drv.Outputs {
+		name := ""
+		if i < len(drv.OutputNames) {
+			name = drv.OutputNames[i]
+		}
+		fmt.Fprintf(&sb, ";%s:%s:%s", name, output.Path, strings.Join(output.Dependencies, ","))
+	}
+	return sb.String()
+}
+
+// signDerivation adds a signature to the derivation, an existing signature
+// from the same key is replaced.
+func signDerivation(drv Derivation, secretKey string) (Derivation, error) {
+	if drv.missingOutput() {
+		return drv, errors.Errorf("can't sign derivation %s, it doesn't have outputs", drv.Name)
+	}
+	name, key, err := parseKey(secretKey, ed25519.PrivateKeySize)
+	if err != nil {
+		return drv, err
+	}
+	signature := formatKey(name, ed25519.Sign(ed25519.PrivateKey(key), []byte(drv.fingerprint())))
+	signatures := []string{signature}
+	for _, sig := range drv.Signatures {
+		if !strings.HasPrefix(sig, name+":") {
+			signatures = append(signatures, sig)
+		}
+	}
+	sort.Strings(signatures)
+	drv.Signatures = signatures
+	return drv, nil
+}
+
+// SignDerivation signs a derivation with a secret key created by
+// GenerateSigningKey and writes the signed derivation to the store.
+func (s *Store) SignDerivation(drv Derivation, secretKey string) (signed Derivation, err error) {
+	if signed, err = signDerivation(drv, secretKey); err != nil {
+		return drv, err
+	}
+	if _, err := s.WriteDerivation(signed); err != nil {
+		return drv, err
+	}
+	signed.store = s
+	s.derivationCache.Store(signed)
+	return signed, nil
+}
+
+// mergeSignatures adds the signatures of existing to drv if they sign the same
+// outputs. Signatures in drv take precedence over signatures from the same
+// key in existing.
+func mergeSignatures(drv, existing Derivation) Derivation {
+	if drv.fingerprint() != existing.fingerprint() {
+		return drv
+	}
+	names := map[string]struct{}{}
+	for _, sig := range drv.Signatures {
+		names[strings.SplitN(sig, ":", 2)[0]] = struct{}{}
+	}
+	signatures := append([]string{}, drv.Signatures...)
+	for _, sig := range existing.Signatures {
+		if _, ok := names[strings.SplitN(sig, ":", 2)[0]]; !ok {
+			signatures = append(signatures, sig)
+		}
+	}
+	sort.Strings(signatures)
+	drv.Signatures = signatures
+	return drv
+}
+
+type trustedKeys map[string]ed25519.PublicKey
+
+func parseTrustedKeys(keys []string) (trustedKeys, error) {
+	tk := trustedKeys{}
+	for _, key := range keys {
+		name, value, err := parseKey(key, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing trusted public key")
+		}
+		tk[name] = ed25519.PublicKey(value)
+	}
+	return tk, nil
+}
+
+// errUntrusted is returned when a derivation isn't signed by a trusted key
+var errUntrusted = errors.New("derivation is not signed by a trusted key")
+
+// verify checks that the derivation has a valid signature from one of the
+// trusted keys. Invalid signatures are ignored if another trusted key has
+// signed the derivation. errUntrusted is returned if there are no signatures
+// from trusted keys, any other error means every signature from a trusted key
+// is invalid.
+func (tk trustedKeys) verify(drv Derivation) error {
+	fingerprint := []byte(drv.fingerprint())
+	var invalid []string
+	for _, signature := range drv.Signatures {
+		i := strings.Index(signature, ":")
+		if i <= 0 {
+			continue
+		}
+		key, ok := tk[signature[:i]]
+		if !ok {
+			continue
+		}
+		_, sig, err := parseKey(signature, ed25519.SignatureSize)
+		if err != nil || !ed25519.Verify(key, fingerprint, sig) {
+			invalid = append(invalid, signature[:i])
+			continue
+		}
+		return nil
+	}
+	if len(invalid) > 0 {
+		return errors.Errorf("derivation %s has invalid signatures from trusted keys %q", drv.Filename(), invalid)
+	}
+	return errUntrusted
+}
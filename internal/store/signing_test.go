@@ -0,0 +1,70 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignDerivation(t *testing.T) {
+	drv := Derivation{
+		Name:        "signed",
+		Builder:     "basic_fetch_url",
+		OutputNames: []string{"out"},
+		Outputs:     []Output{{Path: "dg7bzrrzd4guscofsaypbcqqfjp5xldo"}},
+	}
+	_, err := signDerivation(drv, "")
+	require.Error(t, err)
+
+	secretKey, publicKey, err := GenerateSigningKey("test-1")
+	require.NoError(t, err)
+	otherSecretKey, otherPublicKey, err := GenerateSigningKey("test-2")
+	require.NoError(t, err)
+
+	signed, err := signDerivation(drv, secretKey)
+	require.NoError(t, err)
+	require.Equal(t, drv.Filename(), signed.Filename(), "signatures aren't part of the hash")
+
+	// Signing again with the same key replaces the signature
+	signed, err = signDerivation(signed, secretKey)
+	require.NoError(t, err)
+	signed, err = signDerivation(signed, otherSecretKey)
+	require.NoError(t, err)
+	require.Len(t, signed.Signatures, 2)
+
+	tk, err := parseTrustedKeys([]string{publicKey})
+	require.NoError(t, err)
+	require.NoError(t, tk.verify(signed))
+	require.Equal(t, errUntrusted, tk.verify(drv))
+
+	otherTK, err := parseTrustedKeys([]string{otherPublicKey})
+	require.NoError(t, err)
+	require.NoError(t, otherTK.verify(signed))
+
+	// Changing the outputs invalidates the signature
+	tampered := signed
+	tampered.Outputs = []Output{{Path: "5fbuwtuoaoqmvosfdrxxbzjfngmqfnrb"}}
+	require.Error(t, tk.verify(tampered))
+	require.NotEqual(t, errUntrusted, tk.verify(tampered))
+
+	// An invalid signature is ignored when another trusted key has signed
+	bothTK, err := parseTrustedKeys([]string{publicKey, otherPublicKey})
+	require.NoError(t, err)
+	signedTampered, err := signDerivation(tampered, secretKey)
+	require.NoError(t, err)
+	oneBad := signed
+	oneBad.Signatures = []string{signedTampered.Signatures[0], signed.Signatures[1]}
+	require.Error(t, tk.verify(oneBad))
+	require.NoError(t, bothTK.verify(oneBad))
+
+	// Signatures from other keys are kept when merging
+	onlyOther, err := signDerivation(drv, otherSecretKey)
+	require.NoError(t, err)
+	onlyFirst, err := signDerivation(drv, secretKey)
+	require.NoError(t, err)
+	require.Equal(t, signed.Signatures, mergeSignatures(onlyFirst, onlyOther).Signatures)
+	require.Equal(t, onlyFirst.Signatures, mergeSignatures(onlyFirst, tampered).Signatures)
+
+	_, err = parseTrustedKeys([]string{"test-1:nope"})
+	require.Error(t, err)
+}
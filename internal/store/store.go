@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -48,6 +47,9 @@ func NewStore(bramblePath string) (*Store, error) {
 type Store struct {
 	BramblePath string
 	StorePath   string
+	// AutoOptimise replaces identical files in new build outputs with hard
+	// links, as if "bramble store optimise" was run after every build
+	AutoOptimise bool
 
 	derivationCache *derivationsMap
 }
@@ -194,7 +196,7 @@ func ensureBramblePath(s *Store, bramblePath string) (err error) {
 		if err = os.MkdirAll(s.StorePath, 0755); err != nil {
 			return err
 		}
-		if err = os.Symlink("."+storeDirectoryName, s.joinBramblePath("store")); err != nil {
+		if err = os.Symlink("."+storeDirectoryName, s.joinBramblePath("store")); err != nil && !os.IsExist(err) {
 			return err
 		}
 	}
@@ -206,13 +208,21 @@ func ensureBramblePath(s *Store, bramblePath string) (err error) {
 		// they're not wiped during GC
 		"var/config-registry",
 
+		// Symlinks to out-links that point to build outputs that should not be
+		// wiped during GC
+		"var/gc-roots",
+
 		// Dependency metadata
 		"var/dependencies",
+
+		// Lock files that coordinate bramble processes sharing the store
+		"var/locks",
 	}
 
 	for _, folder := range folders {
 		if _, ok := fileMap[folder]; !ok {
-			if err = os.Mkdir(s.joinBramblePath(folder), 0755); err != nil {
+			// Another process might be creating the folders as well
+			if err = os.Mkdir(s.joinBramblePath(folder), 0755); err != nil && !os.IsExist(err) {
 				return errors.Wrap(err, fmt.Sprintf("error creating bramble folder %q", folder))
 			}
 		}
@@ -316,104 +326,316 @@ func calculatePaddedDirectoryName(bramblePath string, paddingLength int) (storeD
 func (s *Store) WriteDerivation(drv Derivation) (filename string, err error) {
 	drv = formatDerivation(drv)
 	filename = drv.Filename()
-	fileLocation := s.joinStorePath(filename)
-	return filename, ioutil.WriteFile(fileLocation, drv.JSON(), 0644)
+	// Write to a temporary file first so that other processes never read a
+	// partially written derivation
+	f, err := s.storeLengthTempFile()
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(drv.JSON()); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return filename, os.Rename(f.Name(), s.joinStorePath(filename))
 }
 
 type CacheClient interface {
 	PostChunk(context.Context, io.Reader) (string, error)
 	PostDerivation(context.Context, Derivation) (string, error)
 	PostOutput(context.Context, OutputRequestBody) error
+	// Missing takes lists of chunk hashes, output paths and derivation
+	// filenames and returns the ones the cache doesn't have
+	Missing(context.Context, CacheObjects) (CacheObjects, error)
+}
+
+// CacheObjects lists objects that can be stored in a cache
+type CacheObjects struct {
+	Chunks      []string
+	Outputs     []string
+	Derivations []string
+}
+
+// chunkLocation is the location of a chunk within a file
+type chunkLocation struct {
+	file   string
+	offset int64
+	size   int64
 }
 
-func (s *Store) UploadDerivationsToCache(ctx context.Context, derivations []Derivation, cc CacheClient) (err error) {
+type UploadOptions struct {
+	// Progress is where a summary of what is uploaded is written, nothing is
+	// written if it's nil
+	Progress io.Writer
+}
+
+// UploadDerivationsToCache uploads derivations and their outputs to a cache.
+// Everything is hashed locally first so that only the chunks, outputs and
+// derivations that the cache doesn't have are uploaded.
+func (s *Store) UploadDerivationsToCache(ctx context.Context, derivations []Derivation, cc CacheClient, opts UploadOptions) (err error) {
 	var span trace.Span
 	ctx, span = tracer.Start(ctx, "store.UploadDerivationsToCache")
 	defer span.End()
-	var cancel func()
-	ctx, cancel = context.WithCancel(ctx)
-	defer cancel()
+	progress := opts.Progress
+	if progress == nil {
+		progress = ioutil.Discard
+	}
+	return s.uploadToCache(ctx, derivations, nil, cc, progress)
+}
+
+// uploadToCache uploads derivations and their outputs, along with any extra
+// outputs, to a cache. A summary of what is uploaded is written to progress.
+func (s *Store) uploadToCache(ctx context.Context, derivations []Derivation, extraOutputs []Output, cc CacheClient, progress io.Writer) (err error) {
 
+	var chunksLock sync.Mutex
+	chunks := map[string]chunkLocation{}
 	bodyWriter := chunkedarchive.NewParallelBodyWriter(
-		8,
+		runtime.NumCPU(),
 		func(rc io.ReadCloser) (out []string, err error) {
+			defer rc.Close()
+			f, ok := rc.(interface{ Name() string })
+			if !ok {
+				return nil, errors.New("archive body must be a file")
+			}
 			buf := bufio.NewReader(rc)
+			var offset int64
 			for {
-				// TODO: hash the body before uploading to confirm it doesn't already exist
-				limited := io.LimitReader(buf, 4e6)
-				hash, err := cc.PostChunk(ctx, limited)
+				h := hasher.New()
+				size, err := io.Copy(h, io.LimitReader(buf, 4e6))
 				if err != nil {
 					return nil, err
 				}
+				hash := h.String()
+				chunksLock.Lock()
+				chunks[hash] = chunkLocation{file: f.Name(), offset: offset, size: size}
+				chunksLock.Unlock()
 				out = append(out, hash)
-				fmt.Println("Finished uploading chunk", hash)
+				offset += size
 				if _, err := buf.Peek(1); err != nil {
 					break
 				}
 			}
-			return out, rc.Close()
+			return out, nil
 		},
 	)
 
-	uploaded := map[string]struct{}{}
-	errChan := make(chan error)
-	doneChan := make(chan struct{})
-	sem := make(chan struct{}, runtime.NumCPU())
-	var wg sync.WaitGroup
-
-	// Loop through derivations
+	// Normalize and archive every output so that we know the hash of every
+	// chunk
+	var (
+		normalizedDerivations []Derivation
+		outputs               []OutputRequestBody
+		seen                  = map[string]struct{}{}
+		// locations are the normalized copies of each output
+		locations []string
+	)
+	defer func() {
+		for _, location := range locations {
+			_ = os.RemoveAll(location)
+		}
+	}()
+	modes, err := s.linkedFileModes()
+	if err != nil {
+		return err
+	}
+	archiveOutput := func(output Output) error {
+		if _, ok := seen[output.Path]; ok {
+			return nil
+		}
+		seen[output.Path] = struct{}{}
+		// Upload the output with references to the store replaced with
+		// the prefix of record so that it can be used by other stores
+		location, err := s.normalizedOutputCopy(output, modes)
+		if err != nil {
+			return err
+		}
+		// Chunks are read from the copy, so it's removed once they're uploaded
+		locations = append(locations, location)
+		toc, err := chunkedarchive.Archive(bodyWriter, location)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, OutputRequestBody{TOC: toc, Output: output})
+		return nil
+	}
 	for _, drv := range derivations {
 		// Normalize them with the fixed prefix path
 		normalized, err := s.normalizeDerivation(drv)
 		if err != nil {
 			return err
 		}
-		// Upload, could confirm hash
-		if _, err := cc.PostDerivation(ctx, normalized); err != nil {
-			return err
-		}
-		// Loop through outputs and post them
+		normalizedDerivations = append(normalizedDerivations, normalized)
 		for _, output := range normalized.Outputs {
-			if _, ok := uploaded[output.Path]; ok {
-				continue
+			if err := archiveOutput(output); err != nil {
+				return err
 			}
-			uploaded[output.Path] = struct{}{}
-			wg.Add(1)
-			go func(output Output) {
-				// Limit parallelism
-				sem <- struct{}{}
-				defer func() { <-sem }()
-				// This will upload using the spawned queue in parallel
-				toc, err := chunkedarchive.Archive(bodyWriter, s.joinStorePath(output.Path))
-				if err != nil {
-					errChan <- err
-				}
+		}
+	}
+	for _, output := range extraOutputs {
+		if err := archiveOutput(output); err != nil {
+			return err
+		}
+	}
 
-				if err := cc.PostOutput(ctx, OutputRequestBody{
-					TOC:    toc,
-					Output: output,
-				}); err != nil {
-					errChan <- err
+	query := CacheObjects{}
+	for hash := range chunks {
+		query.Chunks = append(query.Chunks, hash)
+	}
+	for _, output := range outputs {
+		query.Outputs = append(query.Outputs, output.Output.Path)
+	}
+	for _, drv := range normalizedDerivations {
+		query.Derivations = append(query.Derivations, drv.Filename())
+	}
+	missing, err := cc.Missing(ctx, query)
+	if err != nil {
+		return errors.Wrap(err, "error checking cache contents")
+	}
+	fmt.Fprintf(progress, "Uploading %d of %d chunks, %d of %d outputs and %d of %d derivations\n",
+		len(missing.Chunks), len(query.Chunks),
+		len(missing.Outputs), len(query.Outputs),
+		len(missing.Derivations), len(query.Derivations))
+
+	// Chunks are uploaded before outputs so that the cache can assemble the
+	// output, and outputs are uploaded before derivations so that a
+	// derivation is never available without its outputs
+	missingChunks := map[string]struct{}{}
+	for _, hash := range missing.Chunks {
+		missingChunks[hash] = struct{}{}
+	}
+	for i, output := range outputs {
+		// Chunks are uploaded with the first output that contains them. They're
+		// read from the copy of the last output that contains them, so that
+		// copy hasn't been removed yet.
+		var outputChunks []string
+		for _, entry := range output.TOC {
+			for _, hash := range entry.Body {
+				if _, ok := missingChunks[hash]; ok {
+					outputChunks = append(outputChunks, hash)
+					delete(missingChunks, hash)
 				}
-				wg.Done()
-			}(output)
+			}
+		}
+		if err := inParallel(ctx, outputChunks, func(ctx context.Context, hash string) error {
+			return s.uploadChunk(ctx, cc, hash, chunks[hash])
+		}); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(locations[i]); err != nil {
+			return err
+		}
+	}
+	missingOutputs := map[string]struct{}{}
+	for _, path := range missing.Outputs {
+		missingOutputs[path] = struct{}{}
+	}
+	for _, output := range outputs {
+		if _, ok := missingOutputs[output.Output.Path]; !ok {
+			continue
+		}
+		if err := cc.PostOutput(ctx, output); err != nil {
+			return errors.Wrapf(err, "error uploading output %s", output.Output.Path)
 		}
 	}
+	missingDerivations := map[string]struct{}{}
+	for _, filename := range missing.Derivations {
+		missingDerivations[filename] = struct{}{}
+	}
+	for _, drv := range normalizedDerivations {
+		// Signed derivations are always uploaded so that the cache has the
+		// latest signatures
+		if _, ok := missingDerivations[drv.Filename()]; !ok && len(drv.Signatures) == 0 {
+			continue
+		}
+		if _, err := cc.PostDerivation(ctx, drv); err != nil {
+			return errors.Wrapf(err, "error uploading derivation %s", drv.Filename())
+		}
+	}
+	return nil
+}
 
-	go func() {
-		wg.Wait()
-		doneChan <- struct{}{}
-	}()
+func (s *Store) uploadChunk(ctx context.Context, cc CacheClient, hash string, loc chunkLocation) (err error) {
+	f, err := os.Open(loc.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	uploaded, err := cc.PostChunk(ctx, io.NewSectionReader(f, loc.offset, loc.size))
+	if err != nil {
+		return errors.Wrapf(err, "error uploading chunk %s", hash)
+	}
+	if uploaded != "" && uploaded != hash {
+		return errors.Errorf("cache returned hash %s for chunk %s", uploaded, hash)
+	}
+	return nil
+}
+
+// inParallel calls fn for every value with limited parallelism and
+// returns the first error
+func inParallel(ctx context.Context, values []string, fn func(context.Context, string) error) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errChan := make(chan error, len(values))
+	sem := make(chan struct{}, 8)
+	var wg sync.WaitGroup
+	for _, value := range values {
+		wg.Add(1)
+		go func(value string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+			if err := fn(ctx, value); err != nil {
+				errChan <- err
+				cancel()
+			}
+		}(value)
+	}
+	wg.Wait()
 	select {
 	case err := <-errChan:
 		return err
-	case <-doneChan:
+	default:
 		return nil
 	}
 }
 
+// RuntimeClosure returns the passed derivations along with every derivation
+// whose outputs they need at runtime.
+func (s *Store) RuntimeClosure(derivations []Derivation) (closure []Derivation, err error) {
+	seen := map[string]struct{}{}
+	for _, drv := range derivations {
+		drv.store = s
+		graph, err := drv.RuntimeDependencyGraph()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error calculating runtime dependencies of %s", drv.Filename())
+		}
+		for _, v := range graph.Vertices() {
+			do := v.(DerivationOutput)
+			if _, ok := seen[do.Filename]; ok {
+				continue
+			}
+			seen[do.Filename] = struct{}{}
+			dep, found, err := s.LoadDerivation(do.Filename)
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				return nil, errors.Errorf("derivation not found with name %s", do.Filename)
+			}
+			closure = append(closure, dep)
+		}
+	}
+	return closure, nil
+}
+
 type S3CacheClient struct {
-	s3 *simples3.S3
+	s3     *simples3.S3
+	bucket string
 }
 
 type fakeSizeSeeker struct {
@@ -440,23 +662,14 @@ func (fss fakeSizeSeeker) Read(p []byte) (n int, err error) { return fss.buf.Rea
 
 var _ CacheClient = new(S3CacheClient)
 
-func NewS3CacheClient(s3 *simples3.S3) CacheClient {
-	return &S3CacheClient{s3: s3}
+// NewS3CacheClient returns a cache client that uploads to a bucket with an S3
+// compatible api. Objects are public so that the bucket can be used as a
+// substituter.
+func NewS3CacheClient(s3 *simples3.S3, bucket string) CacheClient {
+	return &S3CacheClient{s3: s3, bucket: bucket}
 }
 
 func fileUpload(s3 *simples3.S3, body *bytes.Buffer, ui simples3.UploadInput) error {
-	checkIt := "https://store.bramble.run/" + ui.ObjectKey
-	resp, err := http.Head(checkIt)
-	if err != nil {
-		return err
-	}
-	switch resp.StatusCode {
-	case http.StatusNotFound:
-	case http.StatusOK:
-		return nil
-	default:
-		return errors.Errorf("unexpected response code %d for url %q", resp.StatusCode, checkIt)
-	}
 	// TODO: Could reduce memory overhead here
 	buf := &bytes.Buffer{}
 	w := gzip.NewWriter(buf)
@@ -481,6 +694,36 @@ func fileUpload(s3 *simples3.S3, body *bytes.Buffer, ui simples3.UploadInput) er
 	return nil
 }
 
+// Missing checks for the existence of each object with a HEAD request. Any
+// error is treated as a missing object, if something is actually wrong it will
+// be reported when we try to upload the object.
+func (cc *S3CacheClient) Missing(ctx context.Context, objects CacheObjects) (missing CacheObjects, err error) {
+	var lock sync.Mutex
+	check := func(prefix string, keys []string, out *[]string) error {
+		return inParallel(ctx, keys, func(ctx context.Context, key string) error {
+			if _, err := cc.s3.FileDetails(simples3.DetailsInput{
+				Bucket:    cc.bucket,
+				ObjectKey: prefix + key,
+			}); err != nil {
+				lock.Lock()
+				*out = append(*out, key)
+				lock.Unlock()
+			}
+			return nil
+		})
+	}
+	for _, err := range []error{
+		check("chunk/", objects.Chunks, &missing.Chunks),
+		check("output/", objects.Outputs, &missing.Outputs),
+		check("derivation/", objects.Derivations, &missing.Derivations),
+	} {
+		if err != nil {
+			return missing, err
+		}
+	}
+	return missing, nil
+}
+
 func (cc *S3CacheClient) PostChunk(ctx context.Context, r io.Reader) (string, error) {
 	var buf bytes.Buffer
 	h := hasher.New()
@@ -489,7 +732,7 @@ func (cc *S3CacheClient) PostChunk(ctx context.Context, r io.Reader) (string, er
 		return "", err
 	}
 	err := fileUpload(cc.s3, &buf, simples3.UploadInput{
-		Bucket:      "bramble",
+		Bucket:      cc.bucket,
 		ACL:         "public-read",
 		ObjectKey:   "chunk/" + h.String(),
 		FileName:    h.String(),
@@ -500,7 +743,7 @@ func (cc *S3CacheClient) PostChunk(ctx context.Context, r io.Reader) (string, er
 func (cc *S3CacheClient) PostDerivation(ctx context.Context, drv Derivation) (string, error) {
 	filename := drv.Filename()
 	err := fileUpload(cc.s3, bytes.NewBuffer([]byte(drv.JSON())), simples3.UploadInput{
-		Bucket:      "bramble",
+		Bucket:      cc.bucket,
 		ACL:         "public-read",
 		ObjectKey:   "derivation/" + drv.Filename(),
 		FileName:    drv.Filename(),
@@ -509,12 +752,13 @@ func (cc *S3CacheClient) PostDerivation(ctx context.Context, drv Derivation) (st
 	return filename, err
 }
 func (cc *S3CacheClient) PostOutput(ctx context.Context, req OutputRequestBody) error {
+	// Only the TOC is uploaded, the output metadata is part of the derivation
 	buf := &bytes.Buffer{}
-	if err := json.NewEncoder(buf).Encode(req); err != nil {
+	if err := json.NewEncoder(buf).Encode(req.TOC); err != nil {
 		return err
 	}
 	err := fileUpload(cc.s3, buf, simples3.UploadInput{
-		Bucket:      "bramble",
+		Bucket:      cc.bucket,
 		ACL:         "public-read",
 		ObjectKey:   "output/" + req.Output.Path,
 		FileName:    req.Output.Path,
@@ -6,7 +6,9 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/maxmcd/bramble/pkg/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_ensureBramblePath(t *testing.T) {
@@ -110,3 +112,23 @@ func Test_calculatePaddedDirectoryName(t *testing.T) {
 		})
 	}
 }
+
+func TestStore_RuntimeClosure(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtimeDep := buildFetchDerivation(t, s, "runtime", "runtime")
+	buildDep := buildFetchDerivation(t, s, "build", "build")
+	root := buildFetchDerivation(t, s, "root",
+		"I reference "+s.joinStorePath(runtimeDep.output("out").Path),
+		runtimeDep, buildDep)
+
+	closure, err := s.RuntimeClosure([]Derivation{root, runtimeDep})
+	require.NoError(t, err)
+	var filenames []string
+	for _, drv := range closure {
+		filenames = append(filenames, drv.Filename())
+	}
+	require.ElementsMatch(t, []string{root.Filename(), runtimeDep.Filename()}, filenames)
+}
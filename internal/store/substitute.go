@@ -0,0 +1,248 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxmcd/bramble/internal/logger"
+	"github.com/maxmcd/bramble/pkg/chunkedarchive"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/pkg/hasher"
+	"github.com/maxmcd/bramble/pkg/textreplace"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Substituter is a binary cache that build outputs can be downloaded from
+// instead of building them locally.
+type Substituter interface {
+	GetDerivation(ctx context.Context, filename string) (drv Derivation, exists bool, err error)
+	GetOutput(ctx context.Context, hash string) (toc []chunkedarchive.TOCEntry, exists bool, err error)
+	GetChunk(ctx context.Context, hash string, chunk io.Writer) (err error)
+}
+
+// substitute attempts to download the outputs of a derivation from the
+// builder's substituters. Derivations must be signed by one of the builder's
+// trusted keys. If no substituter has all of the outputs of the derivation,
+// found is false and the derivation must be built.
+func (b *Builder) substitute(ctx context.Context, drv Derivation) (substituted Derivation, found bool, err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.substitute")
+	defer span.End()
+	span.SetAttributes(attribute.String("name", drv.Name))
+
+	filename := drv.Filename()
+	for _, sub := range b.substituters {
+		remoteDrv, exists, err := sub.GetDerivation(ctx, filename)
+		if err != nil {
+			// A cache being unavailable shouldn't stop us from building
+			logger.Printfln("error fetching derivation %s from cache: %v", filename, err)
+			continue
+		}
+		if !exists || remoteDrv.missingOutput() || len(remoteDrv.Outputs) != len(drv.OutputNames) {
+			continue
+		}
+		remoteDrv.store = b.store
+		if remoteDrv.Filename() != filename {
+			return drv, false, errors.Errorf("cache returned derivation %s when %s was requested", remoteDrv.Filename(), filename)
+		}
+		if err := b.trustedKeys.verify(remoteDrv); err != nil {
+			if err == errUntrusted {
+				logger.Printfln("not using derivation %s from cache: %v", filename, err)
+				continue
+			}
+			return drv, false, err
+		}
+		ok, err := b.substituteOutputs(ctx, sub, remoteDrv.Outputs)
+		if err != nil {
+			return drv, false, errors.Wrapf(err, "error substituting outputs of %s", filename)
+		}
+		if ok {
+			drv.Outputs = remoteDrv.Outputs
+			drv.Signatures = remoteDrv.Signatures
+			return drv, true, nil
+		}
+	}
+	return drv, false, nil
+}
+
+func (b *Builder) substituteOutputs(ctx context.Context, sub Substituter, outputs []Output) (found bool, err error) {
+	for _, output := range outputs {
+		if fileutil.DirExists(b.store.joinStorePath(output.Path)) {
+			continue
+		}
+		// Runtime dependencies are build dependencies, so they should already
+		// be in the store, if they're not we can't use this output
+		for _, dep := range output.Dependencies {
+			if !fileutil.DirExists(b.store.joinStorePath(dep)) {
+				return false, nil
+			}
+		}
+		toc, exists, err := sub.GetOutput(ctx, output.Path)
+		if err != nil {
+			logger.Printfln("error fetching output %s from cache: %v", output.Path, err)
+			return false, nil
+		}
+		if !exists {
+			return false, nil
+		}
+		if err := b.store.unarchiveSubstitutedOutput(toc, &substituterHashFetcher{ctx: ctx, sub: sub}, output); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// unarchiveSubstitutedOutput fetches the chunks of a normalized output,
+// confirms that its contents match its hash and then moves it into the store
+// with references to the prefix of record replaced with references to the
+// local store.
+func (s *Store) unarchiveSubstitutedOutput(toc []chunkedarchive.TOCEntry, hf chunkedarchive.HashFetcher, output Output) (err error) {
+	tempDir, err := s.storeLengthTempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	// Unarchive into a child folder, the temp dir already exists
+	location := filepath.Join(tempDir, "out")
+	if err := chunkedarchive.Unarchive(toc, hf, location); err != nil {
+		return errors.Wrap(err, "error downloading output")
+	}
+	if err := s.hashNormalizedBuildOutput(location, output.Path); err != nil {
+		return err
+	}
+	if err := s.relocateOutput(location, output, BramblePrefixOfRecord, s.StorePath); err != nil {
+		return err
+	}
+	if err := os.Rename(location, s.joinStorePath(output.Path)); err != nil {
+		// Another process might have added the output
+		if fileutil.DirExists(s.joinStorePath(output.Path)) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// relocateOutput replaces the old store prefix with the new store prefix for
+// all references to the output and its runtime dependencies within the files
+// and symlinks in location.
+func (s *Store) relocateOutput(location string, output Output, old, new string) (err error) {
+	values := []string{old + "/" + output.Path}
+	for _, dep := range output.Dependencies {
+		values = append(values, old+"/"+dep)
+	}
+	return filepath.Walk(location, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			replacements, _, err := textreplace.ReplaceStringsPrefix(strings.NewReader(target), &buf, values, old, new)
+			if err != nil || replacements == 0 {
+				return err
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			return os.Symlink(buf.String(), path)
+		case fi.Mode().IsRegular():
+			return s.relocateFile(path, fi, values, old, new)
+		}
+		return nil
+	})
+}
+
+// normalizedOutputCopy copies an output to a temporary directory and replaces
+// references to the local store with the prefix of record. modes is the result
+// of linkedFileModes. The caller is responsible for removing the directory.
+func (s *Store) normalizedOutputCopy(output Output, modes map[uint64]os.FileMode) (location string, err error) {
+	tempDir, err := s.storeLengthTempDir()
+	if err != nil {
+		return "", err
+	}
+	if err := fileutil.CopyDirectory(s.joinStorePath(output.Path), tempDir); err != nil {
+		_ = os.RemoveAll(tempDir)
+		return "", err
+	}
+	if err := s.restoreLinkedFileModes(output.Path, tempDir, modes); err != nil {
+		_ = os.RemoveAll(tempDir)
+		return "", err
+	}
+	if err := s.relocateOutput(tempDir, output, s.StorePath, BramblePrefixOfRecord); err != nil {
+		_ = os.RemoveAll(tempDir)
+		return "", err
+	}
+	return tempDir, nil
+}
+
+func (s *Store) relocateFile(path string, fi os.FileInfo, values []string, old, new string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tmp, err := s.storeLengthTempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	replacements, _, err := textreplace.ReplaceStringsPrefix(f, tmp, values, old, new)
+	if err != nil || replacements == 0 {
+		return err
+	}
+	// Replacements are the same length, so overwrite the file in place to
+	// retain its mode and inode
+	if fi.Mode().Perm()&0200 == 0 {
+		if err := os.Chmod(path, fi.Mode().Perm()|0200); err != nil {
+			return err
+		}
+		defer func() { _ = os.Chmod(path, fi.Mode().Perm()) }()
+	}
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if _, err := io.Copy(dst, tmp); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// substituterHashFetcher fetches chunks from a substituter and confirms that
+// they match their hash
+type substituterHashFetcher struct {
+	ctx context.Context
+	sub Substituter
+}
+
+var _ chunkedarchive.HashFetcher = new(substituterHashFetcher)
+
+func (hf *substituterHashFetcher) Lookup(hash string) (file io.ReadCloser, err error) {
+	var buf bytes.Buffer
+	h := hasher.New()
+	if err := hf.sub.GetChunk(hf.ctx, hash, io.MultiWriter(&buf, h)); err != nil {
+		return nil, errors.Wrapf(err, "error fetching chunk %s", hash)
+	}
+	if h.String() != hash {
+		return nil, errors.Errorf("chunk %s has unexpected hash %s", hash, h.String())
+	}
+	return ioutil.NopCloser(&buf), nil
+}
@@ -0,0 +1,265 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/pkg/hasher"
+	"github.com/maxmcd/bramble/pkg/reptar"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type VerifyOptions struct {
+	// Repair is used to substitute or rebuild outputs that are missing or
+	// corrupted. Nothing is repaired if it's nil.
+	Repair *Builder
+}
+
+type VerifyResult struct {
+	// Checked is the number of derivations, outputs and sources that were
+	// checked
+	Checked int
+	// Problems lists every store path that failed verification
+	Problems []VerifyProblem
+}
+
+// VerifyProblem is a store path that failed verification
+type VerifyProblem struct {
+	// Path is the name of the store path
+	Path string
+	// Derivation is the filename of the derivation that references the path,
+	// if the path isn't a derivation
+	Derivation string
+	Err        error
+	// Repaired is true if the path was repaired
+	Repaired bool
+	// RepairErr is the error from repairing the path, if it couldn't be
+	// repaired
+	RepairErr error
+}
+
+func (p VerifyProblem) String() string {
+	s := p.Path + ": " + p.Err.Error()
+	if p.Derivation != "" {
+		s += " (referenced by " + p.Derivation + ")"
+	}
+	switch {
+	case p.Repaired:
+		s += ", repaired"
+	case p.RepairErr != nil:
+		s += ", couldn't repair: " + p.RepairErr.Error()
+	}
+	return s
+}
+
+// Verify checks that every derivation in the store can be parsed and matches
+// its filename, that the outputs and sources referenced by derivations exist,
+// and that their contents match their hash. Outputs are normalized and hashed
+// the same way they are when they're substituted.
+//
+// If opts.Repair is set derivations that can't be read are removed, they're
+// recreated the next time they're built. Outputs that are missing or
+// corrupted are removed and substituted or built again, sources can't be
+// repaired.
+func (s *Store) Verify(ctx context.Context, opts VerifyOptions) (result VerifyResult, err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.Verify")
+	defer span.End()
+
+	unlock, err := s.lockStore(ctx, false)
+	if err != nil {
+		return result, err
+	}
+	files, err := os.ReadDir(s.StorePath)
+	if err != nil {
+		_ = unlock()
+		return result, errors.Wrap(err, "error listing store")
+	}
+
+	derivations := map[string]Derivation{}
+	outputs := map[string]Output{}
+	sources := map[string]struct{}{}
+	// producers maps outputs and sources to the derivation that references
+	// them
+	producers := map[string]string{}
+	var outputPaths, sourcePaths []string
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".drv") || strings.HasPrefix(name, buildDirPrefix) {
+			continue
+		}
+		result.Checked++
+		drv, err := s.readDerivation(name)
+		if err == nil && drv.Filename() != name {
+			err = errors.Errorf("derivation hashes to %s", drv.Filename())
+		}
+		if err != nil {
+			result.Problems = append(result.Problems, VerifyProblem{Path: name, Err: err})
+			continue
+		}
+		derivations[name] = drv
+		for _, output := range drv.Outputs {
+			if _, seen := outputs[output.Path]; output.Path != "" && !seen {
+				outputs[output.Path] = output
+				producers[output.Path] = name
+				outputPaths = append(outputPaths, output.Path)
+			}
+		}
+		if _, seen := sources[drv.Source.Path]; drv.Source.Path != "" && !seen {
+			sources[drv.Source.Path] = struct{}{}
+			producers[drv.Source.Path] = name
+			sourcePaths = append(sourcePaths, drv.Source.Path)
+		}
+	}
+
+	sort.Strings(outputPaths)
+	sort.Strings(sourcePaths)
+	modes, err := s.linkedFileModes()
+	if err != nil {
+		_ = unlock()
+		return result, err
+	}
+	for _, path := range outputPaths {
+		result.Checked++
+		if err := s.verifyOutput(outputs[path], modes); err != nil {
+			result.Problems = append(result.Problems, VerifyProblem{Path: path, Derivation: producers[path], Err: err})
+		}
+	}
+	for _, path := range sourcePaths {
+		result.Checked++
+		if err := s.verifySource(path); err != nil {
+			result.Problems = append(result.Problems, VerifyProblem{Path: path, Derivation: producers[path], Err: err})
+		}
+	}
+	// Builds take their own lock on the store
+	_ = unlock()
+
+	if opts.Repair == nil {
+		return result, nil
+	}
+	r := storeRepair{
+		store:       s,
+		builder:     opts.Repair,
+		derivations: derivations,
+		broken:      map[string]struct{}{},
+		repaired:    map[string]error{},
+	}
+	for _, problem := range result.Problems {
+		r.broken[problem.Path] = struct{}{}
+	}
+	for i, problem := range result.Problems {
+		_, isSource := sources[problem.Path]
+		switch {
+		case problem.Derivation == "":
+			err = os.Remove(s.joinStorePath(problem.Path))
+		case !isSource:
+			err = r.repair(ctx, problem.Derivation)
+		default:
+			err = errors.New("sources can't be repaired, build the project that uses them again")
+		}
+		result.Problems[i].Repaired = err == nil
+		result.Problems[i].RepairErr = err
+	}
+	return result, nil
+}
+
+// readDerivation parses a derivation file without using the derivation cache
+func (s *Store) readDerivation(filename string) (drv Derivation, err error) {
+	f, err := os.Open(s.joinStorePath(filename))
+	if err != nil {
+		return drv, err
+	}
+	defer f.Close()
+	drv = s.newDerivation()
+	if err := json.NewDecoder(f).Decode(&drv); err != nil {
+		return drv, errors.Wrap(err, "error parsing derivation")
+	}
+	return drv, nil
+}
+
+// verifyOutput confirms that an output exists and that its normalized
+// contents match its hash. modes is the result of linkedFileModes.
+func (s *Store) verifyOutput(output Output, modes map[uint64]os.FileMode) (err error) {
+	if !fileutil.DirExists(s.joinStorePath(output.Path)) {
+		return errors.New("output is missing")
+	}
+	location, err := s.normalizedOutputCopy(output, modes)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(location)
+	return s.hashNormalizedBuildOutput(location, output.Path)
+}
+
+// verifySource confirms that a source directory exists and that its contents
+// match its hash.
+func (s *Store) verifySource(path string) (err error) {
+	if !fileutil.DirExists(s.joinStorePath(path)) {
+		return errors.New("source is missing")
+	}
+	hshr := hasher.New()
+	if err := reptar.Reptar(s.joinStorePath(path), hshr); err != nil {
+		return err
+	}
+	if hshr.String() != path {
+		return errors.Errorf("source hash %s doesn't match computed hash value %s", path, hshr.String())
+	}
+	return nil
+}
+
+// storeRepair substitutes or rebuilds derivations with broken outputs. The
+// broken outputs of dependencies are repaired first.
+type storeRepair struct {
+	store       *Store
+	builder     *Builder
+	derivations map[string]Derivation
+	// broken are the store paths that failed verification
+	broken map[string]struct{}
+	// repaired holds the result of repairing each derivation
+	repaired map[string]error
+}
+
+func (r *storeRepair) repair(ctx context.Context, filename string) (err error) {
+	if err, ok := r.repaired[filename]; ok {
+		return err
+	}
+	defer func() { r.repaired[filename] = err }()
+	drv, found := r.derivations[filename]
+	if !found {
+		return errors.Errorf("derivation %s is missing or broken", filename)
+	}
+	for _, do := range drv.Dependencies {
+		dep, found := r.derivations[do.Filename]
+		if !found {
+			return errors.Errorf("dependency %s is missing or broken", do.Filename)
+		}
+		if _, broken := r.broken[dep.output(do.OutputName).Path]; broken {
+			if err := r.repair(ctx, do.Filename); err != nil {
+				return errors.Wrapf(err, "error repairing dependency %s", do.Filename)
+			}
+		}
+	}
+	for _, output := range drv.Outputs {
+		if _, broken := r.broken[output.Path]; broken {
+			if err := os.RemoveAll(r.store.joinStorePath(output.Path)); err != nil {
+				return err
+			}
+		}
+	}
+	built, _, err := r.builder.BuildDerivation(ctx, drv, BuildDerivationOptions{})
+	if err != nil {
+		return err
+	}
+	for _, name := range drv.OutputNames {
+		if path := built.output(name).Path; path != drv.output(name).Path {
+			return errors.Errorf("derivation was built again but output %q is now %s, the build might not be reproducible",
+				name, path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_Verify(t *testing.T) {
+	s, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	dep := buildFetchDerivation(t, s, "dep", "dep")
+	root := buildFetchDerivation(t, s, "root", "I reference "+s.joinStorePath(dep.output("out").Path), dep)
+	broken := buildFetchDerivation(t, s, "broken", "broken")
+
+	result, err := s.Verify(ctx, VerifyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, result.Problems)
+	require.Equal(t, 6, result.Checked)
+
+	// Corrupt the output of a dependency and a derivation file
+	require.NoError(t, filepath.Walk(s.joinStorePath(dep.output("out").Path), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		return os.WriteFile(path, []byte("corrupted"), 0644)
+	}))
+	require.NoError(t, os.WriteFile(s.joinStorePath(broken.Filename()), []byte("{"), 0644))
+
+	result, err = s.Verify(ctx, VerifyOptions{})
+	require.NoError(t, err)
+	require.Len(t, result.Problems, 2)
+	paths := []string{}
+	for _, problem := range result.Problems {
+		paths = append(paths, problem.Path)
+	}
+	require.ElementsMatch(t, []string{broken.Filename(), dep.output("out").Path}, paths)
+
+	result, err = s.Verify(ctx, VerifyOptions{Repair: s.NewBuilder(testLockfileWriter{})})
+	require.NoError(t, err)
+	for _, problem := range result.Problems {
+		require.True(t, problem.Repaired, problem.String())
+	}
+	result, err = s.Verify(ctx, VerifyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, result.Problems)
+	require.FileExists(t, s.joinStorePath(root.Filename()))
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"context"
+	"io"
 	"runtime"
 )
 
@@ -9,6 +10,8 @@ func Platform() string { return runtime.GOOS + "_" + runtime.GOARCH }
 
 type BuildOptions struct {
 	Check bool
+	// Logs receives build output, if set
+	Logs io.Writer
 }
 
 type BuildResponse struct {
@@ -36,4 +39,7 @@ type Builder interface {
 
 type NewBuilder func(location string) (Builder, error)
 
-type DownloadGithubRepo func(url string, reference string) (location string, err error)
+// FetchSource fetches the source of a package to a new directory. The source
+// is a git url or a local directory, reference is an optional version control
+// reference to check out.
+type FetchSource func(source string, reference string) (location string, err error)
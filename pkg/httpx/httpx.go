@@ -43,24 +43,72 @@ func ErrNotAcceptable(err error) error {
 func ErrUnprocessableEntity(err error) error {
 	return ErrHTTPResponse{err: err, code: http.StatusUnprocessableEntity}
 }
+func ErrUnauthorized(err error) error {
+	return ErrHTTPResponse{err: err, code: http.StatusUnauthorized}
+}
+func ErrForbidden(err error) error {
+	return ErrHTTPResponse{err: err, code: http.StatusForbidden}
+}
+func ErrServiceUnavailable(err error) error {
+	return ErrHTTPResponse{err: err, code: http.StatusServiceUnavailable}
+}
 
 func (r Router) h(handler func(c Context) (err error)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
 		err := handler(Context{ResponseWriter: rw, Request: req, Params: p})
 		if err != nil {
-			code := http.StatusInternalServerError
-			if v, ok := err.(ErrHTTPResponse); ok {
-				code = v.code
-			}
 			if r.errHandler != nil {
-				r.errHandler(rw, err.Error(), code)
+				r.errHandler(rw, err.Error(), errCode(err))
 				return
 			}
-			http.Error(rw, err.Error(), code)
+			writeError(rw, err)
 		}
 	}
 }
 
+func errCode(err error) int {
+	if v, ok := err.(ErrHTTPResponse); ok {
+		return v.code
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(rw http.ResponseWriter, err error) {
+	http.Error(rw, err.Error(), errCode(err))
+}
+
+// Middleware returns a handler that calls fn before passing the request to
+// next. If fn returns an error it's written to the response like errors that
+// are returned from routes and next is not called.
+func Middleware(next http.Handler, fn func(c Context) error) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if err := fn(Context{ResponseWriter: rw, Request: req}); err != nil {
+			writeError(rw, err)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// BearerTokenTransport adds an Authorization header with a bearer token to
+// every request.
+type BearerTokenTransport struct {
+	Token string
+	// Transport is used to make requests, http.DefaultTransport is used if
+	// it's nil
+	Transport http.RoundTripper
+}
+
+func (t BearerTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.Token)
+	return transport.RoundTrip(req)
+}
+
 func (r Router) ErrHandler(handle func(http.ResponseWriter, string, int)) {
 	r.errHandler = handle
 	// Support multiple at different path prefixes?
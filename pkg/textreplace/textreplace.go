@@ -98,11 +98,21 @@ func CopyWithFrames(src io.Reader, dst io.Writer, buf []byte, overlapSize int, t
 		buf = make([]byte, size)
 	}
 	firstPassOffset := overlapSize
+	// The first frame must be at least as long as the overlap, if the source is
+	// shorter than that we transform and write it all at once
+	nr, er := io.ReadAtLeast(src, buf[overlapSize:], overlapSize)
+	if er == io.EOF || er == io.ErrUnexpectedEOF {
+		frame := buf[overlapSize : overlapSize+nr]
+		if err = transform(frame); err != nil {
+			return
+		}
+		nw, ew := dst.Write(frame)
+		return int64(nw), ew
+	}
+	if er != nil {
+		return 0, er
+	}
 	for {
-		nr, er := src.Read(buf[overlapSize:])
-		// TODO: if our first read is less than the length of the frame, what
-		// do we do about that?
-		// TODO: set up tests with many variable first read sizes
 		if nr > 0 {
 			if err = transform(buf[firstPassOffset:]); err != nil {
 				return
@@ -134,11 +144,10 @@ func CopyWithFrames(src io.Reader, dst io.Writer, buf []byte, overlapSize int, t
 			}
 			written += int64(nw)
 			break
-		} else {
-			// if we have read 0 and there is no error just go back and read again
-			continue
 		}
+		// if we have read 0 and there is no error we just read again
 		firstPassOffset = 0
+		nr, er = src.Read(buf[overlapSize:])
 	}
 	return
 }
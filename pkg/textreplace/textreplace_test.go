@@ -365,3 +365,18 @@ func BenchmarkUninterruptedReplaceBytes(b *testing.B) {
 		buf.Reset()
 	}
 }
+
+func TestShortInput(t *testing.T) {
+	for _, input := range []string{"", "/hi", "/hi/there"} {
+		var buf bytes.Buffer
+		replacements, _, err := ReplaceStringsPrefix(strings.NewReader(input), &buf, []string{"/hi/there/friend"}, "/hi", "/ho")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, replacements)
+		assert.Equal(t, input, buf.String())
+	}
+	var buf bytes.Buffer
+	replacements, _, err := ReplaceStringsPrefix(strings.NewReader("/hi/there"), &buf, []string{"/hi/there"}, "/hi", "/ho")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replacements)
+	assert.Equal(t, "/ho/there", buf.String())
+}